@@ -0,0 +1,248 @@
+package main
+
+// api.go holds the JSON endpoints of herus, starting with the suggestion
+// endpoint that the forms use to pick existing topics and media instead of
+// typing names and hashes by hand.
+//
+// Topic suggestions come from a prefix scan over the canonical names in the
+// topics bucket and the aliases bucket. Media suggestions come from the media
+// titles bucket, which holds every word-initial suffix of every media title
+// under the key [suffix][0][hash], so that typing any word of a title from
+// its start will find the media. The media titles bucket is kept up to date
+// by putMediaMetadata.
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strings"
+
+	"github.com/boltdb/bolt"
+)
+
+const (
+	suggestPage = "/api/suggest"
+
+	maxSuggestions = 10
+
+	// maxTitleKeyLen limits the length of the title suffixes stored in the
+	// media titles bucket.
+	maxTitleKeyLen = 64
+)
+
+var (
+	errInvalidSuggestKind = errors.New("kind must be 'topic' or 'media'")
+)
+
+// suggestion is a single entry in the response of the suggestion endpoint.
+// Name is the value that a form should submit, which is the canonical name of
+// a topic or the hash of a piece of media.
+type suggestion struct {
+	Name  string `json:"name"`
+	Title string `json:"title"`
+}
+
+// apiError is the body of an error response from a JSON endpoint.
+type apiError struct {
+	Error string `json:"error"`
+}
+
+// writeJSON writes v to the response as JSON with the provided status code.
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	err := json.NewEncoder(w).Encode(v)
+	if err != nil {
+		println(err.Error())
+	}
+}
+
+// writeJSONError writes an error response to a JSON endpoint.
+func writeJSONError(w http.ResponseWriter, status int, err error) {
+	writeJSON(w, status, apiError{Error: err.Error()})
+}
+
+// normalizeTitle converts a media title into the form used by the media
+// titles bucket.
+func normalizeTitle(title string) string {
+	return strings.Join(strings.Fields(normalizeTerm(title)), " ")
+}
+
+// mediaTitleKeys returns the keys of a piece of media in the media titles
+// bucket, one for each word of the title.
+func mediaTitleKeys(title, hash string) [][]byte {
+	title = normalizeTitle(title)
+	var keys [][]byte
+	wordStart := true
+	for i, c := range title {
+		if !isWordRune(c) {
+			wordStart = true
+			continue
+		}
+		if !wordStart {
+			continue
+		}
+		wordStart = false
+		suffix := title[i:]
+		if len(suffix) > maxTitleKeyLen {
+			suffix = strings.ToValidUTF8(suffix[:maxTitleKeyLen], "")
+		}
+		keys = append(keys, []byte(suffix+"\x00"+hash))
+	}
+	return keys
+}
+
+// indexMediaTitle moves a piece of media in the media titles bucket from its
+// old title to its new title.
+func indexMediaTitle(tx *bolt.Tx, hash, oldTitle, newTitle string) error {
+	bt := tx.Bucket(bucketMediaTitles)
+	for _, key := range mediaTitleKeys(oldTitle, hash) {
+		err := bt.Delete(key)
+		if err != nil {
+			return err
+		}
+	}
+	for _, key := range mediaTitleKeys(newTitle, hash) {
+		err := bt.Put(key, nil)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// indexAllMediaTitles records the title of every piece of media in the media
+// titles bucket. It is used to build the bucket for databases that predate
+// it.
+func indexAllMediaTitles(tx *bolt.Tx) error {
+	var hashes []string
+	err := tx.Bucket(bucketMedia).ForEach(func(k, v []byte) error {
+		hashes = append(hashes, string(k))
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	for _, hash := range hashes {
+		mm, _, err := getMediaMetadata(tx, hash)
+		if err != nil {
+			return err
+		}
+		err = indexMediaTitle(tx, hash, "", mm.Title)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// suggestTopics returns the topics whose canonical name, or one of whose
+// aliases, starts with the prefix.
+func suggestTopics(tx *bolt.Tx, prefix string) ([]suggestion, error) {
+	p := []byte(canonicalTopicName(prefix))
+	if len(p) == 0 {
+		return nil, nil
+	}
+	var names []string
+	seen := make(map[string]bool)
+	add := func(name string) {
+		if !seen[name] && len(names) < maxSuggestions {
+			seen[name] = true
+			names = append(names, name)
+		}
+	}
+	c := tx.Bucket(bucketTopics).Cursor()
+	for k, _ := c.Seek(p); k != nil && bytes.HasPrefix(k, p) && len(names) < maxSuggestions; k, _ = c.Next() {
+		add(string(k))
+	}
+	c = tx.Bucket(bucketAliases).Cursor()
+	for k, _ := c.Seek(p); k != nil && bytes.HasPrefix(k, p) && len(names) < maxSuggestions; k, _ = c.Next() {
+		target, err := resolveTopic(tx, string(k))
+		if err != nil {
+			return nil, err
+		}
+		add(target)
+	}
+
+	var suggestions []suggestion
+	for _, name := range names {
+		td, exists, err := getTopic(tx, name)
+		if err != nil {
+			return nil, err
+		}
+		if !exists {
+			continue
+		}
+		title := td.Title
+		if title == "" {
+			title = topicTitleFromName(name)
+		}
+		suggestions = append(suggestions, suggestion{Name: name, Title: title})
+	}
+	return suggestions, nil
+}
+
+// suggestMedia returns the media with a word in its title that starts with
+// the prefix.
+func suggestMedia(tx *bolt.Tx, prefix string) ([]suggestion, error) {
+	p := []byte(normalizeTitle(prefix))
+	if len(p) == 0 {
+		return nil, nil
+	}
+	var suggestions []suggestion
+	seen := make(map[string]bool)
+	c := tx.Bucket(bucketMediaTitles).Cursor()
+	for k, _ := c.Seek(p); k != nil && bytes.HasPrefix(k, p) && len(suggestions) < maxSuggestions; k, _ = c.Next() {
+		i := bytes.LastIndexByte(k, 0)
+		if i < 0 {
+			continue
+		}
+		hash := string(k[i+1:])
+		if seen[hash] {
+			continue
+		}
+		seen[hash] = true
+		mm, exists, err := getMediaMetadata(tx, hash)
+		if err != nil {
+			return nil, err
+		}
+		if !exists || mm.Hidden {
+			continue
+		}
+		suggestions = append(suggestions, suggestion{Name: hash, Title: mm.Title})
+	}
+	return suggestions, nil
+}
+
+// suggestHandler handles requests for topics or media that start with a
+// prefix, responding with a JSON list of suggestions.
+func (h *herus) suggestHandler(w http.ResponseWriter, r *http.Request) {
+	kind := r.URL.Query().Get("kind")
+	prefix := r.URL.Query().Get("prefix")
+	var suggest func(*bolt.Tx, string) ([]suggestion, error)
+	switch kind {
+	case itemKindTopic:
+		suggest = suggestTopics
+	case itemKindMedia:
+		suggest = suggestMedia
+	default:
+		writeJSONError(w, http.StatusBadRequest, errInvalidSuggestKind)
+		return
+	}
+
+	suggestions := []suggestion{}
+	err := h.db.View(func(tx *bolt.Tx) error {
+		s, err := suggest(tx, prefix)
+		if err != nil {
+			return err
+		}
+		suggestions = append(suggestions, s...)
+		return nil
+	})
+	if err != nil {
+		writeJSONError(w, http.StatusInternalServerError, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, suggestions)
+}
@@ -0,0 +1,424 @@
+package main
+
+// apiv1.go implements version 1 of the JSON API, which lets scripts read and
+// write topics, relations, and media. The routes are:
+//
+//	GET  /api/v1/topics/<name>  a topic with its media and relations
+//	POST /api/v1/topics         create a topic from {"title", "description"}
+//	POST /api/v1/relations      connect two topics from {"source",
+//	                            "destination", "type"}
+//	GET  /api/v1/media/<hash>   a piece of media with its elaborations
+//	POST /api/v1/media          upload media as a multipart form with the
+//	                            same fields as the upload page
+//	     /api/v1/uploads        resumable uploads, see resumable.go
+//
+// Writes go through the same functions as the html forms, so the API and the
+// site always agree. Scripts can authenticate with an API token instead of a
+// session cookie, see token.go. Errors are returned as {"error": "..."} with a
+// status code that reflects the kind of error.
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/boltdb/bolt"
+)
+
+const (
+	apiV1Prefix = "/api/v1/"
+
+	// maxAPIBodyLen limits the size of the JSON bodies accepted by the API.
+	maxAPIBodyLen = 1 << 20 // 1 MB
+)
+
+var (
+	errMissingMedia    = errors.New("media does not exist")
+	errMissingResource = errors.New("no such api resource")
+	errWrongMethod     = errors.New("method not allowed for this resource")
+)
+
+// apiMediaRelation is a piece of media on a topic, as returned by the API.
+type apiMediaRelation struct {
+	Hash           string    `json:"hash"`
+	Title          string    `json:"title"`
+	Submitter      string    `json:"submitter"`
+	SubmissionDate time.Time `json:"submissionDate"`
+
+	Upvotes    uint64 `json:"upvotes"`
+	Downvotes  uint64 `json:"downvotes"`
+	LeftVotes  uint64 `json:"leftVotes"`
+	RightVotes uint64 `json:"rightVotes"`
+}
+
+// apiRelation is a relation between two topics, as returned by the API.
+type apiRelation struct {
+	Source         string    `json:"source"`
+	Destination    string    `json:"destination"`
+	Type           string    `json:"type"`
+	Submitter      string    `json:"submitter"`
+	SubmissionDate time.Time `json:"submissionDate"`
+
+	Upvotes     uint64 `json:"upvotes"`
+	Downvotes   uint64 `json:"downvotes"`
+	LeftVotes   uint64 `json:"leftVotes"`
+	CenterVotes uint64 `json:"centerVotes"`
+	RightVotes  uint64 `json:"rightVotes"`
+}
+
+// apiTopic is a topic as returned by the API. Relations holds the relations
+// on both ends of the topic.
+type apiTopic struct {
+	Name         string    `json:"name"`
+	Title        string    `json:"title"`
+	Description  string    `json:"description"`
+	Creator      string    `json:"creator"`
+	CreationDate time.Time `json:"creationDate"`
+
+	Media     []apiMediaRelation `json:"media"`
+	Relations []apiRelation      `json:"relations"`
+}
+
+// apiElaboration is an elaboration on a piece of media, as returned by the
+// API.
+type apiElaboration struct {
+	Hash           string    `json:"hash"`
+	Title          string    `json:"title"`
+	Submitter      string    `json:"submitter"`
+	SubmissionDate time.Time `json:"submissionDate"`
+
+	Upvotes   uint64 `json:"upvotes"`
+	Downvotes uint64 `json:"downvotes"`
+}
+
+// apiMedia is a piece of media as returned by the API.
+type apiMedia struct {
+	Hash        string `json:"hash"`
+	Title       string `json:"title"`
+	ContentType string `json:"contentType"`
+	URL         string `json:"url"`
+	Thumbnail   string `json:"thumbnail,omitempty"`
+	Preview     string `json:"preview,omitempty"`
+	Text        string `json:"text,omitempty"`
+	TextStatus  string `json:"textStatus,omitempty"`
+
+	Elaborations []apiElaboration `json:"elaborations"`
+}
+
+// apiTopicRequest is the body of a request to create a topic.
+type apiTopicRequest struct {
+	Title       string `json:"title"`
+	Description string `json:"description"`
+}
+
+// apiRelationRequest is the body of a request to connect two topics.
+type apiRelationRequest struct {
+	Source      string `json:"source"`
+	Destination string `json:"destination"`
+	Type        string `json:"type"`
+}
+
+// apiErrorStatus returns the status code that an error is reported with.
+func apiErrorStatus(err error) int {
+	switch err {
+	case errMissingMedia, errMissingResource, errMissingTopic, errMissingUpload:
+		return http.StatusNotFound
+	case errDuplicateElaboration, errDuplicateMedia, errDuplicateRelation, errDuplicateTopic, errIncompleteUpload, errUploadHashMismatch:
+		return http.StatusConflict
+	case errNotLoggedIn:
+		return http.StatusUnauthorized
+	case errNoPermission:
+		return http.StatusForbidden
+	case errChunkTooLarge, errUploadTooLarge:
+		return http.StatusRequestEntityTooLarge
+	case errDisallowedMediaType:
+		return http.StatusUnsupportedMediaType
+	case errWrongMethod:
+		return http.StatusMethodNotAllowed
+	}
+	return http.StatusBadRequest
+}
+
+// apiRequireRole returns the user making an API request if the user holds the
+// provided role. Otherwise an error is written to the response.
+func apiRequireRole(w http.ResponseWriter, r *http.Request, role string) (User, bool) {
+	user, ok := currentUser(r)
+	if !ok {
+		writeJSONError(w, http.StatusUnauthorized, errNotLoggedIn)
+		return User{}, false
+	}
+	if !hasRole(user, role) {
+		writeJSONError(w, http.StatusForbidden, errNoPermission)
+		return User{}, false
+	}
+	return user, true
+}
+
+// decodeAPIBody decodes the JSON body of an API request into v.
+func decodeAPIBody(w http.ResponseWriter, r *http.Request, v interface{}) error {
+	return json.NewDecoder(http.MaxBytesReader(w, r.Body, maxAPIBodyLen)).Decode(v)
+}
+
+// getAPITopic builds the API representation of a topic. Hidden media and
+// relations are left out.
+func getAPITopic(tx *bolt.Tx, name string) (apiTopic, error) {
+	name, err := resolveTopic(tx, name)
+	if err != nil {
+		return apiTopic{}, err
+	}
+	td, exists, err := getTopic(tx, name)
+	if err != nil {
+		return apiTopic{}, err
+	}
+	if !exists {
+		return apiTopic{}, errMissingTopic
+	}
+	at := apiTopic{
+		Name:         name,
+		Title:        td.Title,
+		Description:  td.Description,
+		Creator:      td.Creator,
+		CreationDate: td.CreationDate,
+
+		Media:     []apiMediaRelation{},
+		Relations: []apiRelation{},
+	}
+	if at.Title == "" {
+		at.Title = topicTitleFromName(name)
+	}
+	for _, mr := range visibleMedia(td.AssociatedMedia) {
+		at.Media = append(at.Media, apiMediaRelation{
+			Hash:           mr.Hash,
+			Title:          mr.Title,
+			Submitter:      mr.Submitter,
+			SubmissionDate: mr.SubmissionDate,
+
+			Upvotes:    mr.Upvotes,
+			Downvotes:  mr.Downvotes,
+			LeftVotes:  mr.LeftVotes,
+			RightVotes: mr.RightVotes,
+		})
+	}
+	prerequisites, subtopics, seeAlso, err := topicRelations(tx, name, td)
+	if err != nil {
+		return apiTopic{}, err
+	}
+	for _, group := range [][]relatedTopic{prerequisites, subtopics, seeAlso} {
+		for _, rt := range group {
+			at.Relations = append(at.Relations, apiRelation{
+				Source:         rt.Page,
+				Destination:    rt.Title,
+				Type:           rt.RelationType(),
+				Submitter:      rt.Submitter,
+				SubmissionDate: rt.SubmissionDate,
+
+				Upvotes:     rt.Upvotes,
+				Downvotes:   rt.Downvotes,
+				LeftVotes:   rt.LeftVotes,
+				CenterVotes: rt.CenterVotes,
+				RightVotes:  rt.RightVotes,
+			})
+		}
+	}
+	return at, nil
+}
+
+// getAPIMedia builds the API representation of a piece of media. Hidden
+// elaborations are left out.
+func getAPIMedia(tx *bolt.Tx, hash string) (apiMedia, error) {
+	mm, exists, err := getMediaMetadata(tx, hash)
+	if err != nil {
+		return apiMedia{}, err
+	}
+	if !exists {
+		return apiMedia{}, errMissingMedia
+	}
+	am := apiMedia{
+		Hash:        hash,
+		Title:       mm.Title,
+		ContentType: mm.ContentType,
+		URL:         mediaPrefix + hash,
+		Thumbnail:   mm.Thumbnail,
+		Preview:     mm.Preview,
+		TextStatus:  mm.TextStatus,
+
+		Elaborations: []apiElaboration{},
+	}
+	if mm.TextStatus == textReady {
+		am.Text = mediaPrefix + hash + textSuffix
+	}
+	for _, me := range visibleElaborations(mm.Elaborations) {
+		am.Elaborations = append(am.Elaborations, apiElaboration{
+			Hash:           me.Hash,
+			Title:          me.Title,
+			Submitter:      me.Submitter,
+			SubmissionDate: me.SubmissionDate,
+
+			Upvotes:   me.Upvotes,
+			Downvotes: me.Downvotes,
+		})
+	}
+	return am, nil
+}
+
+// apiGetTopic handles requests for a topic.
+func (h *herus) apiGetTopic(w http.ResponseWriter, r *http.Request, name string) {
+	var at apiTopic
+	err := h.db.View(func(tx *bolt.Tx) error {
+		var err error
+		at, err = getAPITopic(tx, name)
+		return err
+	})
+	if err != nil {
+		writeJSONError(w, apiErrorStatus(err), err)
+		return
+	}
+	writeJSON(w, http.StatusOK, at)
+}
+
+// apiCreateTopic handles requests to create a topic.
+func (h *herus) apiCreateTopic(w http.ResponseWriter, r *http.Request) {
+	user, ok := apiRequireRole(w, r, memberContributor)
+	if !ok {
+		return
+	}
+	var req apiTopicRequest
+	err := decodeAPIBody(w, r, &req)
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest, err)
+		return
+	}
+	var at apiTopic
+	err = h.db.Update(func(tx *bolt.Tx) error {
+		name, err := createTopic(tx, user, req.Title, req.Description)
+		if err != nil {
+			return err
+		}
+		at, err = getAPITopic(tx, name)
+		return err
+	})
+	if err != nil {
+		writeJSONError(w, apiErrorStatus(err), err)
+		return
+	}
+	writeJSON(w, http.StatusCreated, at)
+}
+
+// apiCreateRelation handles requests to connect two topics. The response is
+// the source topic with the new relation.
+func (h *herus) apiCreateRelation(w http.ResponseWriter, r *http.Request) {
+	user, ok := apiRequireRole(w, r, memberContributor)
+	if !ok {
+		return
+	}
+	var req apiRelationRequest
+	err := decodeAPIBody(w, r, &req)
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest, err)
+		return
+	}
+	var at apiTopic
+	err = h.db.Update(func(tx *bolt.Tx) error {
+		err := connectTopics(tx, user, req.Source, req.Destination, req.Type)
+		if err != nil {
+			return err
+		}
+		at, err = getAPITopic(tx, req.Source)
+		return err
+	})
+	if err != nil {
+		writeJSONError(w, apiErrorStatus(err), err)
+		return
+	}
+	writeJSON(w, http.StatusCreated, at)
+}
+
+// apiGetMedia handles requests for a piece of media.
+func (h *herus) apiGetMedia(w http.ResponseWriter, r *http.Request, hash string) {
+	var am apiMedia
+	err := h.db.View(func(tx *bolt.Tx) error {
+		var err error
+		am, err = getAPIMedia(tx, hash)
+		return err
+	})
+	if err != nil {
+		writeJSONError(w, apiErrorStatus(err), err)
+		return
+	}
+	writeJSON(w, http.StatusOK, am)
+}
+
+// apiUploadMedia handles uploads made through the API.
+func (h *herus) apiUploadMedia(w http.ResponseWriter, r *http.Request) {
+	user, ok := apiRequireRole(w, r, memberContributor)
+	if !ok {
+		return
+	}
+	su, fields, err := h.readUploadForm(w, r)
+	if err != nil {
+		writeJSONError(w, apiErrorStatus(err), err)
+		return
+	}
+	defer su.discard()
+
+	hash, err := h.storeUpload(user, su, fields.Get("title"), fields.Get("parentTopic"), fields.Get("parentMedia"))
+	if err != nil {
+		writeJSONError(w, apiErrorStatus(err), err)
+		return
+	}
+	var am apiMedia
+	err = h.db.View(func(tx *bolt.Tx) error {
+		var err error
+		am, err = getAPIMedia(tx, hash)
+		return err
+	})
+	if err != nil {
+		writeJSONError(w, apiErrorStatus(err), err)
+		return
+	}
+	writeJSON(w, http.StatusCreated, am)
+}
+
+// apiV1Handler sends each request to the API to the handler for its resource
+// and method. Requests made with an API token need the read scope to fetch
+// resources, the connect scope to create topics and relations, and the
+// upload scope to upload media, including resumable uploads.
+func (h *herus) apiV1Handler(w http.ResponseWriter, r *http.Request) {
+	parts := strings.SplitN(strings.TrimPrefix(r.URL.Path, apiV1Prefix), "/", 2)
+	resource, id := parts[0], ""
+	if len(parts) == 2 {
+		id = parts[1]
+	}
+
+	var scope string
+	var handler http.HandlerFunc
+	switch {
+	case resource == "topics" && id == "" && r.Method == "POST":
+		scope, handler = scopeConnect, h.apiCreateTopic
+	case resource == "topics" && id != "" && r.Method == "GET":
+		scope, handler = scopeRead, func(w http.ResponseWriter, r *http.Request) { h.apiGetTopic(w, r, id) }
+	case resource == "relations" && id == "" && r.Method == "POST":
+		scope, handler = scopeConnect, h.apiCreateRelation
+	case resource == "media" && id == "" && r.Method == "POST":
+		scope, handler = scopeUpload, h.apiUploadMedia
+	case resource == "media" && id != "" && r.Method == "GET":
+		scope, handler = scopeRead, func(w http.ResponseWriter, r *http.Request) { h.apiGetMedia(w, r, id) }
+	case resource == "uploads":
+		scope, handler = scopeUpload, func(w http.ResponseWriter, r *http.Request) { h.apiUploadsHandler(w, r, id) }
+	case resource == "topics" || resource == "relations" || resource == "media":
+		writeJSONError(w, http.StatusMethodNotAllowed, errWrongMethod)
+		return
+	default:
+		writeJSONError(w, http.StatusNotFound, errMissingResource)
+		return
+	}
+
+	r, err := authorizeScope(r, scope)
+	if err != nil {
+		writeJSONError(w, http.StatusForbidden, err)
+		return
+	}
+	handler(w, r)
+}
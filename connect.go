@@ -6,7 +6,6 @@ import (
 	"io"
 	"net/http"
 	"path/filepath"
-	"strings"
 	"time"
 
 	"github.com/boltdb/bolt"
@@ -39,7 +38,8 @@ func (h *herus) connectHandler(w http.ResponseWriter, r *http.Request) {
 	var ctd connectTemplateData
 	var err error
 	if r.Method == "POST" {
-		err = h.processConnectSubmission(r)
+		user, _ := currentUser(r)
+		err = h.processConnectSubmission(r, user)
 		if err != nil {
 			ctd.ErrorExists = true
 			ctd.Error = err.Error()
@@ -75,55 +75,72 @@ func executeConnectBody(w io.Writer, ctd connectTemplateData) error {
 	return t.Execute(w, ctd)
 }
 
-// processConnectSubmission processes a request to connect two topics.
-func (h *herus) processConnectSubmission(r *http.Request) error {
+// connectTopics adds a relation of the provided type from the source topic to
+// the destination topic on behalf of the user. Both topics must already
+// exist.
+func connectTopics(tx *bolt.Tx, user User, source, destination, relationType string) error {
+	relationType, err := parseRelationType(relationType)
+	if err != nil {
+		return err
+	}
+	sourceTopic, err := resolveTopic(tx, source)
+	if err != nil {
+		return err
+	}
+	destinationTopic, err := resolveTopic(tx, destination)
+	if err != nil {
+		return err
+	}
+	sourceTD, exists1, err := getTopic(tx, sourceTopic)
+	if err != nil {
+		return err
+	}
+	_, exists2, err := getTopic(tx, destinationTopic)
+	if err != nil {
+		return err
+	}
+	if !exists1 {
+		return errMissingSourceTopic
+	}
+	if !exists2 {
+		return errMissingDestinationTopic
+	}
+
+	// Check if the two topics are already related in either direction.
+	if sourceTopic == destinationTopic || hasRelation(tx, sourceTopic, destinationTopic) {
+		return errDuplicateRelation
+	}
+
+	// Add the relation.
+	sourceTD.RelatedTopics = append(sourceTD.RelatedTopics, topicRelation{
+		Title:          destinationTopic,
+		Type:           relationType,
+		SubmissionDate: time.Now(),
+		Submitter:      user.Name,
+
+		Downvotes:  0,
+		LeftVotes:  0,
+		RightVotes: 0,
+		Upvotes:    submittedUpvotes,
+	})
+	err = putTopic(tx, sourceTopic, sourceTD, user.Name)
+	if err != nil {
+		return err
+	}
+	return incrementPosts(tx, user.Name)
+}
+
+// processConnectSubmission processes a request from the user to connect two
+// topics.
+func (h *herus) processConnectSubmission(r *http.Request, user User) error {
 	err := r.ParseForm()
 	if err != nil {
 		return err
 	}
-	sourceTopic := r.FormValue("sourceTopic")
-	sourceTopic = strings.Replace(sourceTopic, " ", "_", -1)
-	sourceTopic = strings.ToLower(sourceTopic)
-	destinationTopic := r.FormValue("destinationTopic")
-	destinationTopic = strings.Replace(destinationTopic, " ", "_", -1)
-	destinationTopic = strings.ToLower(destinationTopic)
 
 	// Add the topic relation to the source topic db file, but only if the
 	// destination topic already exists.
 	return h.db.Update(func(tx *bolt.Tx) error {
-		sourceTD, exists1, err := getTopic(tx, sourceTopic)
-		if err != nil {
-			return err
-		}
-		_, exists2, err := getTopic(tx, destinationTopic)
-		if err != nil {
-			return err
-		}
-		if !exists1 {
-			return errMissingSourceTopic
-		}
-		if !exists2 {
-			return errMissingDestinationTopic
-		}
-
-		// Check if the relation being created already exists.
-		for _, relation := range sourceTD.RelatedTopics {
-			if relation.Title == destinationTopic {
-				return errDuplicateRelation
-			}
-		}
-
-		// Add the relation.
-		sourceTD.RelatedTopics = append(sourceTD.RelatedTopics, topicRelation{
-			Title:          destinationTopic,
-			SubmissionDate: time.Now(),
-			// Submitter:
-
-			Downvotes:  0,
-			LeftVotes:  0,
-			RightVotes: 0,
-			Upvotes:    3,
-		})
-		return putTopic(tx, sourceTopic, sourceTD)
+		return connectTopics(tx, user, r.FormValue("sourceTopic"), r.FormValue("destinationTopic"), r.FormValue("relation"))
 	})
 }
@@ -0,0 +1,234 @@
+package main
+
+// create.go produces the pages that are used to create new topics and to edit
+// the title and description of existing topics.
+
+import (
+	"errors"
+	"html/template"
+	"io"
+	"net/http"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/boltdb/bolt"
+)
+
+const (
+	createPage = "/create.go"
+	editSuffix = "/edit"
+
+	createTitle = "Create a Topic"
+	editTitle   = "Edit a Topic"
+
+	maxDescriptionLen = 64 << 10 // 64 KB
+)
+
+var (
+	createTpl = filepath.Join(dirTemplates, "create.tpl")
+
+	errDuplicateTopic    = errors.New("topic already exists")
+	errLongDescription   = errors.New("topic description is too long")
+	errMissingTopic      = errors.New("topic does not exist")
+	errMissingTopicTitle = errors.New("topic must have a title")
+)
+
+// createTemplateData defines the data which is used to fill out the create
+// template file.
+type createTemplateData struct {
+	Action      string
+	Description string
+	Editing     bool
+	Error       string
+	ErrorExists bool
+	Title       string
+}
+
+// executeCreateBody builds the body portion of the create page.
+func executeCreateBody(w io.Writer, ctd createTemplateData) error {
+	t, err := template.ParseFiles(createTpl)
+	if err != nil {
+		return err
+	}
+	return t.Execute(w, ctd)
+}
+
+// createTopic creates a new topic on behalf of the user, returning the name
+// of the new topic.
+func createTopic(tx *bolt.Tx, user User, title, description string) (string, error) {
+	title = strings.TrimSpace(title)
+	if title == "" {
+		return "", errMissingTopicTitle
+	}
+	if len(description) > maxDescriptionLen {
+		return "", errLongDescription
+	}
+	topicName := canonicalTopicName(title)
+	if topicName == "" {
+		return "", errInvalidTopicName
+	}
+
+	// The name must not already be taken by a topic or an alias.
+	resolved, err := resolveTopic(tx, topicName)
+	if err != nil {
+		return "", err
+	}
+	if resolved != topicName {
+		return "", errDuplicateTopic
+	}
+	_, exists, err := getTopic(tx, topicName)
+	if err != nil {
+		return "", err
+	}
+	if exists {
+		return "", errDuplicateTopic
+	}
+	td := topicData{
+		Title:        title,
+		Description:  description,
+		Creator:      user.Name,
+		CreationDate: time.Now(),
+	}
+	err = putTopic(tx, topicName, td, user.Name)
+	if err != nil {
+		return "", err
+	}
+	return topicName, incrementPosts(tx, user.Name)
+}
+
+// processCreateSubmission creates a new topic from the submitted form,
+// returning the name of the new topic.
+func (h *herus) processCreateSubmission(r *http.Request, user User) (string, error) {
+	err := r.ParseForm()
+	if err != nil {
+		return "", err
+	}
+	var topicName string
+	err = h.db.Update(func(tx *bolt.Tx) error {
+		var err error
+		topicName, err = createTopic(tx, user, r.FormValue("title"), r.FormValue("description"))
+		return err
+	})
+	return topicName, err
+}
+
+// createHandler handles requests to the create page. A successful submission
+// sends the user to the page of the new topic.
+func (h *herus) createHandler(w http.ResponseWriter, r *http.Request) {
+	ctd := createTemplateData{
+		Action: createPage,
+		Title:  r.URL.Query().Get("title"),
+	}
+	if r.Method == "POST" {
+		user, _ := currentUser(r)
+		topicName, err := h.processCreateSubmission(r, user)
+		if err == nil {
+			http.Redirect(w, r, topicURL(topicName), http.StatusSeeOther)
+			return
+		}
+		ctd.ErrorExists = true
+		ctd.Error = err.Error()
+		ctd.Title = r.FormValue("title")
+		ctd.Description = r.FormValue("description")
+	}
+
+	err := executeHeader(w, HeaderTemplateData{Title: createTitle})
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	err = executeCreateBody(w, ctd)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	err = executeFooter(w)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+}
+
+// processEditSubmission replaces the title and description of a topic with
+// the submitted values.
+func (h *herus) processEditSubmission(r *http.Request, user User, topicName string) error {
+	err := r.ParseForm()
+	if err != nil {
+		return err
+	}
+	title := strings.TrimSpace(r.FormValue("title"))
+	description := r.FormValue("description")
+	if title == "" {
+		return errMissingTopicTitle
+	}
+	if len(description) > maxDescriptionLen {
+		return errLongDescription
+	}
+
+	return h.db.Update(func(tx *bolt.Tx) error {
+		td, exists, err := getTopic(tx, topicName)
+		if err != nil {
+			return err
+		}
+		if !exists {
+			return errMissingTopic
+		}
+		td.Title = title
+		td.Description = description
+		return putTopic(tx, topicName, td, user.Name)
+	})
+}
+
+// editHandler handles requests to edit the title and description of a topic.
+func (h *herus) editHandler(w http.ResponseWriter, r *http.Request, topicName string) {
+	ctd := createTemplateData{
+		Action:  topicURL(topicName) + editSuffix,
+		Editing: true,
+	}
+	if r.Method == "POST" {
+		user, _ := currentUser(r)
+		err := h.processEditSubmission(r, user, topicName)
+		if err == nil {
+			http.Redirect(w, r, topicURL(topicName), http.StatusSeeOther)
+			return
+		}
+		ctd.ErrorExists = true
+		ctd.Error = err.Error()
+		ctd.Title = r.FormValue("title")
+		ctd.Description = r.FormValue("description")
+	} else {
+		err := h.db.View(func(tx *bolt.Tx) error {
+			td, exists, err := getTopic(tx, topicName)
+			if err != nil {
+				return err
+			}
+			if !exists {
+				return errMissingTopic
+			}
+			ctd.Title = td.Title
+			ctd.Description = td.Description
+			return nil
+		})
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+
+	err := executeHeader(w, HeaderTemplateData{Title: editTitle})
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	err = executeCreateBody(w, ctd)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	err = executeFooter(w)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+}
@@ -0,0 +1,384 @@
+package main
+
+// derive.go generates the derived assets of uploaded media: a small thumbnail
+// for every image and pdf, and a larger preview of the first page of every
+// pdf. Derived assets are written to the derived folder under the hash of the
+// media they come from and served from derivedPrefix.
+//
+// Generating assets can be slow, so uploads only queue the media, and a single
+// background thread works through the queue. The state of each piece of media
+// is kept in the AssetsStatus of its metadata. Media that has never been
+// processed, including media that was dropped because the queue was full, is
+// picked up again when the server starts.
+//
+// Images are decoded and scaled in pure Go, which covers png, jpeg, and gif.
+// Pdfs are rendered with pdftoppm or mutool when either is installed; without
+// them pdfs are marked as unsupported.
+//
+// The same thread extracts the text of each piece of media, see extract.go.
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"image"
+	"image/color"
+	_ "image/gif"  // register the gif decoder
+	_ "image/jpeg" // register the jpeg decoder
+	"image/png"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/boltdb/bolt"
+)
+
+const (
+	derivedPrefix = "/d/"
+
+	assetsFailed      = "failed"
+	assetsPending     = ""
+	assetsReady       = "ready"
+	assetsUnsupported = "unsupported"
+
+	previewFile   = "preview.png"
+	thumbnailFile = "thumbnail.png"
+
+	deriveQueueLen   = 256
+	pdfPreviewWidth  = 800
+	pdfRenderTimeout = 30 * time.Second
+	thumbnailSize    = 160
+
+	// maxDecodePixels limits the size of the images that are decoded, so
+	// that a small file claiming enormous dimensions cannot exhaust memory.
+	maxDecodePixels = 50 << 20
+)
+
+var (
+	errImageTooLarge   = errors.New("image is too large to make a thumbnail from")
+	errNoPDFRenderer   = errors.New("no pdf renderer is installed")
+	errPDFRenderFailed = errors.New("pdf renderer did not produce an image")
+)
+
+// derivedPath returns the path in the derived folder of an asset of a piece
+// of media.
+func derivedPath(hash, name string) string {
+	return filepath.Join(dirDerived, hash, name)
+}
+
+// derivedURL returns the url that an asset of a piece of media is served at.
+func derivedURL(hash, name string) string {
+	return derivedPrefix + hash + "/" + name
+}
+
+// queueDerivedAssets asks the background thread to generate the assets of a
+// piece of media. Media is dropped if the queue is full and picked up again
+// when the server restarts.
+func (h *herus) queueDerivedAssets(hash string) {
+	select {
+	case h.deriveQueue <- hash:
+	default:
+	}
+}
+
+// queuePendingAssets queues every piece of media whose assets or text have not
+// been generated.
+func (h *herus) queuePendingAssets() {
+	var pending []string
+	err := h.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(bucketMedia).ForEach(func(k, v []byte) error {
+			var mm mediaMetadata
+			err := json.Unmarshal(v, &mm)
+			if err != nil {
+				return err
+			}
+			if mm.AssetsStatus == assetsPending || mm.TextStatus == textPending {
+				pending = append(pending, string(k))
+			}
+			return nil
+		})
+	})
+	if err != nil {
+		println(err.Error())
+		return
+	}
+	for _, hash := range pending {
+		h.deriveQueue <- hash
+	}
+}
+
+// threadedDeriveAssets generates the assets of the media in the queue, one at
+// a time.
+func (h *herus) threadedDeriveAssets() {
+	go h.queuePendingAssets()
+	for hash := range h.deriveQueue {
+		err := h.deriveAssets(hash)
+		if err != nil {
+			println(err.Error())
+		}
+	}
+}
+
+// deriveAssets generates the assets and extracts the text of a piece of media
+// unless that has already been done.
+func (h *herus) deriveAssets(hash string) error {
+	var mm mediaMetadata
+	var exists bool
+	err := h.db.View(func(tx *bolt.Tx) error {
+		var err error
+		mm, exists, err = getMediaMetadata(tx, hash)
+		return err
+	})
+	if err != nil || !exists {
+		return err
+	}
+	path := filepath.Join(dirMedia, hash)
+	contentType, err := mediaContentType(mm, path)
+	if err != nil {
+		return err
+	}
+	if mm.AssetsStatus == assetsPending {
+		err = h.generateAssets(hash, path, contentType)
+		if err != nil {
+			return err
+		}
+	}
+	if mm.TextStatus == textPending {
+		return h.extractMediaText(hash, mm.Title, path, contentType)
+	}
+	return nil
+}
+
+// generateAssets generates the assets of a piece of media and records them in
+// its metadata.
+func (h *herus) generateAssets(hash, path, contentType string) error {
+	var err error
+	var thumbnail, preview string
+	status := assetsReady
+	switch baseMediaType(contentType) {
+	case "image/gif", "image/jpeg", "image/png":
+		err = writeThumbnail(path, derivedPath(hash, thumbnailFile))
+		thumbnail = derivedURL(hash, thumbnailFile)
+	case "application/pdf":
+		err = renderPDFPreview(path, derivedPath(hash, previewFile))
+		if err == nil {
+			err = writeThumbnail(derivedPath(hash, previewFile), derivedPath(hash, thumbnailFile))
+		}
+		preview = derivedURL(hash, previewFile)
+		thumbnail = derivedURL(hash, thumbnailFile)
+	default:
+		status = assetsUnsupported
+	}
+	if err == errNoPDFRenderer {
+		status = assetsUnsupported
+	} else if err != nil {
+		println("unable to generate assets for " + hash + ": " + err.Error())
+		status = assetsFailed
+	}
+	if status != assetsReady {
+		thumbnail, preview = "", ""
+	}
+
+	return h.db.Update(func(tx *bolt.Tx) error {
+		mm, exists, err := getMediaMetadata(tx, hash)
+		if err != nil || !exists {
+			return err
+		}
+		mm.AssetsStatus = status
+		mm.Preview = preview
+		mm.Thumbnail = thumbnail
+		return putMediaMetadata(tx, hash, mm)
+	})
+}
+
+// mediaThumbnails returns the urls of the thumbnails of the provided media,
+// keyed by hash. Media without a thumbnail is left out.
+func mediaThumbnails(tx *bolt.Tx, media []mediaRelation) (map[string]string, error) {
+	thumbnails := make(map[string]string)
+	for _, mr := range media {
+		mm, _, err := getMediaMetadata(tx, mr.Hash)
+		if err != nil {
+			return nil, err
+		}
+		if mm.Thumbnail != "" {
+			thumbnails[mr.Hash] = mm.Thumbnail
+		}
+	}
+	return thumbnails, nil
+}
+
+// elaborationThumbnails returns the urls of the thumbnails of the provided
+// elaborations, keyed by hash. Elaborations without a thumbnail are left out.
+func elaborationThumbnails(tx *bolt.Tx, elaborations []mediaElaboration) (map[string]string, error) {
+	thumbnails := make(map[string]string)
+	for _, me := range elaborations {
+		mm, _, err := getMediaMetadata(tx, me.Hash)
+		if err != nil {
+			return nil, err
+		}
+		if mm.Thumbnail != "" {
+			thumbnails[me.Hash] = mm.Thumbnail
+		}
+	}
+	return thumbnails, nil
+}
+
+// writeAsset writes an image to the derived folder as a png. The image is
+// written to a temporary file first so that a half written asset is never
+// served.
+func writeAsset(dst string, img image.Image) error {
+	err := os.MkdirAll(filepath.Dir(dst), 0700)
+	if err != nil {
+		return err
+	}
+	f, err := ioutil.TempFile(filepath.Dir(dst), tempUploadPrefix)
+	if err != nil {
+		return err
+	}
+	err = png.Encode(f, img)
+	closeErr := f.Close()
+	if err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(f.Name(), dst)
+	}
+	if err != nil {
+		os.Remove(f.Name())
+	}
+	return err
+}
+
+// writeThumbnail scales the image at src down to a thumbnail and writes it to
+// dst.
+func writeThumbnail(src, dst string) error {
+	f, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	config, _, err := image.DecodeConfig(f)
+	if err != nil {
+		return err
+	}
+	if config.Width*config.Height > maxDecodePixels {
+		return errImageTooLarge
+	}
+	_, err = f.Seek(0, 0)
+	if err != nil {
+		return err
+	}
+	img, _, err := image.Decode(f)
+	if err != nil {
+		return err
+	}
+	return writeAsset(dst, scaleToFit(img, thumbnailSize))
+}
+
+// scaleToFit shrinks an image so that neither side is longer than size,
+// averaging the pixels that fold into each pixel of the result. Images that
+// already fit are copied as they are.
+func scaleToFit(src image.Image, size int) *image.RGBA {
+	b := src.Bounds()
+	w, h := b.Dx(), b.Dy()
+	dw, dh := w, h
+	if w > size || h > size {
+		if w >= h {
+			dw, dh = size, max(1, h*size/w)
+		} else {
+			dw, dh = max(1, w*size/h), size
+		}
+	}
+
+	dst := image.NewRGBA(image.Rect(0, 0, dw, dh))
+	for y := 0; y < dh; y++ {
+		y0 := b.Min.Y + y*h/dh
+		y1 := max(y0+1, b.Min.Y+(y+1)*h/dh)
+		for x := 0; x < dw; x++ {
+			x0 := b.Min.X + x*w/dw
+			x1 := max(x0+1, b.Min.X+(x+1)*w/dw)
+			var r, g, bl, a, n uint64
+			for sy := y0; sy < y1; sy++ {
+				for sx := x0; sx < x1; sx++ {
+					cr, cg, cb, ca := src.At(sx, sy).RGBA()
+					r, g, bl, a = r+uint64(cr), g+uint64(cg), bl+uint64(cb), a+uint64(ca)
+					n++
+				}
+			}
+			dst.SetRGBA(x, y, color.RGBA{
+				R: uint8(r / n >> 8),
+				G: uint8(g / n >> 8),
+				B: uint8(bl / n >> 8),
+				A: uint8(a / n >> 8),
+			})
+		}
+	}
+	return dst
+}
+
+// renderPDFPreview renders the first page of the pdf at src to a png at dst
+// using whichever pdf renderer is installed.
+func renderPDFPreview(src, dst string) error {
+	err := os.MkdirAll(filepath.Dir(dst), 0700)
+	if err != nil {
+		return err
+	}
+	tmp, err := ioutil.TempDir(filepath.Dir(dst), tempUploadPrefix)
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(tmp)
+	out := filepath.Join(tmp, "page")
+
+	ctx, cancel := context.WithTimeout(context.Background(), pdfRenderTimeout)
+	defer cancel()
+	var cmd *exec.Cmd
+	width := strconv.Itoa(pdfPreviewWidth)
+	if path, err := exec.LookPath("pdftoppm"); err == nil {
+		cmd = exec.CommandContext(ctx, path, "-png", "-f", "1", "-l", "1", "-singlefile", "-scale-to-x", width, "-scale-to-y", "-1", src, out)
+	} else if path, err := exec.LookPath("mutool"); err == nil {
+		cmd = exec.CommandContext(ctx, path, "draw", "-q", "-F", "png", "-w", width, "-o", out+".png", src, "1")
+	} else {
+		return errNoPDFRenderer
+	}
+	err = cmd.Run()
+	if err != nil {
+		return err
+	}
+	if _, err := os.Stat(out + ".png"); err != nil {
+		return errPDFRenderFailed
+	}
+	return os.Rename(out+".png", dst)
+}
+
+// derivedHandler serves the derived assets of media.
+func (h *herus) derivedHandler(w http.ResponseWriter, r *http.Request) {
+	parts := strings.Split(strings.TrimPrefix(r.URL.Path, derivedPrefix), "/")
+	if len(parts) != 2 || !mediaHashPattern.MatchString(parts[0]) || (parts[1] != thumbnailFile && parts[1] != previewFile) {
+		http.NotFound(w, r)
+		return
+	}
+	f, err := os.Open(derivedPath(parts[0], parts[1]))
+	if os.IsNotExist(err) {
+		http.NotFound(w, r)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	w.Header().Set("Content-Type", "image/png")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	http.ServeContent(w, r, "", info.ModTime(), f)
+}
@@ -0,0 +1,672 @@
+package main
+
+// extract.go pulls the plain text out of uploaded documents so that search has
+// more than titles to work with. The text of each piece of media is written to
+// the derived folder next to its other derived assets, served at
+// mediaPrefix+hash+"/text", and indexed for search. The state of each piece of
+// media is kept in the TextStatus of its metadata, and the extraction is done
+// by the same background thread that generates the derived assets.
+//
+// Plain text is taken as it is, markdown is rendered and stripped of its
+// markup, and html is stripped of its tags, scripts, and styles. Pdfs are read
+// with pdftotext when it is installed. Without it a small built in reader
+// pulls the text out of the content streams of the pdf, which works for most
+// pdfs written by word processors but not for pdfs that use embedded fonts
+// with custom encodings.
+
+import (
+	"bytes"
+	"compress/zlib"
+	"context"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"time"
+	"unicode"
+	"unicode/utf16"
+	"unicode/utf8"
+
+	"github.com/boltdb/bolt"
+	"golang.org/x/net/html"
+)
+
+const (
+	textEmpty       = "empty"
+	textFailed      = "failed"
+	textPending     = ""
+	textReady       = "ready"
+	textUnsupported = "unsupported"
+
+	textFile   = "text.txt"
+	textSuffix = "/text"
+
+	// maxExtractedTextLen limits how much text is kept from a single piece of
+	// media.
+	maxExtractedTextLen = 4 << 20 // 4 MB
+
+	// maxParseLen limits how much of an html document or pdf is read by the
+	// built in extractors. The pdf reader holds the whole pdf in memory.
+	maxParseLen = 64 << 20 // 64 MB
+
+	// maxPDFStreamLen limits the size of a single decompressed pdf stream.
+	maxPDFStreamLen = 16 << 20 // 16 MB
+
+	pdfExtractTimeout = 60 * time.Second
+)
+
+var (
+	errPDFTooLarge     = errors.New("pdf is too large to be read without pdftotext")
+	errTextUnsupported = errors.New("text cannot be extracted from media of this type")
+
+	// htmlSkippedElements lists the html elements whose contents are not
+	// part of the text of a page.
+	htmlSkippedElements = map[string]bool{
+		"head":     true,
+		"noscript": true,
+		"script":   true,
+		"style":    true,
+		"template": true,
+		"title":    true,
+	}
+
+	// htmlBlockElements lists the html elements that start a new line of
+	// text.
+	htmlBlockElements = map[string]bool{
+		"address": true, "article": true, "aside": true, "blockquote": true,
+		"br": true, "dd": true, "div": true, "dl": true, "dt": true,
+		"figcaption": true, "figure": true, "footer": true, "h1": true,
+		"h2": true, "h3": true, "h4": true, "h5": true, "h6": true,
+		"header": true, "hr": true, "li": true, "main": true, "nav": true,
+		"ol": true, "p": true, "pre": true, "section": true, "table": true,
+		"td": true, "th": true, "tr": true, "ul": true,
+	}
+)
+
+// extractMediaText extracts the text of a piece of media, stores it in the
+// derived folder, and indexes it for search.
+func (h *herus) extractMediaText(hash, title, path, contentType string) error {
+	text, err := extractText(path, contentType, title)
+	status := textReady
+	switch {
+	case err == errTextUnsupported || err == errPDFTooLarge:
+		status = textUnsupported
+	case err != nil:
+		println("unable to extract the text of " + hash + ": " + err.Error())
+		status = textFailed
+	case strings.TrimSpace(text) == "":
+		status = textEmpty
+	default:
+		err = writeTextFile(derivedPath(hash, textFile), text)
+		if err != nil {
+			return err
+		}
+	}
+
+	return h.db.Update(func(tx *bolt.Tx) error {
+		mm, exists, err := getMediaMetadata(tx, hash)
+		if err != nil || !exists {
+			return err
+		}
+		mm.TextStatus = status
+		err = putMediaMetadata(tx, hash, mm)
+		if err != nil {
+			return err
+		}
+		if status != textReady {
+			return nil
+		}
+		return indexMediaText(tx, hash, text)
+	})
+}
+
+// extractText returns the plain text of the file at path.
+func extractText(path, contentType, title string) (string, error) {
+	switch baseMediaType(contentType) {
+	case "text/plain":
+		text, err := readTextFile(path)
+		if err != nil {
+			return "", err
+		}
+		if markdownExtensions[titleExtension(title)] {
+			return htmlText(strings.NewReader(string(renderMarkdown(text))))
+		}
+		return normalizeText(text), nil
+	case "text/html":
+		f, err := os.Open(path)
+		if err != nil {
+			return "", err
+		}
+		defer f.Close()
+		return htmlText(io.LimitReader(f, maxParseLen))
+	case "application/pdf":
+		return pdfText(path)
+	default:
+		return "", errTextUnsupported
+	}
+}
+
+// readTextFile reads a text file, up to the limit on extracted text.
+func readTextFile(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	data, err := ioutil.ReadAll(io.LimitReader(f, maxExtractedTextLen))
+	if err != nil {
+		return "", err
+	}
+	return strings.ToValidUTF8(string(data), ""), nil
+}
+
+// writeTextFile writes extracted text to the derived folder. The text is
+// written to a temporary file first so that half written text is never served.
+func writeTextFile(dst, text string) error {
+	err := os.MkdirAll(filepath.Dir(dst), 0700)
+	if err != nil {
+		return err
+	}
+	f, err := ioutil.TempFile(filepath.Dir(dst), tempUploadPrefix)
+	if err != nil {
+		return err
+	}
+	_, err = f.WriteString(text)
+	closeErr := f.Close()
+	if err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(f.Name(), dst)
+	}
+	if err != nil {
+		os.Remove(f.Name())
+	}
+	return err
+}
+
+// normalizeText trims the whitespace from the end of every line, collapses
+// runs of blank lines, and cuts the text down to the limit on extracted text.
+func normalizeText(text string) string {
+	text = strings.ReplaceAll(text, "\r\n", "\n")
+	var b strings.Builder
+	blank := true
+	for _, line := range strings.Split(text, "\n") {
+		line = strings.TrimRightFunc(line, unicode.IsSpace)
+		if line == "" {
+			if !blank {
+				b.WriteByte('\n')
+			}
+			blank = true
+			continue
+		}
+		if b.Len()+len(line) >= maxExtractedTextLen {
+			break
+		}
+		b.WriteString(line)
+		b.WriteByte('\n')
+		blank = false
+	}
+	return strings.TrimSpace(b.String())
+}
+
+// htmlText returns the text of an html document, with a line for every block
+// of the document.
+func htmlText(r io.Reader) (string, error) {
+	var b strings.Builder
+	skipping := 0
+	z := html.NewTokenizer(r)
+	for b.Len() < maxExtractedTextLen {
+		tt := z.Next()
+		switch tt {
+		case html.ErrorToken:
+			if z.Err() != io.EOF {
+				return "", z.Err()
+			}
+			return normalizeText(trimLines(b.String())), nil
+		case html.StartTagToken, html.EndTagToken, html.SelfClosingTagToken:
+			name, _ := z.TagName()
+			tag := string(name)
+			if htmlSkippedElements[tag] && tt != html.SelfClosingTagToken {
+				if tt == html.StartTagToken {
+					skipping++
+				} else if skipping > 0 {
+					skipping--
+				}
+			}
+			if htmlBlockElements[tag] {
+				b.WriteByte('\n')
+			}
+		case html.TextToken:
+			if skipping > 0 {
+				continue
+			}
+			// Collapse the whitespace in the text the way a browser would.
+			text := string(z.Text())
+			words := strings.Fields(text)
+			if len(words) == 0 {
+				if text != "" {
+					b.WriteByte(' ')
+				}
+				continue
+			}
+			if unicode.IsSpace(rune(text[0])) {
+				b.WriteByte(' ')
+			}
+			b.WriteString(strings.Join(words, " "))
+			if unicode.IsSpace(rune(text[len(text)-1])) {
+				b.WriteByte(' ')
+			}
+		}
+	}
+	return normalizeText(trimLines(b.String())), nil
+}
+
+// trimLines trims the whitespace from the start and end of every line.
+func trimLines(text string) string {
+	lines := strings.Split(text, "\n")
+	for k, line := range lines {
+		lines[k] = strings.TrimSpace(line)
+	}
+	return strings.Join(lines, "\n")
+}
+
+// pdfText returns the text of a pdf, using pdftotext if it is installed and
+// the built in pdf reader otherwise.
+func pdfText(path string) (string, error) {
+	pdftotext, err := exec.LookPath("pdftotext")
+	if err != nil {
+		info, err := os.Stat(path)
+		if err != nil {
+			return "", err
+		}
+		if info.Size() > maxParseLen {
+			return "", errPDFTooLarge
+		}
+		data, err := ioutil.ReadFile(path)
+		if err != nil {
+			return "", err
+		}
+		return normalizeText(parsePDFText(data)), nil
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), pdfExtractTimeout)
+	defer cancel()
+	cmd := exec.CommandContext(ctx, pdftotext, "-q", "-enc", "UTF-8", path, "-")
+	out, err := cmd.StdoutPipe()
+	if err != nil {
+		return "", err
+	}
+	err = cmd.Start()
+	if err != nil {
+		return "", err
+	}
+	data, err := ioutil.ReadAll(io.LimitReader(out, maxExtractedTextLen))
+	io.Copy(ioutil.Discard, out)
+	waitErr := cmd.Wait()
+	if err == nil {
+		err = waitErr
+	}
+	if err != nil {
+		return "", err
+	}
+	return normalizeText(strings.ToValidUTF8(string(data), "")), nil
+}
+
+// parsePDFText pulls the text out of the content streams of a pdf. Streams
+// that carry a type, such as fonts, images, and object streams, are skipped,
+// as are streams compressed with anything other than flate.
+func parsePDFText(data []byte) string {
+	var b strings.Builder
+	for i := 0; i < len(data) && b.Len() < maxExtractedTextLen; {
+		n := bytes.Index(data[i:], []byte("stream"))
+		if n < 0 {
+			break
+		}
+		start := i + n
+		i = start + len("stream")
+		if start >= 3 && string(data[start-3:start]) == "end" {
+			continue
+		}
+
+		// The dictionary of the stream sits between the start of its object
+		// and the stream keyword.
+		dict := data[:start]
+		if obj := bytes.LastIndex(dict, []byte("obj")); obj >= 0 {
+			dict = dict[obj:]
+		}
+		end := bytes.Index(data[i:], []byte("endstream"))
+		if end < 0 {
+			break
+		}
+		body := data[i : i+end]
+		i += end + len("endstream")
+		if bytes.Contains(dict, []byte("/Type")) || bytes.Contains(dict, []byte("/Subtype")) {
+			continue
+		}
+		body = bytes.TrimLeft(body, "\r\n")
+
+		if bytes.Contains(dict, []byte("/Filter")) {
+			if !bytes.Contains(dict, []byte("/FlateDecode")) {
+				continue
+			}
+			zr, err := zlib.NewReader(bytes.NewReader(body))
+			if err != nil {
+				continue
+			}
+			// A truncated stream still yields the text decoded before the
+			// error.
+			body, _ = ioutil.ReadAll(io.LimitReader(zr, maxPDFStreamLen))
+			zr.Close()
+		}
+		parsePDFContent(&b, body)
+	}
+	return b.String()
+}
+
+// parsePDFContent writes the text shown by the text operators of a pdf content
+// stream to b.
+func parsePDFContent(b *strings.Builder, content []byte) {
+	var operands []pdfOperand
+	var array []pdfOperand
+	inArray := false
+	push := func(op pdfOperand) {
+		if inArray {
+			array = append(array, op)
+		} else {
+			operands = append(operands, op)
+		}
+	}
+
+	for i := 0; i < len(content); {
+		c := content[i]
+		switch {
+		case isPDFSpace(c):
+			i++
+		case c == '%':
+			for i < len(content) && content[i] != '\n' && content[i] != '\r' {
+				i++
+			}
+		case c == '(':
+			s, n := readPDFLiteral(content[i:])
+			push(pdfOperand{Str: s, IsStr: true})
+			i += n
+		case c == '<' && i+1 < len(content) && content[i+1] == '<':
+			i += 2
+		case c == '>' && i+1 < len(content) && content[i+1] == '>':
+			i += 2
+		case c == '<':
+			s, n := readPDFHex(content[i:])
+			push(pdfOperand{Str: s, IsStr: true})
+			i += n
+		case c == '[':
+			inArray, array = true, nil
+			i++
+		case c == ']':
+			operands = append(operands, pdfOperand{Array: array})
+			inArray, array = false, nil
+			i++
+		default:
+			n := 1
+			for i+n < len(content) && !isPDFSpace(content[i+n]) && !isPDFDelimiter(content[i+n]) {
+				n++
+			}
+			word := string(content[i : i+n])
+			i += n
+			if c == '/' || c == '+' || c == '-' || c == '.' || ('0' <= c && c <= '9') {
+				push(pdfOperand{Num: parsePDFNumber(word)})
+				continue
+			}
+			if word == "ID" {
+				// Skip the data of an inline image.
+				end := bytes.Index(content[i:], []byte("EI"))
+				if end < 0 {
+					return
+				}
+				i += end + 2
+			}
+			writePDFOperator(b, word, operands)
+			operands = operands[:0]
+		}
+	}
+}
+
+// pdfOperand is an operand in a pdf content stream: a string, a number, or an
+// array. Names are kept as numbers because their values never matter here.
+type pdfOperand struct {
+	Str   []byte
+	IsStr bool
+	Num   float64
+	Array []pdfOperand
+}
+
+// writePDFOperator writes the text shown by a pdf operator to b.
+func writePDFOperator(b *strings.Builder, op string, operands []pdfOperand) {
+	last := func() pdfOperand {
+		if len(operands) == 0 {
+			return pdfOperand{}
+		}
+		return operands[len(operands)-1]
+	}
+	switch op {
+	case "Tj":
+		b.WriteString(pdfString(last().Str))
+	case "'", "\"":
+		b.WriteByte('\n')
+		b.WriteString(pdfString(last().Str))
+	case "TJ":
+		for _, o := range last().Array {
+			if o.IsStr {
+				b.WriteString(pdfString(o.Str))
+			} else if o.Num < -200 {
+				// Large negative adjustments are gaps between words.
+				b.WriteByte(' ')
+			}
+		}
+	case "T*", "ET":
+		b.WriteByte('\n')
+	case "Td", "TD":
+		if len(operands) >= 2 && operands[len(operands)-1].Num != 0 {
+			b.WriteByte('\n')
+		} else {
+			b.WriteByte(' ')
+		}
+	case "Tm":
+		b.WriteByte('\n')
+	}
+}
+
+// readPDFLiteral reads a pdf literal string, such as (text), returning the
+// string and the number of bytes read.
+func readPDFLiteral(data []byte) ([]byte, int) {
+	var s []byte
+	depth := 0
+	i := 0
+	for i < len(data) {
+		c := data[i]
+		i++
+		switch c {
+		case '(':
+			if depth > 0 {
+				s = append(s, c)
+			}
+			depth++
+		case ')':
+			depth--
+			if depth == 0 {
+				return s, i
+			}
+			s = append(s, c)
+		case '\\':
+			if i >= len(data) {
+				return s, i
+			}
+			e := data[i]
+			i++
+			switch e {
+			case 'n':
+				s = append(s, '\n')
+			case 'r':
+				s = append(s, '\r')
+			case 't':
+				s = append(s, '\t')
+			case 'b':
+				s = append(s, '\b')
+			case 'f':
+				s = append(s, '\f')
+			case '\r':
+				if i < len(data) && data[i] == '\n' {
+					i++
+				}
+			case '\n':
+			default:
+				if '0' <= e && e <= '7' {
+					v := int(e - '0')
+					for k := 0; k < 2 && i < len(data) && '0' <= data[i] && data[i] <= '7'; k++ {
+						v = v*8 + int(data[i]-'0')
+						i++
+					}
+					s = append(s, byte(v))
+				} else {
+					s = append(s, e)
+				}
+			}
+		default:
+			s = append(s, c)
+		}
+	}
+	return s, i
+}
+
+// readPDFHex reads a pdf hex string, such as <48656c6c6f>, returning the
+// string and the number of bytes read.
+func readPDFHex(data []byte) ([]byte, int) {
+	var s []byte
+	var digits []byte
+	i := 1
+	for ; i < len(data) && data[i] != '>'; i++ {
+		if v, ok := hexValue(data[i]); ok {
+			digits = append(digits, v)
+		}
+	}
+	if len(digits)%2 == 1 {
+		digits = append(digits, 0)
+	}
+	for k := 0; k < len(digits); k += 2 {
+		s = append(s, digits[k]<<4|digits[k+1])
+	}
+	return s, i + 1
+}
+
+// hexValue returns the value of a hex digit.
+func hexValue(c byte) (byte, bool) {
+	switch {
+	case '0' <= c && c <= '9':
+		return c - '0', true
+	case 'a' <= c && c <= 'f':
+		return c - 'a' + 10, true
+	case 'A' <= c && c <= 'F':
+		return c - 'A' + 10, true
+	}
+	return 0, false
+}
+
+// parsePDFNumber parses a number in a pdf content stream, returning zero for
+// anything that is not a number.
+func parsePDFNumber(word string) float64 {
+	var v, scale float64
+	neg := false
+	for k, c := range word {
+		switch {
+		case c == '-' && k == 0:
+			neg = true
+		case c == '+' && k == 0:
+		case c == '.' && scale == 0:
+			scale = 1
+		case '0' <= c && c <= '9':
+			v = v*10 + float64(c-'0')
+			if scale != 0 {
+				scale *= 10
+			}
+		default:
+			return 0
+		}
+	}
+	if scale != 0 {
+		v /= scale
+	}
+	if neg {
+		v = -v
+	}
+	return v
+}
+
+// pdfString decodes the bytes of a pdf string. Strings that start with a byte
+// order mark are utf-16, and the rest are treated as latin-1, which matches
+// the standard encodings of pdf fonts for ordinary text. Control characters,
+// which are what strings in custom font encodings mostly decode to, are
+// dropped.
+func pdfString(s []byte) string {
+	var runes []rune
+	if len(s) >= 2 && s[0] == 0xfe && s[1] == 0xff {
+		units := make([]uint16, 0, len(s)/2)
+		for k := 2; k+1 < len(s); k += 2 {
+			units = append(units, uint16(s[k])<<8|uint16(s[k+1]))
+		}
+		runes = utf16.Decode(units)
+	} else {
+		for _, c := range s {
+			runes = append(runes, rune(c))
+		}
+	}
+	var b strings.Builder
+	for _, r := range runes {
+		if r == utf8.RuneError || (unicode.IsControl(r) && r != '\n' && r != '\t') {
+			continue
+		}
+		b.WriteRune(r)
+	}
+	return b.String()
+}
+
+// isPDFSpace returns whether a byte is whitespace in a pdf.
+func isPDFSpace(c byte) bool {
+	return c == ' ' || c == '\n' || c == '\r' || c == '\t' || c == '\f' || c == 0
+}
+
+// isPDFDelimiter returns whether a byte ends a word in a pdf.
+func isPDFDelimiter(c byte) bool {
+	return strings.IndexByte("()<>[]{}/%", c) >= 0
+}
+
+// serveMediaText serves the text extracted from a piece of media.
+func serveMediaText(w http.ResponseWriter, r *http.Request, hash string, mm mediaMetadata) {
+	if mm.TextStatus != textReady {
+		http.Error(w, "no text has been extracted from this media", http.StatusNotFound)
+		return
+	}
+	f, err := os.Open(derivedPath(hash, textFile))
+	if os.IsNotExist(err) {
+		http.NotFound(w, r)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	header := w.Header()
+	header.Set("Content-Type", "text/plain; charset=utf-8")
+	header.Set("Content-Security-Policy", "default-src 'none'; sandbox")
+	header.Set("X-Content-Type-Options", "nosniff")
+	http.ServeContent(w, r, "", info.ModTime(), f)
+}
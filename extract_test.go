@@ -0,0 +1,130 @@
+package main
+
+import (
+	"bytes"
+	"compress/zlib"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// TestParsePDFContent checks the text read from pdf content streams.
+func TestParsePDFContent(t *testing.T) {
+	tests := []struct {
+		name    string
+		content string
+		want    string
+	}{
+		{"literal", `BT (Hello World) Tj ET`, "Hello World\n"},
+		{"escapes", `BT (a\(b\)c\\d\nnext\tt) Tj ET`, "a(b)c\\d\nnext\tt\n"},
+		{"octal escapes", `BT (caf\351 \101\102C \0610) Tj ET`, "café ABC 10\n"},
+		{"line continuation", "BT (split \\\nline) Tj ET", "split line\n"},
+		{"nested parentheses", `BT (f(x (y)) = 1) Tj ET`, "f(x (y)) = 1\n"},
+		{"hex", `BT <48656C6C6F> Tj ET`, "Hello\n"},
+		{"hex with spaces and odd length", `BT <48 65 6c 6c 6> Tj ET`, "Hell`\n"},
+		{"utf-16 hex", `BT <FEFF00480069> Tj ET`, "Hi\n"},
+		{"kerning", `BT [(Hel) -20 (lo) -250 (Wor) 10 (ld)] TJ ET`, "Hello World\n"},
+		{"kerning with hex", `BT [<576F72> -1000 (ds)] TJ ET`, "Wor ds\n"},
+		{"new lines", `BT (one) Tj 0 -12 Td (two) Tj T* (three) Tj (four) ' ET`, "one\ntwo\nthree\nfour\n"},
+		{"same line move", `BT (a) Tj 10 0 Td (b) Tj ET`, "a b\n"},
+		{"comments", "BT % (hidden) Tj\n(shown) Tj ET", "shown\n"},
+		{"dictionaries and names", `/Span << /MCID 0 >> BDC BT /F1 12 Tf (x) Tj ET EMC`, "x\n"},
+		{"inline image", "BI /W 1 /H 1 ID \x00(junk)\xff EI BT (after) Tj ET", "after\n"},
+		{"control characters", `BT (\001\002ok\003) Tj ET`, "ok\n"},
+	}
+	for _, test := range tests {
+		var b strings.Builder
+		parsePDFContent(&b, []byte(test.content))
+		if got := b.String(); got != test.want {
+			t.Errorf("%v: got %q, want %q", test.name, got, test.want)
+		}
+	}
+}
+
+// pdfObject returns a pdf stream object with the provided dictionary entries
+// and data.
+func pdfObject(n int, dict string, data []byte) []byte {
+	var b bytes.Buffer
+	b.WriteString(strconv.Itoa(n) + " 0 obj\n<< /Length " + strconv.Itoa(len(data)) + " " + dict + " >>\nstream\n")
+	b.Write(data)
+	b.WriteString("\nendstream\nendobj\n")
+	return b.Bytes()
+}
+
+// flate compresses data the way pdf streams with /FlateDecode are.
+func flate(data string) []byte {
+	var b bytes.Buffer
+	zw := zlib.NewWriter(&b)
+	zw.Write([]byte(data))
+	zw.Close()
+	return b.Bytes()
+}
+
+// testPDF returns a small pdf with a plain content stream, a compressed
+// content stream, and streams that have to be skipped.
+func testPDF() []byte {
+	var b bytes.Buffer
+	b.WriteString("%PDF-1.4\n")
+	b.Write(pdfObject(1, "", []byte("BT (Plain page) Tj ET")))
+	b.Write(pdfObject(2, "/Filter /FlateDecode", flate("BT [(Comp) -300 (ressed)] TJ ET")))
+	b.Write(pdfObject(3, "/Type /XObject /Subtype /Image", []byte("BT (image) Tj ET")))
+	b.Write(pdfObject(4, "/Filter /DCTDecode", []byte("BT (jpeg) Tj ET")))
+	b.Write(pdfObject(5, "/Filter /FlateDecode", flate("BT (Last page) Tj ET")))
+	b.WriteString("trailer\n<< /Root 1 0 R >>\n%%EOF\n")
+	return b.Bytes()
+}
+
+// TestParsePDFText checks that the text of content streams is read, including
+// compressed streams, and that other streams are skipped.
+func TestParsePDFText(t *testing.T) {
+	got := parsePDFText(testPDF())
+	want := "Plain page\nComp ressed\nLast page\n"
+	if got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
+
+// TestParsePDFMalformed checks that truncated and malformed pdfs are read
+// without panicking or looping forever.
+func TestParsePDFMalformed(t *testing.T) {
+	var inputs [][]byte
+	pdf := testPDF()
+	for n := 0; n <= len(pdf); n++ {
+		inputs = append(inputs, pdf[:n])
+	}
+	compressed := flate("BT (truncated) Tj ET")
+	inputs = append(inputs,
+		pdfObject(1, "/Filter /FlateDecode", compressed[:len(compressed)/2]),
+		pdfObject(1, "/Filter /FlateDecode", []byte("not zlib at all")),
+		[]byte("stream"),
+		[]byte("endstream stream endstream"),
+		[]byte("1 0 obj stream\n BT (unterminated"),
+	)
+	contents := []string{
+		"(", "(\\", "(abc\\", "((((", "))))", "<", "<4", "<<", ">>", ">",
+		"[", "]", "[[[(a)", "]]] TJ", "TJ", "Tj", "'", "\"", "Td", "ID",
+		"ID no end", "%", "/", "//", "-", "+.", "1.2.3 Tf", "{}", "\x00\x00",
+		"BT (a) Tj", "[(a) -300",
+	}
+	for _, content := range contents {
+		inputs = append(inputs, pdfObject(1, "", []byte(content)))
+	}
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for _, input := range inputs {
+			parsePDFText(input)
+		}
+		for _, content := range contents {
+			var b strings.Builder
+			parsePDFContent(&b, []byte(content))
+		}
+	}()
+	select {
+	case <-done:
+	case <-time.After(10 * time.Second):
+		t.Fatal("reading malformed pdfs did not finish")
+	}
+}
@@ -0,0 +1,372 @@
+package main
+
+// graph.go produces the graph pages, which show the neighborhood of a topic in
+// the knowledge graph that topic relations build.
+//
+// The neighborhood is found with a breadth first walk over the relations of
+// the topic, following relations in both directions, out to the requested
+// depth. It can be fetched as JSON with '?format=json', as a bare SVG image
+// with '?format=svg', or as an html page with the SVG inlined. The SVG is laid
+// out on the server with a force directed layout, and every node links to the
+// graph page of its topic so that the graph can be navigated without any
+// client side code.
+
+import (
+	"bytes"
+	"encoding/json"
+	"html/template"
+	"io"
+	"math"
+	"net/http"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/boltdb/bolt"
+)
+
+const (
+	graphPrefix = "/graph/"
+
+	graphTitle = "Topic Graph"
+
+	defaultGraphDepth = 2
+	maxGraphDepth     = 4
+	maxGraphNodes     = 100
+
+	// The size of the SVG image and the number of iterations of the force
+	// directed layout.
+	graphHeight     = 600
+	graphIterations = 300
+	graphMargin     = 40
+	graphWidth      = 800
+)
+
+var (
+	graphTpl    = filepath.Join(dirTemplates, "graph.tpl")
+	graphSVGTpl = filepath.Join(dirTemplates, "graph-svg.tpl")
+)
+
+// graphNode is a topic in the neighborhood of a graph. Depth is the number of
+// relations between the topic and the topic at the center of the graph.
+type graphNode struct {
+	Name  string  `json:"name"`
+	Title string  `json:"title"`
+	Depth int     `json:"depth"`
+	X     float64 `json:"x"`
+	Y     float64 `json:"y"`
+}
+
+// graphEdge is a relation between two topics of a graph.
+type graphEdge struct {
+	Source string `json:"source"`
+	Target string `json:"target"`
+	Type   string `json:"type"`
+
+	// The endpoints of the edge in the SVG image.
+	X1 float64 `json:"-"`
+	Y1 float64 `json:"-"`
+	X2 float64 `json:"-"`
+	Y2 float64 `json:"-"`
+}
+
+// topicGraph is the neighborhood of a topic.
+type topicGraph struct {
+	Root  string      `json:"root"`
+	Depth int         `json:"depth"`
+	Nodes []graphNode `json:"nodes"`
+	Edges []graphEdge `json:"edges"`
+}
+
+// graphTemplateData defines the data which is used to fill out the graph
+// template files.
+type graphTemplateData struct {
+	Depth       int
+	GraphPrefix string
+	Height      int
+	Title       string
+	TopicPrefix string
+	Width       int
+
+	DepthOptions []int
+	Graph        topicGraph
+}
+
+// parseGraphDepth converts the depth requested in the url into a depth that
+// is within the limits of the graph page.
+func parseGraphDepth(depth string) int {
+	d, err := strconv.Atoi(depth)
+	if err != nil || d < 1 {
+		return defaultGraphDepth
+	}
+	if d > maxGraphDepth {
+		return maxGraphDepth
+	}
+	return d
+}
+
+// neighborhood walks the visible relations of a topic in both directions and
+// returns every topic within depth relations of it, stopping early once the
+// graph holds maxGraphNodes topics.
+func neighborhood(tx *bolt.Tx, root string, depth int) (topicGraph, error) {
+	g := topicGraph{Root: root, Depth: depth}
+	index := make(map[string]int)
+	edges := make(map[[2]string]bool)
+	addNode := func(name string, d int) error {
+		td, exists, err := getTopic(tx, name)
+		if err != nil {
+			return err
+		}
+		title := td.Title
+		if !exists || title == "" {
+			title = topicTitleFromName(name)
+		}
+		index[name] = len(g.Nodes)
+		g.Nodes = append(g.Nodes, graphNode{Name: name, Title: title, Depth: d})
+		return nil
+	}
+	addEdge := func(source, target, relation string) {
+		key := [2]string{source, target}
+		if edges[key] {
+			return
+		}
+		edges[key] = true
+		g.Edges = append(g.Edges, graphEdge{Source: source, Target: target, Type: relation})
+	}
+
+	err := addNode(root, 0)
+	if err != nil {
+		return topicGraph{}, err
+	}
+	frontier := []string{root}
+	for d := 1; d <= depth && len(frontier) > 0; d++ {
+		var next []string
+		for _, name := range frontier {
+			td, _, err := getTopic(tx, name)
+			if err != nil {
+				return topicGraph{}, err
+			}
+			prerequisites, subtopics, seeAlso, err := topicRelations(tx, name, td)
+			if err != nil {
+				return topicGraph{}, err
+			}
+			related := append(append(prerequisites, subtopics...), seeAlso...)
+			sort.SliceStable(related, func(i, j int) bool {
+				return related[i].Topic < related[j].Topic
+			})
+			for _, rt := range related {
+				if _, ok := index[rt.Topic]; !ok {
+					if len(g.Nodes) >= maxGraphNodes {
+						continue
+					}
+					err = addNode(rt.Topic, d)
+					if err != nil {
+						return topicGraph{}, err
+					}
+					next = append(next, rt.Topic)
+				}
+				addEdge(rt.Page, rt.Title, rt.RelationType())
+			}
+		}
+		frontier = next
+	}
+
+	// Relations between topics on the outer edge of the graph were not
+	// walked, so pick them up now that every topic is known.
+	for _, name := range frontier {
+		td, _, err := getTopic(tx, name)
+		if err != nil {
+			return topicGraph{}, err
+		}
+		for _, tr := range visibleTopics(td.RelatedTopics) {
+			if _, ok := index[tr.Title]; ok {
+				addEdge(name, tr.Title, tr.RelationType())
+			}
+		}
+	}
+
+	layoutGraph(&g, index)
+	return g, nil
+}
+
+// layoutGraph places the nodes of a graph with the Fruchterman-Reingold force
+// directed layout. Related topics pull on each other while all topics push
+// each other apart, and the topic at the center of the graph is pinned to the
+// middle of the image. The starting positions are fixed, so the same graph is
+// always drawn the same way.
+func layoutGraph(g *topicGraph, index map[string]int) {
+	n := len(g.Nodes)
+	width := float64(graphWidth - 2*graphMargin)
+	height := float64(graphHeight - 2*graphMargin)
+	k := math.Sqrt(width * height / float64(n))
+
+	// Start with the topics spread around the center in rings by depth.
+	for i := range g.Nodes {
+		if i == 0 {
+			continue
+		}
+		angle := 2 * math.Pi * float64(i) / float64(n-1)
+		radius := k * float64(g.Nodes[i].Depth)
+		g.Nodes[i].X = radius * math.Cos(angle)
+		g.Nodes[i].Y = radius * math.Sin(angle)
+	}
+
+	temperature := width / 10
+	for iter := 0; iter < graphIterations; iter++ {
+		dx := make([]float64, n)
+		dy := make([]float64, n)
+		for i := 0; i < n; i++ {
+			for j := i + 1; j < n; j++ {
+				x := g.Nodes[i].X - g.Nodes[j].X
+				y := g.Nodes[i].Y - g.Nodes[j].Y
+				dist := math.Max(math.Hypot(x, y), 0.01)
+				force := k * k / dist
+				dx[i] += x / dist * force
+				dy[i] += y / dist * force
+				dx[j] -= x / dist * force
+				dy[j] -= y / dist * force
+			}
+		}
+		for _, e := range g.Edges {
+			i, j := index[e.Source], index[e.Target]
+			x := g.Nodes[i].X - g.Nodes[j].X
+			y := g.Nodes[i].Y - g.Nodes[j].Y
+			dist := math.Max(math.Hypot(x, y), 0.01)
+			force := dist * dist / k
+			dx[i] -= x / dist * force
+			dy[i] -= y / dist * force
+			dx[j] += x / dist * force
+			dy[j] += y / dist * force
+		}
+		for i := 1; i < n; i++ {
+			dist := math.Max(math.Hypot(dx[i], dy[i]), 0.01)
+			step := math.Min(dist, temperature)
+			g.Nodes[i].X += dx[i] / dist * step
+			g.Nodes[i].Y += dy[i] / dist * step
+		}
+		temperature *= 0.98
+	}
+
+	// Scale the layout to fit the image.
+	maxX, maxY := 1.0, 1.0
+	for _, node := range g.Nodes {
+		maxX = math.Max(maxX, math.Abs(node.X))
+		maxY = math.Max(maxY, math.Abs(node.Y))
+	}
+	for i := range g.Nodes {
+		g.Nodes[i].X = math.Round(graphWidth/2 + g.Nodes[i].X/maxX*width/2)
+		g.Nodes[i].Y = math.Round(graphHeight/2 + g.Nodes[i].Y/maxY*height/2)
+	}
+	for i, e := range g.Edges {
+		source, target := g.Nodes[index[e.Source]], g.Nodes[index[e.Target]]
+		g.Edges[i].X1, g.Edges[i].Y1 = source.X, source.Y
+		g.Edges[i].X2, g.Edges[i].Y2 = target.X, target.Y
+	}
+}
+
+// executeGraphSVG writes the SVG image of a graph.
+func executeGraphSVG(w io.Writer, gtd graphTemplateData) error {
+	t, err := template.ParseFiles(graphSVGTpl)
+	if err != nil {
+		return err
+	}
+	return t.Execute(w, gtd)
+}
+
+// executeGraphBody builds the body portion of the graph page, which inlines
+// the SVG image of the graph.
+func executeGraphBody(w io.Writer, gtd graphTemplateData) error {
+	t, err := template.ParseFiles(graphTpl, graphSVGTpl)
+	if err != nil {
+		return err
+	}
+	return t.Execute(w, gtd)
+}
+
+// graphHandler handles requests for the graph of a topic.
+func (h *herus) graphHandler(w http.ResponseWriter, r *http.Request) {
+	topicName := strings.TrimPrefix(r.URL.Path, graphPrefix)
+	redirected, err := h.redirectToCanonical(w, r, graphPrefix, topicName, "")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if redirected {
+		return
+	}
+
+	gtd := graphTemplateData{
+		Depth:       parseGraphDepth(r.URL.Query().Get("depth")),
+		GraphPrefix: graphPrefix,
+		Height:      graphHeight,
+		TopicPrefix: topicPrefix,
+		Width:       graphWidth,
+	}
+	for d := 1; d <= maxGraphDepth; d++ {
+		gtd.DepthOptions = append(gtd.DepthOptions, d)
+	}
+	var exists bool
+	err = h.db.View(func(tx *bolt.Tx) error {
+		var td topicData
+		td, exists, err = getTopic(tx, topicName)
+		if err != nil || !exists {
+			return err
+		}
+		gtd.Title = td.Title
+		if gtd.Title == "" {
+			gtd.Title = topicTitleFromName(topicName)
+		}
+		gtd.Graph, err = neighborhood(tx, topicName, gtd.Depth)
+		return err
+	})
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if !exists {
+		rootHandler(w, r)
+		return
+	}
+
+	switch r.URL.Query().Get("format") {
+	case "json":
+		w.Header().Set("Content-Type", "application/json")
+		err = json.NewEncoder(w).Encode(gtd.Graph)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+		}
+		return
+	case "svg":
+		// Render into a buffer so that a failed render can still be
+		// reported with the right content type.
+		var buf bytes.Buffer
+		err = executeGraphSVG(&buf, gtd)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		w.Header().Set("Content-Type", "image/svg+xml")
+		_, err = buf.WriteTo(w)
+		if err != nil {
+			println(err.Error())
+		}
+		return
+	}
+
+	err = executeHeader(w, HeaderTemplateData{Title: graphTitle + ": " + gtd.Title})
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	err = executeGraphBody(w, gtd)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	err = executeFooter(w)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+}
@@ -3,6 +3,7 @@ package main
 // main.go intializes the herus server and all of its components.
 
 import (
+	"flag"
 	"fmt"
 	"html/template"
 	"net/http"
@@ -17,21 +18,44 @@ const (
 	dbFile = "herus.db"
 
 	dirCSS       = "css"
+	dirDerived   = "derived"
 	dirMedia     = "media"
 	dirTemplates = "templates"
 )
 
 var (
 	// bucketTopics houses information about all of the pages tracked by herus.
-	bucketTopics = []byte("BucketTopics")
-	bucketMedia  = []byte("BucketMedia")
-	bucketUsers  = []byte("BucketUsers")
+	bucketTopics    = []byte("BucketTopics")
+	bucketAliases   = []byte("BucketAliases")
+	bucketBacklinks = []byte("BucketBacklinks")
+	bucketFlags     = []byte("BucketFlags")
+	bucketMedia     = []byte("BucketMedia")
+	bucketRevisions = []byte("BucketRevisions")
+	bucketSessions  = []byte("BucketSessions")
+	bucketTokens    = []byte("BucketTokens")
+	bucketUploads   = []byte("BucketUploads")
+	bucketUsers     = []byte("BucketUsers")
+	bucketVotes     = []byte("BucketVotes")
+
+	// bucketMediaTitles indexes the titles of media for suggestions, see
+	// api.go. bucketSearchDocs and bucketSearchIndex hold the search index,
+	// see search.go.
+	bucketMediaTitles = []byte("BucketMediaTitles")
+	bucketSearchDocs  = []byte("BucketSearchDocs")
+	bucketSearchIndex = []byte("BucketSearchIndex")
 )
 
 // herus contains all data that needs to persist in memory throughout the life
 // of the server.
 type herus struct {
 	db *bolt.DB
+
+	// deriveQueue holds the hashes of the media waiting for their derived
+	// assets to be generated.
+	deriveQueue chan string
+
+	// maxUploadSize is the largest file, in bytes, that can be uploaded.
+	maxUploadSize int64
 }
 
 // rootHandler will handle any request that comes to the page root - usually
@@ -60,12 +84,32 @@ func (h *herus) establishServerRoutes() {
 	wafs = http.StripPrefix("/web-assets/", wafs)
 	http.Handle("/web-assets/", wafs)
 
-	http.Handle("/m/", http.StripPrefix("/m/", http.FileServer(http.Dir("media")))) // Serve everything directly from the media dir
-	http.HandleFunc(connectPage, h.connectHandler)
+	http.HandleFunc(apiV1Prefix, h.apiV1Handler)
+	http.HandleFunc(aliasPage, requireRole(memberContributor, h.aliasHandler))
+	http.HandleFunc(connectPage, requireScope(scopeConnect, requireRole(memberContributor, h.connectHandler)))
+	http.HandleFunc(createPage, requireRole(memberContributor, h.createHandler))
+	http.HandleFunc(derivedPrefix, h.derivedHandler)
 	http.HandleFunc(elaborationPrefix, h.elaborationHandler)
+	http.HandleFunc(flagPage, requireRole(memberContributor, h.flagHandler))
+	http.HandleFunc(graphPrefix, h.graphHandler)
 	http.HandleFunc(indexPage, indexHandler)
+	http.HandleFunc(loginPage, h.loginHandler)
+	http.HandleFunc(logoutPage, h.logoutHandler)
+	http.HandleFunc(mediaPrefix, h.mediaHandler)
+	http.HandleFunc(mergePage, requireRole(memberAdmin, h.mergeHandler))
+	http.HandleFunc(moderatePage, requireRole(memberModerator, h.moderateHandler))
+	http.HandleFunc(passwordPage, h.passwordHandler)
+	http.HandleFunc(pathPrefix, h.pathHandler)
+	http.HandleFunc(registerPage, h.registerHandler)
+	http.HandleFunc(rolesPage, requireRole(memberAdmin, h.rolesHandler))
+	http.HandleFunc(searchPage, h.searchHandler)
+	http.HandleFunc(settingsPage, h.settingsHandler)
+	http.HandleFunc(splitPage, requireRole(memberAdmin, h.splitHandler))
+	http.HandleFunc(suggestPage, h.suggestHandler)
 	http.HandleFunc(topicPrefix, h.topicHandler)
-	http.HandleFunc(uploadPage, h.uploadHandler)
+	http.HandleFunc(uploadPage, requireScope(scopeUpload, requireRole(memberContributor, h.uploadHandler)))
+	http.HandleFunc(userPrefix, h.userHandler)
+	http.HandleFunc(votePage, requireScope(scopeVote, requireRole(memberContributor, h.voteHandler)))
 }
 
 // initDB will initialize the database used by herus.
@@ -75,26 +119,76 @@ func (h *herus) initDB() (err error) {
 		return err
 	}
 
-	return h.db.Update(func(tx *bolt.Tx) error {
-		buckets := [][]byte{
-			bucketTopics,
-			bucketMedia,
-			bucketUsers,
+	return h.db.Update(initBuckets)
+}
+
+// initBuckets creates the buckets that herus uses and brings databases from
+// older versions of herus up to date.
+func initBuckets(tx *bolt.Tx) error {
+	// Databases from before relations had backlinks need to have them built
+	// once the bucket exists.
+	indexBacklinks := tx.Bucket(bucketBacklinks) == nil
+	indexSearch := tx.Bucket(bucketSearchDocs) == nil
+	indexMediaTitles := tx.Bucket(bucketMediaTitles) == nil
+
+	buckets := [][]byte{
+		bucketTopics,
+		bucketAliases,
+		bucketBacklinks,
+		bucketFlags,
+		bucketMedia,
+		bucketMediaTitles,
+		bucketRevisions,
+		bucketSearchDocs,
+		bucketSearchIndex,
+		bucketSessions,
+		bucketTokens,
+		bucketUploads,
+		bucketUsers,
+		bucketVotes,
+	}
+	for _, bucket := range buckets {
+		_, err := tx.CreateBucketIfNotExists(bucket)
+		if err != nil {
+			return err
+		}
+	}
+	err := migrateTopicNames(tx)
+	if err != nil {
+		return err
+	}
+	if indexBacklinks {
+		err := indexAllRelations(tx)
+		if err != nil {
+			return err
+		}
+	}
+	if indexSearch {
+		err := indexEverything(tx)
+		if err != nil {
+			return err
 		}
-		for _, bucket := range buckets {
-			_, err := tx.CreateBucketIfNotExists(bucket)
-			if err != nil {
-				return err
-			}
+	} else {
+		err := countSearchDocuments(tx)
+		if err != nil {
+			return err
 		}
-		return nil
-	})
+	}
+	if indexMediaTitles {
+		return indexAllMediaTitles(tx)
+	}
+	return nil
 }
 
 // main initializes the server and then starts serving pages.
 func main() {
+	maxUploadMB := flag.Int64("max-upload", defaultMaxUploadSize>>20, "largest file that can be uploaded, in MB")
+	flag.Parse()
+
 	fmt.Println("Preparing Herus...")
 	h := new(herus)
+	h.deriveQueue = make(chan string, deriveQueueLen)
+	h.maxUploadSize = *maxUploadMB << 20
 
 	// Initialize the database.
 	err := h.initDB()
@@ -103,18 +197,33 @@ func main() {
 		return
 	}
 
-	// Create the media folder.
+	// Create the media folder, and clear out any uploads, derived assets, and
+	// extracted text that were cut off the last time the server stopped.
 	err = os.MkdirAll(dirMedia, 0700)
 	if err != nil {
 		fmt.Println(err)
 		return
 	}
+	err = removeTempFiles()
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
 
 	// Set up the server routes.
 	h.establishServerRoutes()
 
+	// Periodically clear out sessions that have expired.
+	go h.threadedPruneSessions()
+
+	// Periodically clear out resumable uploads that were abandoned.
+	go h.threadedPruneUploads()
+
+	// Generate thumbnails and previews for uploaded media.
+	go h.threadedDeriveAssets()
+
 	fmt.Println("Serving...")
-	err = http.ListenAndServe(":3841", nil)
+	err = http.ListenAndServe(":3841", h.sessionMiddleware(http.DefaultServeMux))
 	if err != nil {
 		fmt.Println(err)
 		return
@@ -0,0 +1,24 @@
+package main
+
+import (
+	"path/filepath"
+	"testing"
+
+	"github.com/boltdb/bolt"
+)
+
+// newTestDB opens an empty database in a temporary folder with every bucket
+// of herus created.
+func newTestDB(t *testing.T) *bolt.DB {
+	t.Helper()
+	db, err := bolt.Open(filepath.Join(t.TempDir(), "herus.db"), 0600, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+	err = db.Update(initBuckets)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return db
+}
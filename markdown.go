@@ -0,0 +1,21 @@
+package main
+
+// markdown.go renders the markdown written by users into html that is safe to
+// place on a page.
+
+import (
+	"html/template"
+
+	"github.com/microcosm-cc/bluemonday"
+	"github.com/russross/blackfriday"
+)
+
+// markdownPolicy strips anything from the rendered markdown that could run
+// scripts or otherwise escape the page.
+var markdownPolicy = bluemonday.UGCPolicy()
+
+// renderMarkdown converts markdown into sanitized html.
+func renderMarkdown(markdown string) template.HTML {
+	unsafe := blackfriday.MarkdownCommon([]byte(markdown))
+	return template.HTML(markdownPolicy.SanitizeBytes(unsafe))
+}
@@ -2,13 +2,24 @@ package main
 
 // media.go manages the information regarding a piece of media, including
 // elaborations and annotations that have been added to the media.
+//
+// Media is stored in the media folder by hash alone, so the type of each piece
+// of media is detected from its contents when it is uploaded and recorded in
+// its metadata. Only the types in allowedMediaTypes can be uploaded. Media is
+// served with the recorded type, with sniffing turned off, and with a content
+// security policy that stops anything in the file from running, so that an
+// upload can never act as a page of the site.
 
 import (
 	"encoding/json"
+	"errors"
 	"html/template"
 	"io"
+	"mime"
 	"net/http"
+	"os"
 	"path/filepath"
+	"regexp"
 	"strings"
 	"time"
 
@@ -22,23 +33,95 @@ const (
 
 var (
 	elaborationTpl = filepath.Join(dirTemplates, "elaborations.tpl")
+
+	// allowedMediaTypes maps the types of media that can be uploaded, as
+	// reported by http.DetectContentType, to the file extension that is
+	// used when the media is saved from the browser.
+	allowedMediaTypes = map[string]string{
+		"application/ogg": ".ogg",
+		"application/pdf": ".pdf",
+		"audio/aiff":      ".aiff",
+		"audio/mpeg":      ".mp3",
+		"audio/wave":      ".wav",
+		"image/bmp":       ".bmp",
+		"image/gif":       ".gif",
+		"image/jpeg":      ".jpg",
+		"image/png":       ".png",
+		"image/webp":      ".webp",
+		"text/html":       ".html",
+		"text/plain":      ".txt",
+		"video/avi":       ".avi",
+		"video/mp4":       ".mp4",
+		"video/webm":      ".webm",
+	}
+
+	// inlineMediaTypes lists the types of media that are shown in the
+	// browser rather than downloaded.
+	inlineMediaTypes = map[string]bool{
+		"application/ogg": true,
+		"application/pdf": true,
+		"audio/mpeg":      true,
+		"audio/wave":      true,
+		"image/bmp":       true,
+		"image/gif":       true,
+		"image/jpeg":      true,
+		"image/png":       true,
+		"image/webp":      true,
+		"text/plain":      true,
+		"video/mp4":       true,
+		"video/webm":      true,
+	}
+
+	// mediaHashPattern matches the names of the files in the media folder.
+	mediaHashPattern = regexp.MustCompile("^[0-9a-f]{64}$")
+
+	errDisallowedMediaType = errors.New("media of this type cannot be uploaded")
 )
 
 // mediaMetadata contains the metadata regarding a piece of media.
+// ContentType, Size, Submitter, and SubmissionDate are empty for media
+// uploaded before they were recorded. Thumbnail and Preview are the urls of
+// the derived assets of the media, see derive.go, and TextStatus is the state
+// of the text extracted from the media, see extract.go. Hidden is set when every
+// submission of the media has been hidden by a moderator, see moderate.go.
 type mediaMetadata struct {
-	Title        string
-	Elaborations []mediaElaboration
+	Title          string
+	ContentType    string
+	Size           int64
+	Submitter      string
+	SubmissionDate time.Time
+	Elaborations   []mediaElaboration
+
+	AssetsStatus string
+	Preview      string
+	Thumbnail    string
+	TextStatus   string
+
+	Hidden bool
 }
 
 // elaborationTemplateData creates the data that fills out
 // templates/elaborations.tpl
 type elaborationTemplateData struct {
 	ElaborationPrefix string
+	FlagPage          string
 	Hash              string
 	MediaPrefix       string
+	Sort              string
 	Title             string
+	UserPrefix        string
+	VotePage          string
+
+	Submitter      string
+	SubmissionDate time.Time
 
 	Elaborations []mediaElaboration
+	HasText      bool
+	Preview      mediaPreview
+
+	// Thumbnails maps the hash of each elaboration that has a thumbnail to
+	// the url of the thumbnail.
+	Thumbnails map[string]string
 }
 
 // mediaElaboration connects elaborating media to the source media.
@@ -50,6 +133,68 @@ type mediaElaboration struct {
 
 	Downvotes uint64
 	Upvotes   uint64
+
+	Hidden bool
+}
+
+// baseMediaType returns the type of a piece of media without its parameters.
+func baseMediaType(contentType string) string {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return ""
+	}
+	return mediaType
+}
+
+// detectMediaType returns the type of a piece of media from the first bytes of
+// the media, and whether media of that type can be uploaded.
+func detectMediaType(head []byte) (string, bool) {
+	contentType := http.DetectContentType(head)
+	_, allowed := allowedMediaTypes[baseMediaType(contentType)]
+	return contentType, allowed
+}
+
+// mediaContentType returns the type that a piece of media is served with.
+// Media uploaded before types were recorded has its type detected from the
+// file, and media of a type that is not allowed is served as a download.
+func mediaContentType(mm mediaMetadata, path string) (string, error) {
+	contentType := mm.ContentType
+	if contentType == "" {
+		f, err := os.Open(path)
+		if err != nil {
+			return "", err
+		}
+		head := make([]byte, sniffLen)
+		n, err := io.ReadFull(f, head)
+		f.Close()
+		if err != nil && err != io.ErrUnexpectedEOF && err != io.EOF {
+			return "", err
+		}
+		contentType = http.DetectContentType(head[:n])
+	}
+	if _, allowed := allowedMediaTypes[baseMediaType(contentType)]; !allowed {
+		return "application/octet-stream", nil
+	}
+	return contentType, nil
+}
+
+// mediaFilename returns the name that a piece of media is given when it is
+// saved from the browser.
+func mediaFilename(title, contentType string) string {
+	name := strings.Map(func(r rune) rune {
+		if r < ' ' || strings.ContainsRune(`"/\:*?<>|`, r) {
+			return '_'
+		}
+		return r
+	}, strings.TrimSpace(title))
+	if name == "" {
+		name = "media"
+	}
+	ext := allowedMediaTypes[baseMediaType(contentType)]
+	if !strings.HasSuffix(strings.ToLower(name), ext) {
+		name += ext
+	}
+	return name
 }
 
 // executeMediaBody writes the html body for the media page.
@@ -79,6 +224,31 @@ func getMediaMetadata(tx *bolt.Tx, mediaName string) (mm mediaMetadata, exists b
 	return mm, true, nil
 }
 
+// putMediaMetadata stores the provided media metadata in the media bucket and
+// updates the search index and the media titles bucket.
+func putMediaMetadata(tx *bolt.Tx, mediaName string, mm mediaMetadata) error {
+	old, _, err := getMediaMetadata(tx, mediaName)
+	if err != nil {
+		return err
+	}
+	mmBytes, err := json.Marshal(mm)
+	if err != nil {
+		return err
+	}
+	bm := tx.Bucket(bucketMedia)
+	err = bm.Put([]byte(mediaName), mmBytes)
+	if err != nil {
+		return err
+	}
+	if old.Title != mm.Title {
+		err = indexMediaTitle(tx, mediaName, old.Title, mm.Title)
+		if err != nil {
+			return err
+		}
+	}
+	return indexMedia(tx, mediaName, mm)
+}
+
 // elaborationHandler handles requests for the elaborations on media.
 func (h *herus) elaborationHandler(w http.ResponseWriter, r *http.Request) {
 	// Parse the hash of the media for which the elaboration is being loaded.
@@ -86,29 +256,61 @@ func (h *herus) elaborationHandler(w http.ResponseWriter, r *http.Request) {
 
 	// Get a list of elaborations on the source media.
 	var mm mediaMetadata
+	var exists bool
+	var thumbnails map[string]string
 	err := h.db.View(func(tx *bolt.Tx) error {
-		var exists bool
 		var err error
 		mm, exists, err = getMediaMetadata(tx, sourceHash)
-		if !exists {
-			return nil
+		if err != nil {
+			return err
 		}
+		thumbnails, err = elaborationThumbnails(tx, mm.Elaborations)
 		return err
 	})
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
+	if !exists || !mediaHashPattern.MatchString(sourceHash) {
+		rootHandler(w, r)
+		return
+	}
+	// A preview that cannot be built, for example because the file is
+	// missing, should not take the elaborations down with it.
+	preview, err := buildMediaPreview(sourceHash, mm)
+	if err != nil {
+		println(err.Error())
+		preview = mediaPreview{Kind: previewNone}
+	}
+
+	// Drop anything hidden by a moderator and order what remains.
+	mm.Elaborations = visibleElaborations(mm.Elaborations)
+	sortMode := parseSortMode(r.URL.Query().Get("sort"))
+	rankElaborations(mm.Elaborations, sortMode)
 
 	// Fill out the struct that informs the elaboration template.
 	etd := elaborationTemplateData{
 		ElaborationPrefix: elaborationPrefix,
+		FlagPage:          flagPage,
 		Hash:              sourceHash,
 		MediaPrefix:       mediaPrefix,
+		Sort:              sortMode,
+		Title:             mm.Title,
+		UserPrefix:        userPrefix,
+		VotePage:          votePage,
+
+		Submitter:      mm.Submitter,
+		SubmissionDate: mm.SubmissionDate,
 
 		Elaborations: mm.Elaborations,
+		HasText:      mm.TextStatus == textReady,
+		Preview:      preview,
+		Thumbnails:   thumbnails,
 	}
-	err = executeHeader(w, HeaderTemplateData{Title: topicTitle})
+	if etd.Title == "" {
+		etd.Title = sourceHash
+	}
+	err = executeHeader(w, HeaderTemplateData{Title: etd.Title})
 	if err != nil {
 		println(err.Error())
 		http.Error(w, err.Error(), http.StatusBadRequest)
@@ -127,3 +329,78 @@ func (h *herus) elaborationHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 }
+
+// mediaHandler serves the media files. Every response carries the recorded
+// type of the media and headers that stop the browser from treating the media
+// as anything else.
+func (h *herus) mediaHandler(w http.ResponseWriter, r *http.Request) {
+	hash := strings.TrimPrefix(r.URL.Path, mediaPrefix)
+	text := strings.HasSuffix(hash, textSuffix)
+	hash = strings.TrimSuffix(hash, textSuffix)
+	if !mediaHashPattern.MatchString(hash) {
+		http.NotFound(w, r)
+		return
+	}
+
+	var mm mediaMetadata
+	var exists bool
+	err := h.db.View(func(tx *bolt.Tx) error {
+		var err error
+		mm, exists, err = getMediaMetadata(tx, hash)
+		return err
+	})
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if !exists {
+		http.NotFound(w, r)
+		return
+	}
+	if text {
+		serveMediaText(w, r, hash, mm)
+		return
+	}
+	path := filepath.Join(dirMedia, hash)
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		http.NotFound(w, r)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	contentType, err := mediaContentType(mm, path)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	disposition := "attachment"
+	if inlineMediaTypes[baseMediaType(contentType)] {
+		disposition = "inline"
+	}
+	// Browsers will not show a pdf inside a sandbox, and a pdf cannot run
+	// scripts against the site anyway, so it is the only type let out of
+	// the sandbox.
+	csp := "default-src 'none'; img-src 'self'; media-src 'self'; style-src 'unsafe-inline'; frame-ancestors 'self'"
+	if baseMediaType(contentType) != "application/pdf" {
+		csp += "; sandbox"
+	}
+	header := w.Header()
+	header.Set("Content-Type", contentType)
+	header.Set("Content-Disposition", mime.FormatMediaType(disposition, map[string]string{"filename": mediaFilename(mm.Title, contentType)}))
+	header.Set("Content-Security-Policy", csp)
+	header.Set("X-Content-Type-Options", "nosniff")
+	// Media never changes, because its name is its hash.
+	header.Set("Cache-Control", "public, max-age=31536000, immutable")
+	header.Set("ETag", `"`+hash+`"`)
+	http.ServeContent(w, r, "", info.ModTime(), f)
+}
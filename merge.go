@@ -0,0 +1,640 @@
+package main
+
+// merge.go implements the admin operations that clean up duplicate topics.
+//
+// Merging topic A into topic B moves the media and related topics of A onto
+// B. Anything that both topics already held is combined into a single entry
+// whose vote counters are the sum of the two. Relations in other topics that
+// led to A are pointed at B, and A is replaced by an alias that redirects to
+// B. The votes and flags on everything that moved are rekeyed so that they
+// follow the items to their new pages, which keeps the counters in agreement
+// with the votes bucket. Like connecting topics, merging never leaves two
+// relations between the same pair of topics; a relation that would lead the
+// other way along an existing relation is dropped along with its votes and
+// flags.
+//
+// Splitting a topic moves a selection of its media into a new topic, along
+// with the votes and flags on that media.
+
+import (
+	"encoding/json"
+	"errors"
+	"html/template"
+	"io"
+	"net/http"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/boltdb/bolt"
+)
+
+const (
+	mergePage = "/merge.go"
+	splitPage = "/split.go"
+
+	mergeTitle = "Merge Topics"
+	splitTitle = "Split a Topic"
+)
+
+var (
+	mergeTpl = filepath.Join(dirTemplates, "merge.tpl")
+	splitTpl = filepath.Join(dirTemplates, "split.tpl")
+
+	errMergeSelf    = errors.New("a topic cannot be merged into itself")
+	errSplitNoMedia = errors.New("select at least one piece of media to move")
+)
+
+// mergeTemplateData defines the data which is used to fill out the merge
+// template file.
+type mergeTemplateData struct {
+	Error       string
+	ErrorExists bool
+	From        string
+	Into        string
+	MergePage   string
+}
+
+// splitTemplateData defines the data which is used to fill out the split
+// template file.
+type splitTemplateData struct {
+	Error       string
+	ErrorExists bool
+	SplitPage   string
+	Title       string
+	Topic       string
+
+	Media []mediaRelation
+}
+
+// relocateFunc reports where an item on a page has moved to. keep is false if
+// the item no longer exists.
+type relocateFunc func(kind, page, item string) (newPage, newItem string, keep bool)
+
+// combineMedia adds the votes of src to dst. The combined media stays visible
+// unless both were hidden.
+func combineMedia(dst *mediaRelation, src mediaRelation) {
+	dst.Downvotes += src.Downvotes
+	dst.LeftVotes += src.LeftVotes
+	dst.RightVotes += src.RightVotes
+	dst.Upvotes += src.Upvotes
+	dst.Hidden = dst.Hidden && src.Hidden
+}
+
+// combineTopics adds the votes of src to dst. The combined relation stays
+// visible unless both were hidden.
+func combineTopics(dst *topicRelation, src topicRelation) {
+	dst.CenterVotes += src.CenterVotes
+	dst.Downvotes += src.Downvotes
+	dst.LeftVotes += src.LeftVotes
+	dst.RightVotes += src.RightVotes
+	dst.Upvotes += src.Upvotes
+	dst.Hidden = dst.Hidden && src.Hidden
+}
+
+// mediaIndex returns the index of the media with the provided hash, or -1.
+func mediaIndex(media []mediaRelation, hash string) int {
+	for i, mr := range media {
+		if mr.Hash == hash {
+			return i
+		}
+	}
+	return -1
+}
+
+// topicIndex returns the index of the relation to the named topic, or -1.
+func topicIndex(topics []topicRelation, name string) int {
+	for i, tr := range topics {
+		if tr.Title == name {
+			return i
+		}
+	}
+	return -1
+}
+
+// relocateVotes moves every media and topic vote to the item reported by
+// relocate. If a user had voted on both of two items that were combined, only
+// the vote on the surviving item is kept, and the counters of the combined
+// item are corrected to match.
+func relocateVotes(tx *bolt.Tx, author string, relocate relocateFunc) error {
+	type movedVote struct {
+		key     []byte
+		user    string
+		kind    string
+		newPage string
+		newItem string
+		keep    bool
+		uv      userVote
+	}
+
+	bv := tx.Bucket(bucketVotes)
+	var moved []movedVote
+	err := bv.ForEach(func(k, v []byte) error {
+		user, kind, page, item, ok := parseVoteKey(k)
+		if !ok || kind == itemKindElaboration {
+			return nil
+		}
+		newPage, newItem, keep := relocate(kind, page, item)
+		if keep && newPage == page && newItem == item {
+			return nil
+		}
+		var uv userVote
+		err := json.Unmarshal(v, &uv)
+		if err != nil {
+			return err
+		}
+		moved = append(moved, movedVote{
+			key:     append([]byte(nil), k...),
+			user:    user,
+			kind:    kind,
+			newPage: newPage,
+			newItem: newItem,
+			keep:    keep,
+			uv:      uv,
+		})
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	for _, mv := range moved {
+		err = bv.Delete(mv.key)
+		if err != nil {
+			return err
+		}
+		if mv.keep {
+			newKey := voteKey(mv.user, mv.kind, mv.newPage, mv.newItem)
+			if bv.Get(newKey) == nil {
+				voteBytes, err := json.Marshal(mv.uv)
+				if err != nil {
+					return err
+				}
+				err = bv.Put(newKey, voteBytes)
+				if err != nil {
+					return err
+				}
+				continue
+			}
+			err = applyVote(tx, mv.kind, mv.newPage, mv.newItem, author, mv.uv, userVote{})
+			if err != nil {
+				return err
+			}
+		}
+
+		// The vote was discarded, so it no longer counts towards the total
+		// of the user.
+		u, exists, err := getUser(tx, mv.user)
+		if err != nil {
+			return err
+		}
+		if !exists {
+			continue
+		}
+		if u.Votes > 0 {
+			u.Votes--
+		}
+		err = putUser(tx, u)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// relocateFlags moves the flags on media and topic relations to the item
+// reported by relocate. Flags on items that were combined are combined as
+// well.
+func relocateFlags(tx *bolt.Tx, relocate relocateFunc) error {
+	bf := tx.Bucket(bucketFlags)
+	var stale [][]byte
+	var moved []flaggedItem
+	err := bf.ForEach(func(k, v []byte) error {
+		var fi flaggedItem
+		err := json.Unmarshal(v, &fi)
+		if err != nil {
+			return err
+		}
+		if fi.Kind == itemKindElaboration {
+			return nil
+		}
+		newPage, newItem, keep := relocate(fi.Kind, fi.Page, fi.Item)
+		if keep && newPage == fi.Page && newItem == fi.Item {
+			return nil
+		}
+		stale = append(stale, append([]byte(nil), k...))
+		if keep {
+			fi.Page = newPage
+			fi.Item = newItem
+			if fi.Kind == itemKindTopic {
+				fi.Title = newItem
+			}
+			moved = append(moved, fi)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	for _, k := range stale {
+		err = bf.Delete(k)
+		if err != nil {
+			return err
+		}
+	}
+	for _, fi := range moved {
+		existing, exists, err := getFlaggedItem(tx, flagKey(fi.Kind, fi.Page, fi.Item))
+		if err != nil {
+			return err
+		}
+		if exists {
+			fi.Flags = append(existing.Flags, fi.Flags...)
+			fi.Hidden = existing.Hidden && fi.Hidden
+		}
+		err = putFlaggedItem(tx, fi)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// mergeTopics merges the topic named from into the topic named into on
+// behalf of an admin, returning the canonical name of the merged topic.
+func mergeTopics(tx *bolt.Tx, from, into, admin string) (string, error) {
+	from, err := resolveTopic(tx, from)
+	if err != nil {
+		return "", err
+	}
+	into, err = resolveTopic(tx, into)
+	if err != nil {
+		return "", err
+	}
+	if from == into {
+		return "", errMergeSelf
+	}
+	fromTD, exists, err := getTopic(tx, from)
+	if err != nil {
+		return "", err
+	}
+	if !exists {
+		return "", errMissingTopic
+	}
+	intoTD, exists, err := getTopic(tx, into)
+	if err != nil {
+		return "", err
+	}
+	if !exists {
+		return "", errMissingTopic
+	}
+
+	// Move the media and related topics, combining duplicates. Relations
+	// between the two topics would point the merged topic at itself, so they
+	// are dropped, as are relations to topics that already lead to either
+	// of the two topics.
+	droppedOutbound := make(map[string]bool)
+	for _, mr := range fromTD.AssociatedMedia {
+		i := mediaIndex(intoTD.AssociatedMedia, mr.Hash)
+		if i < 0 {
+			intoTD.AssociatedMedia = append(intoTD.AssociatedMedia, mr)
+			continue
+		}
+		combineMedia(&intoTD.AssociatedMedia[i], mr)
+	}
+	for _, tr := range fromTD.RelatedTopics {
+		if tr.Title == from || tr.Title == into {
+			continue
+		}
+		i := topicIndex(intoTD.RelatedTopics, tr.Title)
+		if i >= 0 {
+			combineTopics(&intoTD.RelatedTopics[i], tr)
+			continue
+		}
+		if relatesTo(tx, tr.Title, into) || relatesTo(tx, tr.Title, from) {
+			droppedOutbound[tr.Title] = true
+			continue
+		}
+		intoTD.RelatedTopics = append(intoTD.RelatedTopics, tr)
+	}
+	if i := topicIndex(intoTD.RelatedTopics, from); i >= 0 {
+		intoTD.RelatedTopics = append(intoTD.RelatedTopics[:i], intoTD.RelatedTopics[i+1:]...)
+	}
+	if intoTD.Description == "" {
+		intoTD.Description = fromTD.Description
+	}
+	err = putTopic(tx, into, intoTD, admin)
+	if err != nil {
+		return "", err
+	}
+
+	// Point the relations in other topics at the merged topic, dropping
+	// those that would lead back along a relation of the merged topic.
+	droppedInbound := make(map[string]bool)
+	var inbound []string
+	err = tx.Bucket(bucketTopics).ForEach(func(k, v []byte) error {
+		name := string(k)
+		if name == from || name == into {
+			return nil
+		}
+		var td topicData
+		err := json.Unmarshal(v, &td)
+		if err != nil {
+			return err
+		}
+		if topicIndex(td.RelatedTopics, from) >= 0 {
+			inbound = append(inbound, name)
+		}
+		return nil
+	})
+	if err != nil {
+		return "", err
+	}
+	for _, name := range inbound {
+		td, _, err := getTopic(tx, name)
+		if err != nil {
+			return "", err
+		}
+		i := topicIndex(td.RelatedTopics, from)
+		j := topicIndex(td.RelatedTopics, into)
+		if j < 0 && topicIndex(intoTD.RelatedTopics, name) >= 0 {
+			droppedInbound[name] = true
+			td.RelatedTopics = append(td.RelatedTopics[:i], td.RelatedTopics[i+1:]...)
+		} else if j < 0 {
+			td.RelatedTopics[i].Title = into
+		} else {
+			combineTopics(&td.RelatedTopics[j], td.RelatedTopics[i])
+			td.RelatedTopics = append(td.RelatedTopics[:i], td.RelatedTopics[i+1:]...)
+		}
+		err = putTopic(tx, name, td, admin)
+		if err != nil {
+			return "", err
+		}
+	}
+
+	// Replace the old topic with an alias, and send the aliases of the old
+	// topic straight to the merged topic.
+	err = deleteTopic(tx, from)
+	if err != nil {
+		return "", err
+	}
+	ba := tx.Bucket(bucketAliases)
+	var aliases [][]byte
+	err = ba.ForEach(func(k, v []byte) error {
+		if string(v) == from {
+			aliases = append(aliases, append([]byte(nil), k...))
+		}
+		return nil
+	})
+	if err != nil {
+		return "", err
+	}
+	for _, alias := range aliases {
+		err = ba.Put(alias, []byte(into))
+		if err != nil {
+			return "", err
+		}
+	}
+	err = putAlias(tx, from, into)
+	if err != nil {
+		return "", err
+	}
+
+	relocate := func(kind, page, item string) (string, string, bool) {
+		switch {
+		case kind == itemKindMedia && page == from:
+			return into, item, true
+		case kind == itemKindTopic && page == from:
+			if item == from || item == into || droppedOutbound[item] {
+				return "", "", false
+			}
+			return into, item, true
+		case kind == itemKindTopic && item == from:
+			if page == into || droppedInbound[page] {
+				return "", "", false
+			}
+			return page, into, true
+		}
+		return page, item, true
+	}
+	err = relocateVotes(tx, admin, relocate)
+	if err != nil {
+		return "", err
+	}
+	err = relocateFlags(tx, relocate)
+	if err != nil {
+		return "", err
+	}
+	return into, nil
+}
+
+// splitTopic moves the media with the provided hashes out of a topic and into
+// a new topic with the provided title, returning the name of the new topic.
+func splitTopic(tx *bolt.Tx, from, title string, hashes []string, admin string) (string, error) {
+	title = strings.TrimSpace(title)
+	if title == "" {
+		return "", errMissingTopicTitle
+	}
+	name := canonicalTopicName(title)
+	if name == "" {
+		return "", errInvalidTopicName
+	}
+	from, err := resolveTopic(tx, from)
+	if err != nil {
+		return "", err
+	}
+	fromTD, exists, err := getTopic(tx, from)
+	if err != nil {
+		return "", err
+	}
+	if !exists {
+		return "", errMissingTopic
+	}
+
+	// The new name must not already be taken by a topic or an alias.
+	resolved, err := resolveTopic(tx, name)
+	if err != nil {
+		return "", err
+	}
+	if resolved != name {
+		return "", errDuplicateTopic
+	}
+	_, exists, err = getTopic(tx, name)
+	if err != nil {
+		return "", err
+	}
+	if exists {
+		return "", errDuplicateTopic
+	}
+
+	selected := make(map[string]bool)
+	for _, hash := range hashes {
+		selected[hash] = true
+	}
+	newTD := topicData{
+		CreationDate: time.Now(),
+		Creator:      admin,
+		Title:        title,
+	}
+	var remaining []mediaRelation
+	for _, mr := range fromTD.AssociatedMedia {
+		if selected[mr.Hash] {
+			newTD.AssociatedMedia = append(newTD.AssociatedMedia, mr)
+		} else {
+			remaining = append(remaining, mr)
+		}
+	}
+	if len(newTD.AssociatedMedia) == 0 {
+		return "", errSplitNoMedia
+	}
+	fromTD.AssociatedMedia = remaining
+	err = putTopic(tx, from, fromTD, admin)
+	if err != nil {
+		return "", err
+	}
+	err = putTopic(tx, name, newTD, admin)
+	if err != nil {
+		return "", err
+	}
+
+	relocate := func(kind, page, item string) (string, string, bool) {
+		if kind == itemKindMedia && page == from && selected[item] {
+			return name, item, true
+		}
+		return page, item, true
+	}
+	err = relocateVotes(tx, admin, relocate)
+	if err != nil {
+		return "", err
+	}
+	err = relocateFlags(tx, relocate)
+	if err != nil {
+		return "", err
+	}
+	return name, nil
+}
+
+// executeMergeBody builds the body portion of the merge page.
+func executeMergeBody(w io.Writer, mtd mergeTemplateData) error {
+	t, err := template.ParseFiles(mergeTpl)
+	if err != nil {
+		return err
+	}
+	return t.Execute(w, mtd)
+}
+
+// executeSplitBody builds the body portion of the split page.
+func executeSplitBody(w io.Writer, std splitTemplateData) error {
+	t, err := template.ParseFiles(splitTpl)
+	if err != nil {
+		return err
+	}
+	return t.Execute(w, std)
+}
+
+// mergeHandler handles requests to merge one topic into another. A successful
+// merge sends the admin to the page of the merged topic.
+func (h *herus) mergeHandler(w http.ResponseWriter, r *http.Request) {
+	mtd := mergeTemplateData{
+		From:      r.URL.Query().Get("from"),
+		MergePage: mergePage,
+	}
+	if r.Method == "POST" {
+		user, _ := currentUser(r)
+		mtd.From = r.FormValue("from")
+		mtd.Into = r.FormValue("into")
+		var into string
+		err := h.db.Update(func(tx *bolt.Tx) error {
+			var err error
+			into, err = mergeTopics(tx, mtd.From, mtd.Into, user.Name)
+			return err
+		})
+		if err == nil {
+			http.Redirect(w, r, topicURL(into), http.StatusSeeOther)
+			return
+		}
+		mtd.ErrorExists = true
+		mtd.Error = err.Error()
+	}
+
+	err := executeHeader(w, HeaderTemplateData{Title: mergeTitle})
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	err = executeMergeBody(w, mtd)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	err = executeFooter(w)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+}
+
+// splitHandler handles requests to split media out of a topic into a new
+// topic. The media of the topic named in the 'topic' parameter is listed so
+// that the admin can pick what to move. A successful split sends the admin to
+// the page of the new topic.
+func (h *herus) splitHandler(w http.ResponseWriter, r *http.Request) {
+	std := splitTemplateData{
+		SplitPage: splitPage,
+		Topic:     r.FormValue("topic"),
+	}
+	if r.Method == "POST" {
+		user, _ := currentUser(r)
+		std.Title = r.FormValue("title")
+		var name string
+		err := h.db.Update(func(tx *bolt.Tx) error {
+			var err error
+			name, err = splitTopic(tx, std.Topic, std.Title, r.Form["media"], user.Name)
+			return err
+		})
+		if err == nil {
+			http.Redirect(w, r, topicURL(name), http.StatusSeeOther)
+			return
+		}
+		std.ErrorExists = true
+		std.Error = err.Error()
+	}
+	if std.Topic != "" {
+		err := h.db.View(func(tx *bolt.Tx) error {
+			name, err := resolveTopic(tx, std.Topic)
+			if err != nil {
+				return err
+			}
+			td, exists, err := getTopic(tx, name)
+			if err != nil {
+				return err
+			}
+			if !exists {
+				return errMissingTopic
+			}
+			std.Topic = name
+			std.Media = td.AssociatedMedia
+			return nil
+		})
+		if err != nil && !std.ErrorExists {
+			std.ErrorExists = true
+			std.Error = err.Error()
+		}
+	}
+
+	err := executeHeader(w, HeaderTemplateData{Title: splitTitle})
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	err = executeSplitBody(w, std)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	err = executeFooter(w)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+}
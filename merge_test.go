@@ -0,0 +1,81 @@
+package main
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/boltdb/bolt"
+)
+
+// TestMergeTopicsDropsReverseRelations checks that merging never leaves a
+// relation in each direction between the merged topic and another topic.
+func TestMergeTopicsDropsReverseRelations(t *testing.T) {
+	tests := []struct {
+		name      string
+		relations map[string][]string
+	}{
+		// from leads to x, and x already leads to into.
+		{"outbound", map[string][]string{"from": {"x"}, "into": nil, "x": {"into"}}},
+		// x leads to from, and into already leads to x.
+		{"inbound", map[string][]string{"from": nil, "into": {"x"}, "x": {"from"}}},
+		// from leads to x, and x leads to from.
+		{"both", map[string][]string{"from": {"x"}, "into": nil, "x": {"from"}}},
+	}
+	for _, test := range tests {
+		db := newTestDB(t)
+		err := db.Update(func(tx *bolt.Tx) error {
+			for name, destinations := range test.relations {
+				var td topicData
+				for _, destination := range destinations {
+					td.RelatedTopics = append(td.RelatedTopics, topicRelation{Title: destination, Upvotes: 1})
+				}
+				err := putTopic(tx, name, td, "admin")
+				if err != nil {
+					return err
+				}
+			}
+			vote, err := json.Marshal(userVote{Value: voteUp})
+			if err != nil {
+				return err
+			}
+			for name, destinations := range test.relations {
+				for _, destination := range destinations {
+					err = tx.Bucket(bucketVotes).Put(voteKey("alice", itemKindTopic, name, destination), vote)
+					if err != nil {
+						return err
+					}
+				}
+			}
+			_, err = mergeTopics(tx, "from", "into", "admin")
+			return err
+		})
+		if err != nil {
+			t.Fatalf("%v: %v", test.name, err)
+		}
+
+		err = db.View(func(tx *bolt.Tx) error {
+			if relatesTo(tx, "into", "x") && relatesTo(tx, "x", "into") {
+				t.Errorf("%v: into and x are related in both directions", test.name)
+			}
+			if !hasRelation(tx, "into", "x") {
+				t.Errorf("%v: into and x are no longer related", test.name)
+			}
+
+			// Every remaining vote must be on a relation that exists.
+			return tx.Bucket(bucketVotes).ForEach(func(k, v []byte) error {
+				_, _, page, item, _ := parseVoteKey(k)
+				td, _, err := getTopic(tx, page)
+				if err != nil {
+					return err
+				}
+				if topicIndex(td.RelatedTopics, item) < 0 {
+					t.Errorf("%v: vote on %v -> %v outlived its relation", test.name, page, item)
+				}
+				return nil
+			})
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+}
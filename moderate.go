@@ -0,0 +1,575 @@
+package main
+
+// moderate.go handles the flagging of abusive users and submissions, and the
+// moderation queue where moderators act on those flags.
+//
+// Flags on users are stored in the Flags field of the user. Flags on
+// submissions are stored in the flags bucket, keyed by the kind, page, and
+// item of the submission. Hiding a submission only sets its Hidden field, the
+// submission stays in the database and can be restored by a moderator. Media
+// whose every submission has been hidden is marked as hidden as well, which
+// keeps it out of search and suggestions.
+//
+// Moderators can only act on users whose role is below their own, so that a
+// moderator cannot suspend an admin or another moderator.
+
+import (
+	"encoding/json"
+	"errors"
+	"html/template"
+	"io"
+	"net/http"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/boltdb/bolt"
+)
+
+const (
+	flagPage     = "/flag.go"
+	moderatePage = "/moderate.go"
+
+	moderateTitle = "Moderation Queue"
+
+	// maxFlagsPerWindow is the number of flags that a single user can submit
+	// within flagWindow.
+	maxFlagsPerWindow = 10
+	flagWindow        = 24 * time.Hour
+)
+
+var (
+	moderateTpl = filepath.Join(dirTemplates, "moderate.tpl")
+
+	errAlreadyFlagged  = errors.New("you have already flagged this")
+	errFlagRateLimit   = errors.New("you have submitted too many flags recently, try again later")
+	errFlagSelf        = errors.New("you cannot flag yourself")
+	errInvalidAction   = errors.New("unrecognized moderation action")
+	errMissingUser     = errors.New("user does not exist")
+	errSuspendedLogin  = errors.New("this account has been suspended")
+	errMissingFlagItem = errors.New("flag must be given a user or an item")
+	errOutranked       = errors.New("you can only moderate users whose role is below your own")
+)
+
+// moderatable is implemented by each of the submission types that can be
+// hidden by a moderator.
+type moderatable interface {
+	itemTitle() string
+	setHidden(hidden bool)
+}
+
+// flaggedItem is the entry in the flags bucket for a submission that has been
+// flagged.
+type flaggedItem struct {
+	Kind  string
+	Page  string
+	Item  string
+	Title string
+
+	Flags  []flags
+	Hidden bool
+}
+
+// moderateTemplateData defines the data which is used to fill out the
+// moderate template file.
+type moderateTemplateData struct {
+	ElaborationPrefix string
+	ModeratePage      string
+	TopicPrefix       string
+	UserPrefix        string
+
+	Error       string
+	ErrorExists bool
+
+	Items []flaggedItem
+	Users []User
+}
+
+// itemTitle returns the title of a media relation.
+func (mr *mediaRelation) itemTitle() string {
+	return mr.Title
+}
+
+// setHidden hides or restores a media relation.
+func (mr *mediaRelation) setHidden(hidden bool) {
+	mr.Hidden = hidden
+}
+
+// itemTitle returns the title of a topic relation.
+func (tr *topicRelation) itemTitle() string {
+	return tr.Title
+}
+
+// setHidden hides or restores a topic relation.
+func (tr *topicRelation) setHidden(hidden bool) {
+	tr.Hidden = hidden
+}
+
+// itemTitle returns the title of an elaboration.
+func (me *mediaElaboration) itemTitle() string {
+	return me.Title
+}
+
+// setHidden hides or restores an elaboration.
+func (me *mediaElaboration) setHidden(hidden bool) {
+	me.Hidden = hidden
+}
+
+// flagKey returns the key in the flags bucket for a submission.
+func flagKey(kind, page, item string) []byte {
+	return []byte(kind + ":" + page + "\x00" + item)
+}
+
+// visibleMedia returns the media that have not been hidden by a moderator.
+func visibleMedia(media []mediaRelation) []mediaRelation {
+	var visible []mediaRelation
+	for _, mr := range media {
+		if !mr.Hidden {
+			visible = append(visible, mr)
+		}
+	}
+	return visible
+}
+
+// visibleTopics returns the related topics that have not been hidden by a
+// moderator.
+func visibleTopics(topics []topicRelation) []topicRelation {
+	var visible []topicRelation
+	for _, tr := range topics {
+		if !tr.Hidden {
+			visible = append(visible, tr)
+		}
+	}
+	return visible
+}
+
+// visibleElaborations returns the elaborations that have not been hidden by a
+// moderator.
+func visibleElaborations(elaborations []mediaElaboration) []mediaElaboration {
+	var visible []mediaElaboration
+	for _, me := range elaborations {
+		if !me.Hidden {
+			visible = append(visible, me)
+		}
+	}
+	return visible
+}
+
+// recordFlagSubmission checks that the flagger has not exceeded the flag rate
+// limit, and then counts the new flag against the limit.
+func recordFlagSubmission(tx *bolt.Tx, flagger string) error {
+	user, exists, err := getUser(tx, flagger)
+	if err != nil {
+		return err
+	}
+	if !exists {
+		return errMissingUser
+	}
+	var recent []time.Time
+	for _, t := range user.RecentFlags {
+		if time.Since(t) < flagWindow {
+			recent = append(recent, t)
+		}
+	}
+	if len(recent) >= maxFlagsPerWindow {
+		return errFlagRateLimit
+	}
+	user.RecentFlags = append(recent, time.Now())
+	return putUser(tx, user)
+}
+
+// flagUser adds a flag from the flagger to the target user. If all of the
+// flag slots of the target are full, the oldest flag is replaced.
+func flagUser(tx *bolt.Tx, flagger, target string) error {
+	if flagger == target {
+		return errFlagSelf
+	}
+	user, exists, err := getUser(tx, target)
+	if err != nil {
+		return err
+	}
+	if !exists {
+		return errMissingUser
+	}
+	slot := 0
+	for i, f := range user.Flags {
+		if f.FlaggerName == flagger {
+			return errAlreadyFlagged
+		}
+		if f.Time.Before(user.Flags[slot].Time) {
+			slot = i
+		}
+	}
+	err = recordFlagSubmission(tx, flagger)
+	if err != nil {
+		return err
+	}
+	user.Flags[slot] = flags{Time: time.Now(), FlaggerName: flagger}
+	return putUser(tx, user)
+}
+
+// getFlaggedItem returns the entry in the flags bucket for a submission.
+func getFlaggedItem(tx *bolt.Tx, key []byte) (fi flaggedItem, exists bool, err error) {
+	fiBytes := tx.Bucket(bucketFlags).Get(key)
+	if fiBytes == nil {
+		return flaggedItem{}, false, nil
+	}
+	err = json.Unmarshal(fiBytes, &fi)
+	if err != nil {
+		return flaggedItem{}, true, err
+	}
+	return fi, true, nil
+}
+
+// putFlaggedItem stores the entry in the flags bucket for a submission.
+func putFlaggedItem(tx *bolt.Tx, fi flaggedItem) error {
+	fiBytes, err := json.Marshal(fi)
+	if err != nil {
+		return err
+	}
+	return tx.Bucket(bucketFlags).Put(flagKey(fi.Kind, fi.Page, fi.Item), fiBytes)
+}
+
+// flagItem adds a flag from the flagger to a submission.
+func flagItem(tx *bolt.Tx, flagger, kind, page, item string) error {
+	c, _, err := findItem(tx, kind, page, item, flagger)
+	if err != nil {
+		return err
+	}
+	fi, exists, err := getFlaggedItem(tx, flagKey(kind, page, item))
+	if err != nil {
+		return err
+	}
+	if !exists {
+		fi = flaggedItem{
+			Kind:  kind,
+			Page:  page,
+			Item:  item,
+			Title: c.(moderatable).itemTitle(),
+		}
+	}
+	for _, f := range fi.Flags {
+		if f.FlaggerName == flagger {
+			return errAlreadyFlagged
+		}
+	}
+	err = recordFlagSubmission(tx, flagger)
+	if err != nil {
+		return err
+	}
+	fi.Flags = append(fi.Flags, flags{Time: time.Now(), FlaggerName: flagger})
+	return putFlaggedItem(tx, fi)
+}
+
+// setItemHidden hides or restores a submission on behalf of a moderator.
+func setItemHidden(tx *bolt.Tx, kind, page, item, moderator string, hidden bool) error {
+	err := updateItem(tx, kind, page, item, moderator, func(c voteCounter) error {
+		c.(moderatable).setHidden(hidden)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	if kind == itemKindMedia || kind == itemKindElaboration {
+		err = refreshMediaHidden(tx, item)
+		if err != nil {
+			return err
+		}
+	}
+
+	// Keep the moderation queue in sync with the submission.
+	key := flagKey(kind, page, item)
+	fi, exists, err := getFlaggedItem(tx, key)
+	if err != nil || !exists {
+		return err
+	}
+	fi.Hidden = hidden
+	return putFlaggedItem(tx, fi)
+}
+
+// refreshMediaHidden records whether every submission of a piece of media, to
+// a topic or as an elaboration, has been hidden by a moderator.
+func refreshMediaHidden(tx *bolt.Tx, hash string) error {
+	found, hidden := false, true
+	err := tx.Bucket(bucketTopics).ForEach(func(k, v []byte) error {
+		var td topicData
+		err := json.Unmarshal(v, &td)
+		if err != nil {
+			return err
+		}
+		for _, mr := range td.AssociatedMedia {
+			if mr.Hash == hash {
+				found, hidden = true, hidden && mr.Hidden
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	err = tx.Bucket(bucketMedia).ForEach(func(k, v []byte) error {
+		var mm mediaMetadata
+		err := json.Unmarshal(v, &mm)
+		if err != nil {
+			return err
+		}
+		for _, me := range mm.Elaborations {
+			if me.Hash == hash {
+				found, hidden = true, hidden && me.Hidden
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	mm, exists, err := getMediaMetadata(tx, hash)
+	if err != nil || !exists {
+		return err
+	}
+	if mm.Hidden == (found && hidden) {
+		return nil
+	}
+	mm.Hidden = found && hidden
+	return putMediaMetadata(tx, hash, mm)
+}
+
+// checkOutranks returns an error unless the moderator holds a role above the
+// role of the named user.
+func checkOutranks(tx *bolt.Tx, moderator User, name string) error {
+	target, exists, err := getUser(tx, name)
+	if err != nil {
+		return err
+	}
+	if !exists {
+		return errMissingUser
+	}
+	if roleLevels[target.Role()] >= roleLevels[moderator.Role()] {
+		return errOutranked
+	}
+	return nil
+}
+
+// setUserSuspended suspends or reinstates a user. Suspending a user logs them
+// out everywhere.
+func setUserSuspended(tx *bolt.Tx, name string, suspended bool) error {
+	user, exists, err := getUser(tx, name)
+	if err != nil {
+		return err
+	}
+	if !exists {
+		return errMissingUser
+	}
+	user.Suspended = suspended
+	err = putUser(tx, user)
+	if err != nil {
+		return err
+	}
+	if suspended {
+		return revokeUserSessions(tx, name)
+	}
+	return nil
+}
+
+// clearUserFlags removes all of the flags from a user.
+func clearUserFlags(tx *bolt.Tx, name string) error {
+	user, exists, err := getUser(tx, name)
+	if err != nil {
+		return err
+	}
+	if !exists {
+		return errMissingUser
+	}
+	user.Flags = [15]flags{}
+	return putUser(tx, user)
+}
+
+// flaggedUsers returns every user that has at least one flag or that has been
+// suspended.
+func flaggedUsers(tx *bolt.Tx) ([]User, error) {
+	var users []User
+	err := tx.Bucket(bucketUsers).ForEach(func(k, v []byte) error {
+		var user User
+		err := json.Unmarshal(v, &user)
+		if err != nil {
+			return err
+		}
+		flagged := user.Suspended
+		for _, f := range user.Flags {
+			if f.FlaggerName != "" {
+				flagged = true
+			}
+		}
+		if flagged {
+			users = append(users, user)
+		}
+		return nil
+	})
+	return users, err
+}
+
+// flaggedItems returns every submission in the flags bucket.
+func flaggedItems(tx *bolt.Tx) ([]flaggedItem, error) {
+	var items []flaggedItem
+	err := tx.Bucket(bucketFlags).ForEach(func(k, v []byte) error {
+		var fi flaggedItem
+		err := json.Unmarshal(v, &fi)
+		if err != nil {
+			return err
+		}
+		items = append(items, fi)
+		return nil
+	})
+	return items, err
+}
+
+// NumFlags returns the number of flags that have been placed on the user.
+func (u User) NumFlags() int {
+	n := 0
+	for _, f := range u.Flags {
+		if f.FlaggerName != "" {
+			n++
+		}
+	}
+	return n
+}
+
+// flagRedirect returns the page that a user should be sent back to after
+// flagging something.
+func flagRedirect(r *http.Request) string {
+	if target := r.FormValue("user"); target != "" {
+		return userPrefix + target
+	}
+	if r.FormValue("kind") == itemKindElaboration {
+		return elaborationPrefix + r.FormValue("page")
+	}
+	if back := r.FormValue("return"); back != "" {
+		return topicURL(back)
+	}
+	return topicURL(r.FormValue("page"))
+}
+
+// flagHandler handles requests to flag a user or a submission.
+func (h *herus) flagHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "flags must be submitted with a POST request", http.StatusMethodNotAllowed)
+		return
+	}
+	user, _ := currentUser(r)
+	err := r.ParseForm()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	target := strings.ToLower(r.FormValue("user"))
+	kind := r.FormValue("kind")
+	err = h.db.Update(func(tx *bolt.Tx) error {
+		if target != "" {
+			return flagUser(tx, user.Name, target)
+		}
+		if kind != "" {
+			return flagItem(tx, user.Name, kind, r.FormValue("page"), r.FormValue("item"))
+		}
+		return errMissingFlagItem
+	})
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	http.Redirect(w, r, flagRedirect(r), http.StatusSeeOther)
+}
+
+// processModerateAction performs the action that a moderator submitted from
+// the moderation queue.
+func (h *herus) processModerateAction(r *http.Request) error {
+	err := r.ParseForm()
+	if err != nil {
+		return err
+	}
+	moderator, _ := currentUser(r)
+	name := r.FormValue("user")
+	kind := r.FormValue("kind")
+	page := r.FormValue("page")
+	item := r.FormValue("item")
+	return h.db.Update(func(tx *bolt.Tx) error {
+		action := r.FormValue("action")
+		if action == "suspend" || action == "reinstate" || action == "clearFlags" {
+			err := checkOutranks(tx, moderator, name)
+			if err != nil {
+				return err
+			}
+		}
+		switch action {
+		case "suspend":
+			return setUserSuspended(tx, name, true)
+		case "reinstate":
+			return setUserSuspended(tx, name, false)
+		case "clearFlags":
+			return clearUserFlags(tx, name)
+		case "hide":
+			return setItemHidden(tx, kind, page, item, moderator.Name, true)
+		case "unhide":
+			return setItemHidden(tx, kind, page, item, moderator.Name, false)
+		case "dismiss":
+			return tx.Bucket(bucketFlags).Delete(flagKey(kind, page, item))
+		}
+		return errInvalidAction
+	})
+}
+
+// executeModerateBody builds the body portion of the moderation queue page.
+func executeModerateBody(w io.Writer, mtd moderateTemplateData) error {
+	t, err := template.ParseFiles(moderateTpl)
+	if err != nil {
+		return err
+	}
+	return t.Execute(w, mtd)
+}
+
+// moderateHandler handles requests for the moderation queue.
+func (h *herus) moderateHandler(w http.ResponseWriter, r *http.Request) {
+	mtd := moderateTemplateData{
+		ElaborationPrefix: elaborationPrefix,
+		ModeratePage:      moderatePage,
+		TopicPrefix:       topicPrefix,
+		UserPrefix:        userPrefix,
+	}
+	if r.Method == "POST" {
+		err := h.processModerateAction(r)
+		if err != nil {
+			mtd.ErrorExists = true
+			mtd.Error = err.Error()
+		}
+	}
+	err := h.db.View(func(tx *bolt.Tx) error {
+		var err error
+		mtd.Users, err = flaggedUsers(tx)
+		if err != nil {
+			return err
+		}
+		mtd.Items, err = flaggedItems(tx)
+		return err
+	})
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	err = executeHeader(w, HeaderTemplateData{Title: moderateTitle})
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	err = executeModerateBody(w, mtd)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	err = executeFooter(w)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+}
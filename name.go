@@ -0,0 +1,426 @@
+package main
+
+// name.go turns the free text names that users give to topics into canonical
+// topic names, and manages the aliases that let several names point at the
+// same topic.
+//
+// A canonical topic name is NFKC normalized and lowercased, and is made up of
+// letters, digits, '-' and '+', with each run of spaces, underscores,
+// slashes, and other punctuation collapsed into a single '_'. Canonical names
+// are used as the keys of the topics bucket and in topic urls. Databases from
+// before canonical names have their topics moved onto canonical names when
+// the server starts.
+
+import (
+	"errors"
+	"html/template"
+	"io"
+	"net/http"
+	"net/url"
+	"path/filepath"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/boltdb/bolt"
+	"golang.org/x/text/unicode/norm"
+)
+
+const (
+	aliasPage = "/alias.go"
+
+	aliasTitle = "Add a Topic Alias"
+
+	// maxAliasDepth limits how many aliases are followed when resolving a
+	// name, protecting against alias loops.
+	maxAliasDepth = 8
+)
+
+var (
+	aliasTpl = filepath.Join(dirTemplates, "alias.tpl")
+
+	errAliasIsTopic     = errors.New("alias is already the name of a topic")
+	errAliasLoop        = errors.New("alias would point back at itself")
+	errInvalidTopicName = errors.New("topic names must contain at least one letter or number")
+)
+
+// aliasTemplateData defines the data which is used to fill out the alias
+// template file.
+type aliasTemplateData struct {
+	Alias            string
+	Error            string
+	ErrorExists      bool
+	PostWithoutError bool
+	Topic            string
+	TopicPrefix      string
+}
+
+// canonicalTopicName converts a topic name into its canonical form.
+func canonicalTopicName(name string) string {
+	name = norm.NFKC.String(name)
+	name = strings.ToLower(name)
+
+	var b strings.Builder
+	pendingSeparator := false
+	for _, c := range name {
+		if unicode.IsLetter(c) || unicode.IsDigit(c) || c == '-' || c == '+' {
+			if pendingSeparator && b.Len() > 0 {
+				b.WriteByte('_')
+			}
+			pendingSeparator = false
+			b.WriteRune(c)
+			continue
+		}
+		// Anything else, including whitespace, underscores, slashes, and
+		// other punctuation, separates words.
+		pendingSeparator = true
+	}
+	return b.String()
+}
+
+// topicTitleFromName builds a display title for a topic that was never given
+// one, by capitalizing each word of the canonical name.
+func topicTitleFromName(name string) string {
+	words := strings.Split(name, "_")
+	for i, word := range words {
+		c, size := utf8.DecodeRuneInString(word)
+		if size > 0 {
+			words[i] = string(unicode.ToTitle(c)) + word[size:]
+		}
+	}
+	return strings.Join(words, " ")
+}
+
+// topicURL returns the url path of a topic page.
+func topicURL(name string) string {
+	return topicPrefix + url.PathEscape(name)
+}
+
+// resolveTopic converts a topic name into its canonical form and follows any
+// aliases, returning the name of the topic that the name refers to.
+func resolveTopic(tx *bolt.Tx, name string) (string, error) {
+	name = canonicalTopicName(name)
+	ba := tx.Bucket(bucketAliases)
+	for i := 0; i < maxAliasDepth; i++ {
+		target := ba.Get([]byte(name))
+		if target == nil {
+			return name, nil
+		}
+		name = string(target)
+	}
+	return "", errAliasLoop
+}
+
+// putAlias makes the alias refer to the target topic. The alias cannot be the
+// name of an existing topic.
+func putAlias(tx *bolt.Tx, alias, target string) error {
+	alias = canonicalTopicName(alias)
+	if alias == "" {
+		return errInvalidTopicName
+	}
+	target, err := resolveTopic(tx, target)
+	if err != nil {
+		return err
+	}
+	if alias == target {
+		return errAliasLoop
+	}
+	_, exists, err := getTopic(tx, alias)
+	if err != nil {
+		return err
+	}
+	if exists {
+		return errAliasIsTopic
+	}
+	_, exists, err = getTopic(tx, target)
+	if err != nil {
+		return err
+	}
+	if !exists {
+		return errMissingTopic
+	}
+	return tx.Bucket(bucketAliases).Put([]byte(alias), []byte(target))
+}
+
+// moveRevisions moves the revision history of a topic to a new name. A topic
+// that already has a history keeps its own, the same way that merging keeps
+// the history of each topic.
+func moveRevisions(tx *bolt.Tx, from, to string) error {
+	br := tx.Bucket(bucketRevisions)
+	src := br.Bucket([]byte(from))
+	if src == nil || br.Bucket([]byte(to)) != nil {
+		return nil
+	}
+	dst, err := br.CreateBucket([]byte(to))
+	if err != nil {
+		return err
+	}
+	err = src.ForEach(func(k, v []byte) error {
+		return dst.Put(append([]byte(nil), k...), append([]byte(nil), v...))
+	})
+	if err != nil {
+		return err
+	}
+	err = dst.SetSequence(src.Sequence())
+	if err != nil {
+		return err
+	}
+	return br.DeleteBucket([]byte(from))
+}
+
+// migrateTopicNames moves every topic stored under a name that is not
+// canonical onto its canonical name, along with the relations, aliases,
+// votes, flags, and revision history that refer to it. Topics whose names
+// collapse onto the same canonical name are combined the same way that
+// merging combines them. Nothing is done once every topic has a canonical
+// name.
+func migrateTopicNames(tx *bolt.Tx) error {
+	// canonical returns the canonical form of a name, keeping names that
+	// have no canonical form as they are.
+	canonical := func(name string) string {
+		if c := canonicalTopicName(name); c != "" {
+			return c
+		}
+		return name
+	}
+
+	bt := tx.Bucket(bucketTopics)
+	var legacy []string
+	err := bt.ForEach(func(k, v []byte) error {
+		if canonical(string(k)) != string(k) {
+			legacy = append(legacy, string(k))
+		}
+		return nil
+	})
+	if err != nil || len(legacy) == 0 {
+		return err
+	}
+
+	// Move each topic onto its canonical name, combining it with any topic
+	// that is already there.
+	for _, name := range legacy {
+		to := canonical(name)
+		fromTD, _, err := getTopic(tx, name)
+		if err != nil {
+			return err
+		}
+		intoTD, exists, err := getTopic(tx, to)
+		if err != nil {
+			return err
+		}
+		if !exists {
+			intoTD = fromTD
+		} else {
+			for _, mr := range fromTD.AssociatedMedia {
+				i := mediaIndex(intoTD.AssociatedMedia, mr.Hash)
+				if i < 0 {
+					intoTD.AssociatedMedia = append(intoTD.AssociatedMedia, mr)
+					continue
+				}
+				combineMedia(&intoTD.AssociatedMedia[i], mr)
+			}
+			intoTD.RelatedTopics = append(intoTD.RelatedTopics, fromTD.RelatedTopics...)
+			if intoTD.Description == "" {
+				intoTD.Description = fromTD.Description
+			}
+		}
+		err = putTopicData(tx, to, intoTD)
+		if err != nil {
+			return err
+		}
+		err = bt.Delete([]byte(name))
+		if err != nil {
+			return err
+		}
+		err = removeSearchDocument(tx, itemKindTopic, name)
+		if err != nil {
+			return err
+		}
+		err = moveRevisions(tx, name, to)
+		if err != nil {
+			return err
+		}
+	}
+
+	// Point every relation at a canonical name, combining relations that
+	// now lead to the same topic and dropping relations that now lead back
+	// to their own topic or the other way along another relation, then
+	// rebuild the search documents of the topics.
+	related := make(map[[2]string]bool)
+	dropped := make(map[[2]string]bool)
+	var names []string
+	err = bt.ForEach(func(k, v []byte) error {
+		names = append(names, string(k))
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	for _, name := range names {
+		td, _, err := getTopic(tx, name)
+		if err != nil {
+			return err
+		}
+		var relations []topicRelation
+		for _, tr := range td.RelatedTopics {
+			tr.Title = canonical(tr.Title)
+			if i := topicIndex(relations, tr.Title); i >= 0 {
+				combineTopics(&relations[i], tr)
+				continue
+			}
+			if tr.Title == name || related[[2]string{tr.Title, name}] {
+				dropped[[2]string{name, tr.Title}] = true
+				continue
+			}
+			related[[2]string{name, tr.Title}] = true
+			relations = append(relations, tr)
+		}
+		td.RelatedTopics = relations
+		err = putTopicData(tx, name, td)
+		if err != nil {
+			return err
+		}
+		err = indexTopic(tx, name, td)
+		if err != nil {
+			return err
+		}
+	}
+
+	// Rebuild the backlinks from the updated relations.
+	err = tx.DeleteBucket(bucketBacklinks)
+	if err != nil {
+		return err
+	}
+	_, err = tx.CreateBucket(bucketBacklinks)
+	if err != nil {
+		return err
+	}
+	err = indexAllRelations(tx)
+	if err != nil {
+		return err
+	}
+
+	// Rekey the aliases. Aliases that now share their name with a topic or
+	// point at themselves are dropped.
+	ba := tx.Bucket(bucketAliases)
+	aliases := make(map[string]string)
+	err = ba.ForEach(func(k, v []byte) error {
+		aliases[string(k)] = string(v)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	for alias := range aliases {
+		err = ba.Delete([]byte(alias))
+		if err != nil {
+			return err
+		}
+	}
+	for alias, target := range aliases {
+		alias, target = canonical(alias), canonical(target)
+		if alias == target || bt.Get([]byte(alias)) != nil {
+			continue
+		}
+		err = ba.Put([]byte(alias), []byte(target))
+		if err != nil {
+			return err
+		}
+	}
+
+	// Move the votes and flags onto the canonical names.
+	relocate := func(kind, page, item string) (string, string, bool) {
+		page = canonical(page)
+		if kind == itemKindTopic {
+			item = canonical(item)
+			if dropped[[2]string{page, item}] {
+				return "", "", false
+			}
+		}
+		return page, item, true
+	}
+	err = relocateVotes(tx, "", relocate)
+	if err != nil {
+		return err
+	}
+	return relocateFlags(tx, relocate)
+}
+
+// redirectToCanonical sends the user to the canonical url of a topic if the
+// requested name is not canonical or is an alias. The prefix is the page that
+// the topic is being viewed under, such as topicPrefix. The subpage, such as
+// "/history", and the query string are kept. It returns true if a redirect
+// was written.
+func (h *herus) redirectToCanonical(w http.ResponseWriter, r *http.Request, prefix, name, subpage string) (bool, error) {
+	var resolved string
+	err := h.db.View(func(tx *bolt.Tx) error {
+		var err error
+		resolved, err = resolveTopic(tx, name)
+		return err
+	})
+	if err != nil {
+		return false, err
+	}
+	if resolved == name {
+		return false, nil
+	}
+	target := prefix + url.PathEscape(resolved) + subpage
+	if r.URL.RawQuery != "" {
+		target += "?" + r.URL.RawQuery
+	}
+	http.Redirect(w, r, target, http.StatusMovedPermanently)
+	return true, nil
+}
+
+// executeAliasBody builds the body portion of the alias page.
+func executeAliasBody(w io.Writer, atd aliasTemplateData) error {
+	t, err := template.ParseFiles(aliasTpl)
+	if err != nil {
+		return err
+	}
+	return t.Execute(w, atd)
+}
+
+// aliasHandler handles requests to add an alias for a topic.
+func (h *herus) aliasHandler(w http.ResponseWriter, r *http.Request) {
+	atd := aliasTemplateData{
+		Topic:       r.URL.Query().Get("topic"),
+		TopicPrefix: topicPrefix,
+	}
+	if r.Method == "POST" {
+		atd.Alias = r.FormValue("alias")
+		atd.Topic = r.FormValue("topic")
+		err := h.db.Update(func(tx *bolt.Tx) error {
+			err := putAlias(tx, atd.Alias, atd.Topic)
+			if err != nil {
+				return err
+			}
+			// Show the names that the alias was stored under.
+			atd.Alias = canonicalTopicName(atd.Alias)
+			atd.Topic, err = resolveTopic(tx, atd.Topic)
+			return err
+		})
+		if err != nil {
+			atd.ErrorExists = true
+			atd.Error = err.Error()
+		} else {
+			atd.PostWithoutError = true
+		}
+	}
+
+	err := executeHeader(w, HeaderTemplateData{Title: aliasTitle})
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	err = executeAliasBody(w, atd)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	err = executeFooter(w)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+}
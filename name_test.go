@@ -0,0 +1,153 @@
+package main
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/boltdb/bolt"
+)
+
+// TestCanonicalTopicName checks the canonical forms of topic names.
+func TestCanonicalTopicName(t *testing.T) {
+	tests := map[string]string{
+		"Linear Algebra":      "linear_algebra",
+		"  linear   algebra ": "linear_algebra",
+		"linear_algebra":      "linear_algebra",
+		"C++ / Templates":     "c++_templates",
+		"Ｆｕｌｌ Width":          "full_width",
+		"?!":                  "",
+	}
+	for name, want := range tests {
+		if got := canonicalTopicName(name); got != want {
+			t.Errorf("canonicalTopicName(%q) = %q, want %q", name, got, want)
+		}
+	}
+}
+
+// TestMigrateTopicNames checks that topics stored under names from before
+// canonical names are moved onto their canonical names, along with everything
+// that refers to them.
+func TestMigrateTopicNames(t *testing.T) {
+	db := newTestDB(t)
+	err := db.Update(func(tx *bolt.Tx) error {
+		topics := map[string]topicData{
+			"Calculus": {
+				AssociatedMedia: []mediaRelation{{Hash: "m1", Upvotes: 1}},
+				RelatedTopics:   []topicRelation{{Title: "Linear Algebra", Upvotes: 1}},
+			},
+			"Linear Algebra": {
+				AssociatedMedia: []mediaRelation{{Hash: "m2", Upvotes: 2}},
+				RelatedTopics:   []topicRelation{{Title: "calculus", Upvotes: 1}},
+			},
+			"linear_algebra": {
+				AssociatedMedia: []mediaRelation{{Hash: "m2", Upvotes: 3}},
+			},
+		}
+		for name, td := range topics {
+			err := putTopicData(tx, name, td)
+			if err != nil {
+				return err
+			}
+		}
+		vote, err := json.Marshal(userVote{Value: voteUp})
+		if err != nil {
+			return err
+		}
+		bv := tx.Bucket(bucketVotes)
+		err = bv.Put(voteKey("alice", itemKindMedia, "Calculus", "m1"), vote)
+		if err != nil {
+			return err
+		}
+		err = bv.Put(voteKey("alice", itemKindTopic, "Calculus", "Linear Algebra"), vote)
+		if err != nil {
+			return err
+		}
+		err = bv.Put(voteKey("alice", itemKindTopic, "Linear Algebra", "calculus"), vote)
+		if err != nil {
+			return err
+		}
+		revisions, err := tx.Bucket(bucketRevisions).CreateBucket([]byte("Calculus"))
+		if err != nil {
+			return err
+		}
+		err = revisions.Put(revisionKey(1), []byte("{}"))
+		if err != nil {
+			return err
+		}
+		return tx.Bucket(bucketAliases).Put([]byte("Calc"), []byte("Calculus"))
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Migrating twice must be the same as migrating once.
+	for i := 0; i < 2; i++ {
+		err = db.Update(migrateTopicNames)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	err = db.View(func(tx *bolt.Tx) error {
+		var names []string
+		err := tx.Bucket(bucketTopics).ForEach(func(k, v []byte) error {
+			names = append(names, string(k))
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		if len(names) != 2 || names[0] != "calculus" || names[1] != "linear_algebra" {
+			t.Errorf("topics are %v, want [calculus linear_algebra]", names)
+		}
+
+		calculus, _, err := getTopic(tx, "calculus")
+		if err != nil {
+			return err
+		}
+		if len(calculus.RelatedTopics) != 1 || calculus.RelatedTopics[0].Title != "linear_algebra" {
+			t.Errorf("relations of calculus are %v, want one to linear_algebra", calculus.RelatedTopics)
+		}
+		linear, _, err := getTopic(tx, "linear_algebra")
+		if err != nil {
+			return err
+		}
+		if len(linear.AssociatedMedia) != 1 || linear.AssociatedMedia[0].Upvotes != 5 {
+			t.Errorf("media of linear_algebra are %v, want m2 with 5 upvotes", linear.AssociatedMedia)
+		}
+		if len(linear.RelatedTopics) != 0 {
+			t.Errorf("relations of linear_algebra are %v, want none because calculus already leads to it", linear.RelatedTopics)
+		}
+
+		bv := tx.Bucket(bucketVotes)
+		if bv.Get(voteKey("alice", itemKindMedia, "calculus", "m1")) == nil {
+			t.Error("media vote was not moved to the canonical topic")
+		}
+		if bv.Get(voteKey("alice", itemKindTopic, "calculus", "linear_algebra")) == nil {
+			t.Error("relation vote was not moved to the canonical topics")
+		}
+		if bv.Get(voteKey("alice", itemKindMedia, "Calculus", "m1")) != nil {
+			t.Error("media vote is still stored under the old topic name")
+		}
+		if bv.Get(voteKey("alice", itemKindTopic, "linear_algebra", "calculus")) != nil || bv.Get(voteKey("alice", itemKindTopic, "Linear Algebra", "calculus")) != nil {
+			t.Error("vote on a dropped relation was kept")
+		}
+		if !hasRelation(tx, "calculus", "linear_algebra") {
+			t.Error("backlink of the relation was not rebuilt")
+		}
+		if tx.Bucket(bucketRevisions).Bucket([]byte("calculus")) == nil || tx.Bucket(bucketRevisions).Bucket([]byte("Calculus")) != nil {
+			t.Error("revision history was not moved to the canonical topic")
+		}
+		resolved, err := resolveTopic(tx, "Calc")
+		if err != nil {
+			return err
+		}
+		if resolved != "calculus" {
+			t.Errorf("alias resolves to %q, want calculus", resolved)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,239 @@
+package main
+
+// path.go produces the learning path pages. The learning path of a topic is
+// every topic that has to be studied before it, following prerequisite-of
+// relations backwards from the topic, put in an order where each topic comes
+// after all of its own prerequisites.
+//
+// The order is a topological sort, built from a depth first search over the
+// prerequisite graph. Prerequisite relations are submitted by users, so the
+// graph can contain cycles. Any cycle that is found is reported on the page,
+// and the relation that closes the cycle is ignored so that a path can still
+// be produced.
+
+import (
+	"bytes"
+	"html/template"
+	"io"
+	"net/http"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/boltdb/bolt"
+)
+
+const (
+	pathPrefix = "/path/"
+
+	pathTitle = "Learning Path"
+
+	// pathMediaCount is the number of media recommended for each step of a
+	// learning path.
+	pathMediaCount = 3
+)
+
+var (
+	pathTpl = filepath.Join(dirTemplates, "path.tpl")
+)
+
+// pathStep is a single topic in a learning path, along with the media that
+// is recommended for studying it.
+type pathStep struct {
+	Name  string
+	Title string
+
+	Media []mediaRelation
+}
+
+// pathTemplateData defines the data which is used to fill out the path
+// template file.
+type pathTemplateData struct {
+	ElaborationPrefix string
+	Name              string
+	Title             string
+	TopicPrefix       string
+
+	Cycles [][]string
+	Steps  []pathStep
+}
+
+// prerequisitesOf returns the names of the topics that are a visible
+// prerequisite of the provided topic, sorted by name.
+func prerequisitesOf(tx *bolt.Tx, topic string) ([]string, error) {
+	var prerequisites []string
+	prefix := backlinkKey(topic, "")
+	c := tx.Bucket(bucketBacklinks).Cursor()
+	for k, v := c.Seek(prefix); k != nil && bytes.HasPrefix(k, prefix); k, v = c.Next() {
+		if string(v) != relationPrerequisite {
+			continue
+		}
+		source := string(k[len(prefix):])
+		td, exists, err := getTopic(tx, source)
+		if err != nil {
+			return nil, err
+		}
+		if !exists {
+			continue
+		}
+		i := topicIndex(td.RelatedTopics, topic)
+		if i < 0 || td.RelatedTopics[i].Hidden {
+			continue
+		}
+		prerequisites = append(prerequisites, source)
+	}
+	sort.Strings(prerequisites)
+	return prerequisites, nil
+}
+
+// learningPath returns the topics that lead up to the provided topic in the
+// order that they should be studied, ending with the topic itself. Any cycles
+// found among the prerequisites are returned as well, each as the list of
+// topics that make up the cycle.
+func learningPath(tx *bolt.Tx, topic string) (order []string, cycles [][]string, err error) {
+	const (
+		unvisited = iota
+		visiting
+		visited
+	)
+	state := make(map[string]int)
+	var stack []string
+
+	var visit func(name string) error
+	visit = func(name string) error {
+		state[name] = visiting
+		stack = append(stack, name)
+		prerequisites, err := prerequisitesOf(tx, name)
+		if err != nil {
+			return err
+		}
+		for _, p := range prerequisites {
+			switch state[p] {
+			case unvisited:
+				err = visit(p)
+				if err != nil {
+					return err
+				}
+			case visiting:
+				// p is further up the stack, so the relation from p to
+				// name closes a cycle. The cycle is listed in study order,
+				// with each topic being a prerequisite of the next.
+				var cycle []string
+				for i := len(stack) - 1; i >= 0; i-- {
+					cycle = append(cycle, stack[i])
+					if stack[i] == p {
+						break
+					}
+				}
+				cycles = append(cycles, append(cycle, name))
+			}
+		}
+		stack = stack[:len(stack)-1]
+		state[name] = visited
+		order = append(order, name)
+		return nil
+	}
+	err = visit(topic)
+	if err != nil {
+		return nil, nil, err
+	}
+	return order, cycles, nil
+}
+
+// pathSteps builds the steps of a learning path, recommending the top voted
+// visible media of each topic.
+func pathSteps(tx *bolt.Tx, order []string) ([]pathStep, error) {
+	var steps []pathStep
+	for _, name := range order {
+		td, _, err := getTopic(tx, name)
+		if err != nil {
+			return nil, err
+		}
+		step := pathStep{
+			Name:  name,
+			Title: td.Title,
+		}
+		if step.Title == "" {
+			step.Title = topicTitleFromName(name)
+		}
+		media := visibleMedia(td.AssociatedMedia)
+		rankMedia(media, sortTop)
+		if len(media) > pathMediaCount {
+			media = media[:pathMediaCount]
+		}
+		step.Media = media
+		steps = append(steps, step)
+	}
+	return steps, nil
+}
+
+// executePathBody builds the body portion of the path page.
+func executePathBody(w io.Writer, ptd pathTemplateData) error {
+	t, err := template.ParseFiles(pathTpl)
+	if err != nil {
+		return err
+	}
+	return t.Execute(w, ptd)
+}
+
+// pathHandler handles requests for the learning path of a topic.
+func (h *herus) pathHandler(w http.ResponseWriter, r *http.Request) {
+	topicName := strings.TrimPrefix(r.URL.Path, pathPrefix)
+	redirected, err := h.redirectToCanonical(w, r, pathPrefix, topicName, "")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if redirected {
+		return
+	}
+
+	ptd := pathTemplateData{
+		ElaborationPrefix: elaborationPrefix,
+		Name:              topicName,
+		TopicPrefix:       topicPrefix,
+	}
+	var exists bool
+	err = h.db.View(func(tx *bolt.Tx) error {
+		var td topicData
+		td, exists, err = getTopic(tx, topicName)
+		if err != nil || !exists {
+			return err
+		}
+		ptd.Title = td.Title
+		if ptd.Title == "" {
+			ptd.Title = topicTitleFromName(topicName)
+		}
+		order, cycles, err := learningPath(tx, topicName)
+		if err != nil {
+			return err
+		}
+		ptd.Cycles = cycles
+		ptd.Steps, err = pathSteps(tx, order)
+		return err
+	})
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if !exists {
+		rootHandler(w, r)
+		return
+	}
+
+	err = executeHeader(w, HeaderTemplateData{Title: pathTitle + ": " + ptd.Title})
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	err = executePathBody(w, ptd)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	err = executeFooter(w)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+}
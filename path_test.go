@@ -0,0 +1,89 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/boltdb/bolt"
+)
+
+// putPrerequisites stores topics whose relations are all prerequisite-of
+// relations, keyed by the name of the prerequisite.
+func putPrerequisites(t *testing.T, db *bolt.DB, leadsTo map[string][]string) {
+	t.Helper()
+	err := db.Update(func(tx *bolt.Tx) error {
+		for name, destinations := range leadsTo {
+			var td topicData
+			for _, destination := range destinations {
+				td.RelatedTopics = append(td.RelatedTopics, topicRelation{Title: destination, Type: relationPrerequisite})
+			}
+			err := putTopic(tx, name, td, "admin")
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+// TestLearningPathOrder checks that every topic of a learning path comes
+// after all of its prerequisites.
+func TestLearningPathOrder(t *testing.T) {
+	db := newTestDB(t)
+	putPrerequisites(t, db, map[string][]string{
+		"arithmetic": {"algebra", "calculus"},
+		"algebra":    {"calculus", "linear_algebra"},
+		"limits":     {"calculus"},
+		"calculus":   {"physics"},
+		"physics":    nil,
+	})
+	err := db.View(func(tx *bolt.Tx) error {
+		order, cycles, err := learningPath(tx, "calculus")
+		if err != nil {
+			return err
+		}
+		want := []string{"arithmetic", "algebra", "limits", "calculus"}
+		if !reflect.DeepEqual(order, want) {
+			t.Errorf("order is %v, want %v", order, want)
+		}
+		if len(cycles) != 0 {
+			t.Errorf("found cycles %v in a graph without any", cycles)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+// TestLearningPathCycle checks that a cycle of prerequisites is reported and
+// that a path is still produced around it.
+func TestLearningPathCycle(t *testing.T) {
+	db := newTestDB(t)
+	putPrerequisites(t, db, map[string][]string{
+		"chicken":  {"egg"},
+		"egg":      {"chicken", "omelette"},
+		"omelette": nil,
+	})
+	err := db.View(func(tx *bolt.Tx) error {
+		order, cycles, err := learningPath(tx, "omelette")
+		if err != nil {
+			return err
+		}
+		want := []string{"chicken", "egg", "omelette"}
+		if !reflect.DeepEqual(order, want) {
+			t.Errorf("order is %v, want %v", order, want)
+		}
+		wantCycles := [][]string{{"chicken", "egg", "chicken"}}
+		if !reflect.DeepEqual(cycles, wantCycles) {
+			t.Errorf("cycles are %v, want %v", cycles, wantCycles)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,294 @@
+package main
+
+// preview.go builds the viewer that the elaboration page shows for a piece of
+// media. Images, audio, and video are shown with the matching html element,
+// pdfs are embedded, and text is shown inline. Text uploads whose title ends
+// in a markdown extension are rendered as markdown, and text uploads whose
+// title ends in the extension of a known programming language are shown with
+// simple syntax highlighting. Html is never shown as a page; its extracted
+// text is shown instead.
+
+import (
+	"fmt"
+	"html/template"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+const (
+	previewAudio    = "audio"
+	previewCode     = "code"
+	previewImage    = "image"
+	previewMarkdown = "markdown"
+	previewNone     = ""
+	previewPDF      = "pdf"
+	previewText     = "text"
+	previewVideo    = "video"
+
+	// maxPreviewTextLen limits how much of a text upload is shown on the
+	// elaboration page.
+	maxPreviewTextLen = 256 << 10 // 256 KB
+)
+
+// codeLanguage describes enough of a programming language to highlight it.
+type codeLanguage struct {
+	Name          string
+	LineComments  []string
+	BlockComments [][2]string
+	Keywords      map[string]bool
+}
+
+// keywordSet builds a set of keywords from a space separated list.
+func keywordSet(keywords string) map[string]bool {
+	set := make(map[string]bool)
+	for _, k := range strings.Fields(keywords) {
+		set[k] = true
+	}
+	return set
+}
+
+var (
+	// markdownExtensions lists the title extensions of text uploads that are
+	// rendered as markdown.
+	markdownExtensions = map[string]bool{
+		".markdown": true,
+		".md":       true,
+	}
+
+	cComments    = [][2]string{{"/*", "*/"}}
+	cKeywords    = "auto break case char const continue default do double else enum extern float for goto if inline int long register return short signed sizeof static struct switch typedef union unsigned void volatile while"
+	shellKeyword = "case do done elif else esac export fi for function if in local return then until while"
+
+	// codeLanguages maps the title extensions of text uploads to the
+	// language that they are highlighted as.
+	codeLanguages = map[string]codeLanguage{
+		".c":    {"C", []string{"//"}, cComments, keywordSet(cKeywords)},
+		".cpp":  {"C++", []string{"//"}, cComments, keywordSet(cKeywords + " bool catch class delete false namespace new nullptr private protected public template this throw true try using virtual")},
+		".go":   {"Go", []string{"//"}, cComments, keywordSet("break case chan const continue default defer else fallthrough false for func go goto if import interface map nil package range return select struct switch true type var")},
+		".h":    {"C", []string{"//"}, cComments, keywordSet(cKeywords)},
+		".java": {"Java", []string{"//"}, cComments, keywordSet("abstract boolean break byte case catch char class continue default do double else enum extends false final finally float for if implements import instanceof int interface long new null package private protected public return short static super switch this throw throws true try void while")},
+		".js":   {"JavaScript", []string{"//"}, cComments, keywordSet("async await break case catch class const continue default delete do else export extends false finally for function if import in instanceof let new null return super switch this throw true try typeof undefined var void while yield")},
+		".py":   {"Python", []string{"#"}, nil, keywordSet("and as assert async await break class continue def del elif else except False finally for from global if import in is lambda None nonlocal not or pass raise return True try while with yield")},
+		".rb":   {"Ruby", []string{"#"}, nil, keywordSet("begin break case class def do else elsif end ensure false for if in module next nil not or redo rescue retry return self super then true unless until when while yield")},
+		".rs":   {"Rust", []string{"//"}, cComments, keywordSet("as break const continue crate else enum extern false fn for if impl in let loop match mod move mut pub ref return self Self static struct super trait true type unsafe use where while")},
+		".sh":   {"Shell", []string{"#"}, nil, keywordSet(shellKeyword)},
+		".sql":  {"SQL", []string{"--"}, cComments, keywordSet("and as by create delete drop from group having in index insert into join key left not null on or order primary select set table update values where AND AS BY CREATE DELETE DROP FROM GROUP HAVING IN INDEX INSERT INTO JOIN KEY LEFT NOT NULL ON OR ORDER PRIMARY SELECT SET TABLE UPDATE VALUES WHERE")},
+		".ts":   {"TypeScript", []string{"//"}, cComments, keywordSet("async await break case catch class const continue default do else enum export extends false finally for function if implements import in interface let new null private public return super switch this throw true try type typeof undefined var void while")},
+	}
+)
+
+// mediaPreview describes how a piece of media is shown on its elaboration
+// page. Only the fields for the kind of the preview are filled out.
+type mediaPreview struct {
+	Kind        string
+	ContentType string
+	Size        int64
+
+	Code      template.HTML
+	Language  string
+	Markdown  template.HTML
+	Text      string
+	Truncated bool
+}
+
+// SizeText returns the size of the media in a readable form.
+func (mp mediaPreview) SizeText() string {
+	return formatSize(mp.Size)
+}
+
+// formatSize returns a number of bytes in a readable form.
+func formatSize(n int64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%d B", n)
+	}
+	div, exp := int64(unit), 0
+	for m := n / unit; m >= unit; m /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %cB", float64(n)/float64(div), "KMGTPE"[exp])
+}
+
+// titleExtension returns the lowercase extension at the end of a title.
+func titleExtension(title string) string {
+	return strings.ToLower(filepath.Ext(strings.TrimSpace(title)))
+}
+
+// readPreviewText reads the start of a text upload. truncated is true if the
+// upload is longer than what was read.
+func readPreviewText(path string) (text string, truncated bool, err error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", false, err
+	}
+	defer f.Close()
+	data := make([]byte, maxPreviewTextLen+1)
+	n, err := io.ReadFull(f, data)
+	if err != nil && err != io.ErrUnexpectedEOF && err != io.EOF {
+		return "", false, err
+	}
+	if n > maxPreviewTextLen {
+		n = maxPreviewTextLen
+		truncated = true
+	}
+	return strings.ToValidUTF8(string(data[:n]), "�"), truncated, nil
+}
+
+// buildMediaPreview works out how to show a piece of media.
+func buildMediaPreview(hash string, mm mediaMetadata) (mediaPreview, error) {
+	path := filepath.Join(dirMedia, hash)
+	info, err := os.Stat(path)
+	if err != nil {
+		return mediaPreview{}, err
+	}
+	contentType, err := mediaContentType(mm, path)
+	if err != nil {
+		return mediaPreview{}, err
+	}
+	mp := mediaPreview{
+		ContentType: contentType,
+		Size:        info.Size(),
+	}
+
+	mediaType := baseMediaType(contentType)
+	switch {
+	case mediaType == "application/pdf":
+		mp.Kind = previewPDF
+	case mediaType == "application/ogg":
+		mp.Kind = previewAudio
+	case strings.HasPrefix(mediaType, "audio/") && inlineMediaTypes[mediaType]:
+		mp.Kind = previewAudio
+	case strings.HasPrefix(mediaType, "image/") && inlineMediaTypes[mediaType]:
+		mp.Kind = previewImage
+	case strings.HasPrefix(mediaType, "video/") && inlineMediaTypes[mediaType]:
+		mp.Kind = previewVideo
+	case mediaType == "text/html" && mm.TextStatus == textReady:
+		mp.Kind = previewText
+		mp.Text, mp.Truncated, err = readPreviewText(derivedPath(hash, textFile))
+		if err != nil {
+			return mediaPreview{}, err
+		}
+	case mediaType == "text/plain":
+		mp.Text, mp.Truncated, err = readPreviewText(path)
+		if err != nil {
+			return mediaPreview{}, err
+		}
+		ext := titleExtension(mm.Title)
+		if lang, ok := codeLanguages[ext]; ok {
+			mp.Kind = previewCode
+			mp.Language = lang.Name
+			mp.Code = highlightCode(mp.Text, lang)
+		} else if markdownExtensions[ext] {
+			mp.Kind = previewMarkdown
+			mp.Markdown = renderMarkdown(mp.Text)
+		} else {
+			mp.Kind = previewText
+		}
+	default:
+		mp.Kind = previewNone
+	}
+	return mp, nil
+}
+
+// highlightCode escapes source code for an html page and wraps its comments,
+// strings, numbers, and keywords in spans that the stylesheet colors. The
+// highlighting is done a token at a time without parsing, which is good enough
+// to make code readable.
+func highlightCode(code string, lang codeLanguage) template.HTML {
+	var b strings.Builder
+	span := func(class, text string) {
+		b.WriteString("<span class='hl-" + class + "'>")
+		b.WriteString(template.HTMLEscapeString(text))
+		b.WriteString("</span>")
+	}
+
+	for i := 0; i < len(code); {
+		rest := code[i:]
+
+		// Comments.
+		matched := false
+		for _, bc := range lang.BlockComments {
+			if strings.HasPrefix(rest, bc[0]) {
+				end := strings.Index(rest[len(bc[0]):], bc[1])
+				n := len(rest)
+				if end >= 0 {
+					n = len(bc[0]) + end + len(bc[1])
+				}
+				span("comment", rest[:n])
+				i += n
+				matched = true
+				break
+			}
+		}
+		for _, lc := range lang.LineComments {
+			if !matched && strings.HasPrefix(rest, lc) {
+				n := strings.IndexByte(rest, '\n')
+				if n < 0 {
+					n = len(rest)
+				}
+				span("comment", rest[:n])
+				i += n
+				matched = true
+			}
+		}
+		if matched {
+			continue
+		}
+
+		c, size := utf8.DecodeRuneInString(rest)
+		switch {
+		case c == '"' || c == '\'' || c == '`':
+			// Strings run to the matching quote, skipping escaped
+			// characters. Only backquoted strings may span lines.
+			n := 1
+			for n < len(rest) && rest[n] != byte(c) && (c == '`' || rest[n] != '\n') {
+				if rest[n] == '\\' && c != '`' && n+1 < len(rest) {
+					n++
+				}
+				n++
+			}
+			if n < len(rest) && rest[n] == byte(c) {
+				n++
+			}
+			span("string", rest[:n])
+			i += n
+		case unicode.IsDigit(c):
+			// Numbers take in the letters of suffixes and hex digits, and
+			// their digits need not be ascii.
+			n := 0
+			for n < len(rest) {
+				r, s := utf8.DecodeRuneInString(rest[n:])
+				if !unicode.IsLetter(r) && !unicode.IsDigit(r) && r != '_' && r != '.' {
+					break
+				}
+				n += s
+			}
+			span("number", rest[:n])
+			i += n
+		case unicode.IsLetter(c) || c == '_':
+			n := 0
+			for n < len(rest) {
+				r, s := utf8.DecodeRuneInString(rest[n:])
+				if !unicode.IsLetter(r) && !unicode.IsDigit(r) && r != '_' {
+					break
+				}
+				n += s
+			}
+			if lang.Keywords[rest[:n]] {
+				span("keyword", rest[:n])
+			} else {
+				b.WriteString(template.HTMLEscapeString(rest[:n]))
+			}
+			i += n
+		default:
+			b.WriteString(template.HTMLEscapeString(rest[:size]))
+			i += size
+		}
+	}
+	return template.HTML(b.String())
+}
@@ -0,0 +1,40 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+// TestHighlightCode checks the spans that code is highlighted with,
+// including numbers and identifiers that are not ascii.
+func TestHighlightCode(t *testing.T) {
+	tests := []struct {
+		code string
+		want string
+	}{
+		{"x = 42", "x = <span class='hl-number'>42</span>"},
+		{"x = 0x1f + 1.5e3", "x = <span class='hl-number'>0x1f</span> + <span class='hl-number'>1.5e3</span>"},
+		{"x = ٣\n", "x = <span class='hl-number'>٣</span>\n"},
+		{"y = ١٢٣.٤٥", "y = <span class='hl-number'>١٢٣.٤٥</span>"},
+		{"z = ３２", "z = <span class='hl-number'>３２</span>"},
+		{"café = naïve", "café = naïve"},
+		{"π2 = ٣π", "π2 = <span class='hl-number'>٣π</span>"},
+		{"if 变量: pass", "<span class='hl-keyword'>if</span> 变量: <span class='hl-keyword'>pass</span>"},
+		{"s = 'ü' # ünïcode", "s = <span class='hl-string'>&#39;ü&#39;</span> <span class='hl-comment'># ünïcode</span>"},
+		{"x = \xff1", "x = \xff<span class='hl-number'>1</span>"},
+	}
+	for _, test := range tests {
+		done := make(chan string, 1)
+		go func() {
+			done <- string(highlightCode(test.code, codeLanguages[".py"]))
+		}()
+		select {
+		case got := <-done:
+			if got != test.want {
+				t.Errorf("highlightCode(%q) =\n%q\nwant\n%q", test.code, got, test.want)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("highlightCode(%q) did not finish", test.code)
+		}
+	}
+}
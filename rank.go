@@ -0,0 +1,112 @@
+package main
+
+// rank.go orders the media, related topics, and elaborations on a page using
+// the votes that they have received.
+
+import (
+	"math"
+	"sort"
+	"time"
+)
+
+const (
+	sortControversial = "controversial"
+	sortNew           = "new"
+	sortTop           = "top"
+
+	// rankHalfLife is the age at which the score of an item under the top
+	// ordering has been reduced by half.
+	rankHalfLife = 90 * 24 * time.Hour
+
+	// wilsonZ is the z-score used for the Wilson score interval, giving a 95%
+	// confidence that the true fraction of upvotes is above the lower bound.
+	wilsonZ = 1.96
+)
+
+// rankInfo contains the information about an item that is used to rank it.
+type rankInfo struct {
+	Upvotes        uint64
+	Downvotes      uint64
+	SubmissionDate time.Time
+}
+
+// parseSortMode returns the ordering requested in the sort query parameter,
+// defaulting to the top ordering.
+func parseSortMode(mode string) string {
+	switch mode {
+	case sortControversial, sortNew:
+		return mode
+	}
+	return sortTop
+}
+
+// wilsonLowerBound returns the lower bound of the Wilson score interval for
+// the fraction of votes that are upvotes.
+func wilsonLowerBound(up, down uint64) float64 {
+	n := float64(up + down)
+	if n == 0 {
+		return 0
+	}
+	p := float64(up) / n
+	z2 := wilsonZ * wilsonZ
+	return (p + z2/(2*n) - wilsonZ*math.Sqrt((p*(1-p)+z2/(4*n))/n)) / (1 + z2/n)
+}
+
+// rankScore returns the score of an item under an ordering. Items with higher
+// scores are displayed first.
+func rankScore(mode string, ri rankInfo, now time.Time) float64 {
+	switch mode {
+	case sortNew:
+		return float64(ri.SubmissionDate.UnixNano())
+	case sortControversial:
+		// Controversial items have many votes that are split evenly
+		// between upvotes and downvotes.
+		if ri.Upvotes == 0 || ri.Downvotes == 0 {
+			return 0
+		}
+		total := float64(ri.Upvotes + ri.Downvotes)
+		balance := math.Min(float64(ri.Upvotes), float64(ri.Downvotes)) / math.Max(float64(ri.Upvotes), float64(ri.Downvotes))
+		return math.Pow(total, balance)
+	}
+
+	// The top ordering decays the Wilson score of an item as it ages, so that
+	// new submissions have a chance to be seen.
+	age := now.Sub(ri.SubmissionDate)
+	if age < 0 {
+		age = 0
+	}
+	decay := math.Pow(0.5, float64(age)/float64(rankHalfLife))
+	return wilsonLowerBound(ri.Upvotes, ri.Downvotes) * decay
+}
+
+// sortRanked sorts a slice of items by their score under an ordering. info
+// returns the rank information of the item currently at index i of the slice.
+func sortRanked(slice interface{}, mode string, info func(i int) rankInfo) {
+	now := time.Now()
+	sort.SliceStable(slice, func(i, j int) bool {
+		return rankScore(mode, info(i), now) > rankScore(mode, info(j), now)
+	})
+}
+
+// rankMedia sorts the media of a topic by their score under an ordering.
+func rankMedia(media []mediaRelation, mode string) {
+	sortRanked(media, mode, func(i int) rankInfo {
+		return rankInfo{media[i].Upvotes, media[i].Downvotes, media[i].SubmissionDate}
+	})
+}
+
+// rankTopics sorts the related topics of a topic by their score under an
+// ordering.
+func rankTopics(topics []relatedTopic, mode string) {
+	sortRanked(topics, mode, func(i int) rankInfo {
+		return rankInfo{topics[i].Upvotes, topics[i].Downvotes, topics[i].SubmissionDate}
+	})
+}
+
+// rankElaborations sorts the elaborations of a piece of media by their score
+// under an ordering.
+func rankElaborations(elaborations []mediaElaboration, mode string) {
+	sortRanked(elaborations, mode, func(i int) rankInfo {
+		return rankInfo{elaborations[i].Upvotes, elaborations[i].Downvotes, elaborations[i].SubmissionDate}
+	})
+}
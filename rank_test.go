@@ -0,0 +1,117 @@
+package main
+
+import (
+	"math"
+	"testing"
+	"time"
+)
+
+// TestWilsonLowerBound checks the Wilson bound against values worked out by
+// hand.
+func TestWilsonLowerBound(t *testing.T) {
+	tests := []struct {
+		up, down uint64
+		want     float64
+	}{
+		{0, 0, 0},
+		{0, 5, 0},
+		{1, 0, 0.2065},
+		{5, 5, 0.2366},
+		{10, 0, 0.7225},
+		{100, 0, 0.9630},
+	}
+	for _, test := range tests {
+		got := wilsonLowerBound(test.up, test.down)
+		if math.Abs(got-test.want) > 1e-4 {
+			t.Errorf("wilsonLowerBound(%v, %v) = %.4f, want %.4f", test.up, test.down, got, test.want)
+		}
+	}
+}
+
+// TestWilsonLowerBoundOrdering checks that more evidence for the same fraction
+// of upvotes ranks higher, and that a better fraction ranks higher.
+func TestWilsonLowerBoundOrdering(t *testing.T) {
+	tests := []struct {
+		higherUp, higherDown uint64
+		lowerUp, lowerDown   uint64
+	}{
+		{10, 0, 1, 0},
+		{60, 40, 6, 4},
+		{9, 1, 5, 5},
+		{1, 0, 0, 0},
+	}
+	for _, test := range tests {
+		higher := wilsonLowerBound(test.higherUp, test.higherDown)
+		lower := wilsonLowerBound(test.lowerUp, test.lowerDown)
+		if higher <= lower {
+			t.Errorf("%v/%v scored %v, which is not above %v/%v at %v", test.higherUp, test.higherDown, higher, test.lowerUp, test.lowerDown, lower)
+		}
+	}
+}
+
+// TestRankScoreDecay checks that the top ordering halves the score of an item
+// every half life and never boosts items from the future.
+func TestRankScoreDecay(t *testing.T) {
+	now := time.Now()
+	fresh := rankScore(sortTop, rankInfo{10, 1, now}, now)
+	old := rankScore(sortTop, rankInfo{10, 1, now.Add(-rankHalfLife)}, now)
+	if math.Abs(old-fresh/2) > 1e-9 {
+		t.Errorf("score after one half life is %v, want %v", old, fresh/2)
+	}
+	future := rankScore(sortTop, rankInfo{10, 1, now.Add(time.Hour)}, now)
+	if future != fresh {
+		t.Errorf("score of an item from the future is %v, want %v", future, fresh)
+	}
+}
+
+// TestRankMedia checks the order of media under each sort mode.
+func TestRankMedia(t *testing.T) {
+	now := time.Now()
+	media := func() []mediaRelation {
+		return []mediaRelation{
+			{Title: "old-popular", Upvotes: 50, Downvotes: 2, SubmissionDate: now.Add(-10 * rankHalfLife)},
+			{Title: "new-decent", Upvotes: 8, Downvotes: 1, SubmissionDate: now.Add(-time.Hour)},
+			{Title: "split", Upvotes: 20, Downvotes: 20, SubmissionDate: now.Add(-2 * time.Hour)},
+			{Title: "newest", Upvotes: 0, Downvotes: 0, SubmissionDate: now},
+		}
+	}
+	tests := []struct {
+		mode string
+		want []string
+	}{
+		{sortTop, []string{"new-decent", "split", "old-popular", "newest"}},
+		{sortNew, []string{"newest", "new-decent", "split", "old-popular"}},
+		{sortControversial, []string{"split", "new-decent", "old-popular", "newest"}},
+	}
+	for _, test := range tests {
+		m := media()
+		rankMedia(m, test.mode)
+		for i, title := range test.want {
+			if m[i].Title != title {
+				var got []string
+				for _, mr := range m {
+					got = append(got, mr.Title)
+				}
+				t.Errorf("%v ordering is %v, want %v", test.mode, got, test.want)
+				break
+			}
+		}
+	}
+}
+
+// TestParseSortMode checks that unknown sort modes fall back to the top
+// ordering.
+func TestParseSortMode(t *testing.T) {
+	tests := map[string]string{
+		"":                sortTop,
+		"bogus":           sortTop,
+		sortTop:           sortTop,
+		sortNew:           sortNew,
+		sortControversial: sortControversial,
+	}
+	for mode, want := range tests {
+		if got := parseSortMode(mode); got != want {
+			t.Errorf("parseSortMode(%q) = %q, want %q", mode, got, want)
+		}
+	}
+}
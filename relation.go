@@ -0,0 +1,196 @@
+package main
+
+// relation.go manages the typed relations between topics.
+//
+// A relation is stored once, on the topic that it was submitted from, and it
+// holds the votes that have been cast on it. So that the topic at the other
+// end of the relation can show it as well, every relation is also recorded in
+// the backlinks bucket under the key [destination][0][source], with the type
+// of the relation as the value. The backlinks are kept up to date by putTopic,
+// which makes them follow every write to a topic, including edits, merges,
+// and reverts.
+//
+// The types are directional. "A prerequisite-of B" puts A under the
+// prerequisites of B, and "A part-of B" puts A under the subtopics of B. The
+// other end of those relations, along with related-to and alternative-to
+// relations in either direction, is shown under "See also".
+
+import (
+	"bytes"
+	"errors"
+
+	"github.com/boltdb/bolt"
+)
+
+const (
+	relationAlternative  = "alternative-to"
+	relationPartOf       = "part-of"
+	relationPrerequisite = "prerequisite-of"
+	relationRelated      = "related-to"
+)
+
+var (
+	errInvalidRelation = errors.New("relation must be prerequisite-of, part-of, related-to, or alternative-to")
+
+	// relationTypes lists the types that a relation can have.
+	relationTypes = map[string]bool{
+		relationAlternative:  true,
+		relationPartOf:       true,
+		relationPrerequisite: true,
+		relationRelated:      true,
+	}
+)
+
+// relatedTopic is a relation as it is shown on a topic page. Page is the
+// topic that stores the relation, which is where votes and flags on the
+// relation are sent, and Topic is the topic at the other end of the relation
+// from the page being viewed.
+type relatedTopic struct {
+	topicRelation
+
+	Label string
+	Page  string
+	Topic string
+}
+
+// relationGroup is a heading on the topic page and the relations under it.
+type relationGroup struct {
+	Heading   string
+	Relations []relatedTopic
+}
+
+// RelationType returns the type of the relation. Relations that were made
+// before relations had types are related-to relations.
+func (tr topicRelation) RelationType() string {
+	if tr.Type == "" {
+		return relationRelated
+	}
+	return tr.Type
+}
+
+// parseRelationType converts the type submitted by the connect form into a
+// relation type.
+func parseRelationType(relation string) (string, error) {
+	if relation == "" {
+		return relationRelated, nil
+	}
+	if !relationTypes[relation] {
+		return "", errInvalidRelation
+	}
+	return relation, nil
+}
+
+// backlinkKey returns the key in the backlinks bucket for a relation.
+func backlinkKey(destination, source string) []byte {
+	return []byte(destination + "\x00" + source)
+}
+
+// indexRelations updates the backlinks of a topic whose relations are
+// changing from oldRelations to newRelations.
+func indexRelations(tx *bolt.Tx, topic string, oldRelations, newRelations []topicRelation) error {
+	bb := tx.Bucket(bucketBacklinks)
+	current := make(map[string]bool)
+	for _, tr := range newRelations {
+		current[tr.Title] = true
+		err := bb.Put(backlinkKey(tr.Title, topic), []byte(tr.RelationType()))
+		if err != nil {
+			return err
+		}
+	}
+	for _, tr := range oldRelations {
+		if current[tr.Title] {
+			continue
+		}
+		err := bb.Delete(backlinkKey(tr.Title, topic))
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// indexAllRelations records the backlinks of every relation in the database.
+// It is used to build the backlinks of databases that predate them.
+func indexAllRelations(tx *bolt.Tx) error {
+	var names []string
+	err := tx.Bucket(bucketTopics).ForEach(func(k, v []byte) error {
+		names = append(names, string(k))
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	for _, name := range names {
+		td, _, err := getTopic(tx, name)
+		if err != nil {
+			return err
+		}
+		err = indexRelations(tx, name, nil, td.RelatedTopics)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// hasRelation returns whether a relation exists between two topics in either
+// direction.
+func hasRelation(tx *bolt.Tx, a, b string) bool {
+	return relatesTo(tx, a, b) || relatesTo(tx, b, a)
+}
+
+// relatesTo returns whether the source topic has a relation that leads to the
+// destination topic.
+func relatesTo(tx *bolt.Tx, source, destination string) bool {
+	return tx.Bucket(bucketBacklinks).Get(backlinkKey(destination, source)) != nil
+}
+
+// topicRelations gathers the visible relations on both ends of a topic and
+// sorts them into the groups shown on the topic page.
+func topicRelations(tx *bolt.Tx, topic string, td topicData) (prerequisites, subtopics, seeAlso []relatedTopic, err error) {
+	// Relations stored on the topic itself.
+	for _, tr := range visibleTopics(td.RelatedTopics) {
+		rt := relatedTopic{topicRelation: tr, Page: topic, Topic: tr.Title}
+		switch tr.RelationType() {
+		case relationAlternative:
+			rt.Label = "alternative"
+		case relationPartOf:
+			rt.Label = "part of"
+		case relationPrerequisite:
+			rt.Label = "leads to"
+		}
+		seeAlso = append(seeAlso, rt)
+	}
+
+	// Relations stored on other topics that lead to this one.
+	prefix := backlinkKey(topic, "")
+	c := tx.Bucket(bucketBacklinks).Cursor()
+	for k, _ := c.Seek(prefix); k != nil && bytes.HasPrefix(k, prefix); k, _ = c.Next() {
+		source := string(k[len(prefix):])
+		sourceTD, exists, err := getTopic(tx, source)
+		if err != nil {
+			return nil, nil, nil, err
+		}
+		if !exists {
+			continue
+		}
+		i := topicIndex(sourceTD.RelatedTopics, topic)
+		if i < 0 || sourceTD.RelatedTopics[i].Hidden {
+			continue
+		}
+		tr := sourceTD.RelatedTopics[i]
+		rt := relatedTopic{topicRelation: tr, Page: source, Topic: source}
+		switch tr.RelationType() {
+		case relationPrerequisite:
+			prerequisites = append(prerequisites, rt)
+		case relationPartOf:
+			subtopics = append(subtopics, rt)
+		case relationAlternative:
+			rt.Label = "alternative"
+			seeAlso = append(seeAlso, rt)
+		default:
+			seeAlso = append(seeAlso, rt)
+		}
+	}
+	return prerequisites, subtopics, seeAlso, nil
+}
@@ -0,0 +1,585 @@
+package main
+
+// resumable.go implements resumable uploads, which let large media be sent in
+// chunks so that a dropped connection only costs the chunk that was in
+// flight. The protocol is part of the JSON API:
+//
+//	POST   /api/v1/uploads                  start an upload from {"size",
+//	                                        "hash", "title", "parentTopic",
+//	                                        "parentMedia"}
+//	PUT    /api/v1/uploads/<id>/chunks/<n>  send chunk n, with the offset of
+//	                                        the chunk in '?offset=' and its
+//	                                        length in Content-Length; every
+//	                                        chunk but the one that ends the
+//	                                        upload must be at least 256 KB
+//	GET    /api/v1/uploads/<id>             the chunks and byte ranges that
+//	                                        have been received
+//	POST   /api/v1/uploads/<id>/finalize    check the hash of the upload and
+//	                                        add it to its parent
+//	DELETE /api/v1/uploads/<id>             abandon the upload
+//
+// Each upload session is stored in the uploads bucket and its data is written
+// into a file in the media folder at the offset of each chunk. Chunks may
+// arrive in any order and may be sent again. Finalizing copies the file into
+// a staged upload of its own, hashing it along the way, so that chunks which
+// are still being written cannot change the file after it has been checked.
+// The hash of the copy must match the hash given when the upload was started,
+// and the copy is then handed to storeUpload like any other upload. Sessions that have not been
+// touched for uploadSessionTimeout are removed along with their data.
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/boltdb/bolt"
+)
+
+const (
+	// maxChunkSize limits the size of a single chunk of a resumable upload.
+	maxChunkSize = 32 << 20 // 32 MB
+
+	// minChunkSize is the smallest chunk allowed anywhere but at the end of
+	// an upload. Chunk numbers are limited to the number of chunks of this
+	// size that fit in the upload, which bounds the number of chunks that a
+	// session has to keep track of.
+	minChunkSize = 256 << 10 // 256 KB
+
+	// maxUploadSessions limits the number of unfinished uploads that a user
+	// can have at once.
+	maxUploadSessions = 10
+
+	// resumableUploadPrefix starts the name of the file that holds the data
+	// of each upload session in the media folder. It differs from
+	// tempUploadPrefix so that the data survives a restart of the server.
+	resumableUploadPrefix = ".resumable-"
+
+	uploadIDLen          = 16
+	uploadPruneInterval  = 10 * time.Minute
+	uploadSessionTimeout = 24 * time.Hour
+)
+
+var (
+	errChunkOutOfRange    = errors.New("chunk does not fit within the size of the upload")
+	errChunkNumber        = errors.New("chunk number is larger than the upload can have")
+	errChunkTooLarge      = errors.New("chunk is larger than the chunk size limit")
+	errChunkTooSmall      = errors.New("chunks other than the one that ends the upload must be at least 256 KB")
+	errIncompleteUpload   = errors.New("upload has not received all of its data")
+	errInvalidChunk       = errors.New("chunks must be numbered from 0 and sent with an offset and a Content-Length")
+	errInvalidUploadHash  = errors.New("upload hash must be a hex encoded sha256 hash")
+	errInvalidUploadSize  = errors.New("upload size must be greater than zero")
+	errMissingUpload      = errors.New("upload does not exist")
+	errTooManyUploads     = errors.New("you have too many unfinished uploads - finish or abandon one first")
+	errUploadHashMismatch = errors.New("upload data does not match the upload hash")
+)
+
+// uploadChunk is the byte range covered by a chunk of an upload.
+type uploadChunk struct {
+	Offset int64 `json:"offset"`
+	Length int64 `json:"length"`
+}
+
+// uploadSession is the information stored in the database about a resumable
+// upload.
+type uploadSession struct {
+	Owner       string
+	Size        int64
+	Hash        string
+	Title       string
+	ParentTopic string
+	ParentMedia string
+
+	Chunks  map[int]uploadChunk
+	Created time.Time
+	Updated time.Time
+}
+
+// apiUploadRequest is the body of a request to start a resumable upload.
+type apiUploadRequest struct {
+	Size        int64  `json:"size"`
+	Hash        string `json:"hash"`
+	Title       string `json:"title"`
+	ParentTopic string `json:"parentTopic"`
+	ParentMedia string `json:"parentMedia"`
+}
+
+// apiUpload is a resumable upload as returned by the API. Received holds the
+// merged byte ranges that have arrived so far.
+type apiUpload struct {
+	ID       string              `json:"id"`
+	Size     int64               `json:"size"`
+	Hash     string              `json:"hash"`
+	Chunks   map[int]uploadChunk `json:"chunks"`
+	Received []uploadChunk       `json:"received"`
+	Complete bool                `json:"complete"`
+	Expires  time.Time           `json:"expires"`
+}
+
+// uploadDataPath returns the path of the file holding the data of an upload.
+func uploadDataPath(id string) string {
+	return filepath.Join(dirMedia, resumableUploadPrefix+id)
+}
+
+// received merges the chunks of an upload into the byte ranges that have
+// arrived.
+func (us uploadSession) received() []uploadChunk {
+	var chunks []uploadChunk
+	for _, c := range us.Chunks {
+		chunks = append(chunks, c)
+	}
+	sort.Slice(chunks, func(i, j int) bool {
+		return chunks[i].Offset < chunks[j].Offset
+	})
+	var ranges []uploadChunk
+	for _, c := range chunks {
+		if c.Length == 0 {
+			continue
+		}
+		last := len(ranges) - 1
+		if last >= 0 && c.Offset <= ranges[last].Offset+ranges[last].Length {
+			end := c.Offset + c.Length
+			if end > ranges[last].Offset+ranges[last].Length {
+				ranges[last].Length = end - ranges[last].Offset
+			}
+			continue
+		}
+		ranges = append(ranges, c)
+	}
+	return ranges
+}
+
+// complete returns whether every byte of the upload has arrived.
+func (us uploadSession) complete() bool {
+	ranges := us.received()
+	return len(ranges) == 1 && ranges[0].Offset == 0 && ranges[0].Length == us.Size
+}
+
+// apiUploadFromSession builds the API representation of an upload session.
+func apiUploadFromSession(id string, us uploadSession) apiUpload {
+	au := apiUpload{
+		ID:       id,
+		Size:     us.Size,
+		Hash:     us.Hash,
+		Chunks:   us.Chunks,
+		Received: us.received(),
+		Complete: us.complete(),
+		Expires:  us.Updated.Add(uploadSessionTimeout),
+	}
+	if au.Chunks == nil {
+		au.Chunks = map[int]uploadChunk{}
+	}
+	if au.Received == nil {
+		au.Received = []uploadChunk{}
+	}
+	return au
+}
+
+// getUploadSession returns the upload session with the provided id, if it
+// belongs to the user.
+func getUploadSession(tx *bolt.Tx, id string, user User) (us uploadSession, err error) {
+	sessionBytes := tx.Bucket(bucketUploads).Get([]byte(id))
+	if sessionBytes == nil {
+		return uploadSession{}, errMissingUpload
+	}
+	err = json.Unmarshal(sessionBytes, &us)
+	if err != nil {
+		return uploadSession{}, err
+	}
+	if us.Owner != user.Name {
+		return uploadSession{}, errMissingUpload
+	}
+	return us, nil
+}
+
+// putUploadSession stores an upload session.
+func putUploadSession(tx *bolt.Tx, id string, us uploadSession) error {
+	sessionBytes, err := json.Marshal(us)
+	if err != nil {
+		return err
+	}
+	return tx.Bucket(bucketUploads).Put([]byte(id), sessionBytes)
+}
+
+// deleteUploadSession removes an upload session from the database. The data
+// of the upload is left for the caller to remove.
+func deleteUploadSession(tx *bolt.Tx, id string) error {
+	return tx.Bucket(bucketUploads).Delete([]byte(id))
+}
+
+// createUploadSession starts a resumable upload for the user.
+func (h *herus) createUploadSession(user User, req apiUploadRequest) (string, uploadSession, error) {
+	if req.Size <= 0 {
+		return "", uploadSession{}, errInvalidUploadSize
+	}
+	if req.Size > h.maxUploadSize {
+		return "", uploadSession{}, errUploadTooLarge
+	}
+	req.Hash = strings.ToLower(req.Hash)
+	if hash, err := hex.DecodeString(req.Hash); err != nil || len(hash) != sha256.Size {
+		return "", uploadSession{}, errInvalidUploadHash
+	}
+	if req.Title == "" {
+		return "", uploadSession{}, errMissingMediaTitle
+	}
+	if req.ParentMedia == "" && req.ParentTopic == "" {
+		return "", uploadSession{}, errMissingParent
+	}
+	if !(req.ParentMedia == "" || req.ParentTopic == "") {
+		return "", uploadSession{}, errMultipleParents
+	}
+	id, err := randomHex(uploadIDLen)
+	if err != nil {
+		return "", uploadSession{}, err
+	}
+	us := uploadSession{
+		Owner:       user.Name,
+		Size:        req.Size,
+		Hash:        req.Hash,
+		Title:       req.Title,
+		ParentTopic: req.ParentTopic,
+		ParentMedia: req.ParentMedia,
+
+		Chunks:  make(map[int]uploadChunk),
+		Created: time.Now(),
+		Updated: time.Now(),
+	}
+
+	err = h.db.Update(func(tx *bolt.Tx) error {
+		open := 0
+		err := tx.Bucket(bucketUploads).ForEach(func(k, v []byte) error {
+			var other uploadSession
+			err := json.Unmarshal(v, &other)
+			if err != nil {
+				return err
+			}
+			if other.Owner == user.Name {
+				open++
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		if open >= maxUploadSessions {
+			return errTooManyUploads
+		}
+		return putUploadSession(tx, id, us)
+	})
+	if err != nil {
+		return "", uploadSession{}, err
+	}
+
+	// Create the data file at its full size so that chunks can be written at
+	// any offset.
+	f, err := os.OpenFile(uploadDataPath(id), os.O_RDWR|os.O_CREATE|os.O_EXCL, 0600)
+	if err == nil {
+		err = f.Truncate(us.Size)
+		closeErr := f.Close()
+		if err == nil {
+			err = closeErr
+		}
+	}
+	if err != nil {
+		os.Remove(uploadDataPath(id))
+		h.db.Update(func(tx *bolt.Tx) error {
+			return deleteUploadSession(tx, id)
+		})
+		return "", uploadSession{}, err
+	}
+	return id, us, nil
+}
+
+// writeChunk writes a chunk of an upload at its offset and records it in the
+// upload session. The length of the chunk must be known up front so that a
+// chunk which does not fit is rejected before any of it is written.
+func (h *herus) writeChunk(user User, id string, n int, offset, length int64, src io.Reader) (uploadSession, error) {
+	var us uploadSession
+	err := h.db.View(func(tx *bolt.Tx) error {
+		var err error
+		us, err = getUploadSession(tx, id, user)
+		return err
+	})
+	if err != nil {
+		return uploadSession{}, err
+	}
+	if n < 0 || offset < 0 || length <= 0 {
+		return uploadSession{}, errInvalidChunk
+	}
+	if length > maxChunkSize {
+		return uploadSession{}, errChunkTooLarge
+	}
+	if offset+length > us.Size {
+		return uploadSession{}, errChunkOutOfRange
+	}
+	if length < minChunkSize && offset+length != us.Size {
+		return uploadSession{}, errChunkTooSmall
+	}
+	if int64(n) > us.Size/minChunkSize {
+		return uploadSession{}, errChunkNumber
+	}
+
+	f, err := os.OpenFile(uploadDataPath(id), os.O_WRONLY, 0600)
+	if err != nil {
+		return uploadSession{}, err
+	}
+	_, err = io.CopyN(io.NewOffsetWriter(f, offset), src, length)
+	if err == nil {
+		err = f.Sync()
+	}
+	closeErr := f.Close()
+	if err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return uploadSession{}, err
+	}
+
+	err = h.db.Update(func(tx *bolt.Tx) error {
+		var err error
+		us, err = getUploadSession(tx, id, user)
+		if err != nil {
+			return err
+		}
+		if us.Chunks == nil {
+			us.Chunks = make(map[int]uploadChunk)
+		}
+		us.Chunks[n] = uploadChunk{Offset: offset, Length: length}
+		us.Updated = time.Now()
+		return putUploadSession(tx, id, us)
+	})
+	return us, err
+}
+
+// finalizeUpload checks that every byte of an upload has arrived and that the
+// data matches the hash of the upload, and then adds the upload to its parent
+// with storeUpload. The data is checked and stored from a private copy, which
+// later chunk writes cannot reach. The session is removed once the upload has
+// been stored.
+func (h *herus) finalizeUpload(user User, id string) (string, error) {
+	var us uploadSession
+	err := h.db.View(func(tx *bolt.Tx) error {
+		var err error
+		us, err = getUploadSession(tx, id, user)
+		return err
+	})
+	if err != nil {
+		return "", err
+	}
+	if !us.complete() {
+		return "", errIncompleteUpload
+	}
+
+	f, err := os.Open(uploadDataPath(id))
+	if err != nil {
+		return "", err
+	}
+	su, err := h.stageUpload(io.LimitReader(f, us.Size))
+	f.Close()
+	if err != nil {
+		return "", err
+	}
+	defer su.discard()
+	if su.Size != us.Size {
+		return "", errIncompleteUpload
+	}
+	if su.Hash != us.Hash {
+		return "", errUploadHashMismatch
+	}
+
+	// Keep the session if the upload cannot be stored, so that the upload
+	// can be finalized again once the problem, such as a missing parent
+	// topic, has been fixed.
+	hash, err := h.storeUpload(user, su, us.Title, us.ParentTopic, us.ParentMedia)
+	if err != nil {
+		return "", err
+	}
+	err = h.abandonUpload(id)
+	if err != nil {
+		println(err.Error())
+	}
+	return hash, nil
+}
+
+// abandonUpload removes an upload session and its data.
+func (h *herus) abandonUpload(id string) error {
+	err := h.db.Update(func(tx *bolt.Tx) error {
+		return deleteUploadSession(tx, id)
+	})
+	if err != nil {
+		return err
+	}
+	err = os.Remove(uploadDataPath(id))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
+
+// pruneUploads removes every upload session that has not been touched for
+// uploadSessionTimeout, along with any data file that has no session.
+func (h *herus) pruneUploads() error {
+	var stale []string
+	live := make(map[string]bool)
+	err := h.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(bucketUploads).ForEach(func(k, v []byte) error {
+			var us uploadSession
+			err := json.Unmarshal(v, &us)
+			if err != nil {
+				return err
+			}
+			if time.Since(us.Updated) > uploadSessionTimeout {
+				stale = append(stale, string(k))
+			} else {
+				live[string(k)] = true
+			}
+			return nil
+		})
+	})
+	if err != nil {
+		return err
+	}
+	for _, id := range stale {
+		err = h.abandonUpload(id)
+		if err != nil {
+			return err
+		}
+	}
+
+	paths, err := filepath.Glob(filepath.Join(dirMedia, resumableUploadPrefix+"*"))
+	if err != nil {
+		return err
+	}
+	for _, path := range paths {
+		id := strings.TrimPrefix(filepath.Base(path), resumableUploadPrefix)
+		if live[id] {
+			continue
+		}
+		// A file created after the sessions were read may belong to a new
+		// session, so only orphans that are past the timeout are removed.
+		info, err := os.Stat(path)
+		if err != nil || time.Since(info.ModTime()) < uploadSessionTimeout {
+			continue
+		}
+		err = os.Remove(path)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// threadedPruneUploads clears out abandoned uploads at regular intervals.
+func (h *herus) threadedPruneUploads() {
+	for {
+		err := h.pruneUploads()
+		if err != nil {
+			println(err.Error())
+		}
+		time.Sleep(uploadPruneInterval)
+	}
+}
+
+// apiUploadsHandler handles the requests that make up a resumable upload. The
+// path is what follows '/api/v1/uploads/'.
+func (h *herus) apiUploadsHandler(w http.ResponseWriter, r *http.Request, path string) {
+	user, ok := apiRequireRole(w, r, memberContributor)
+	if !ok {
+		return
+	}
+	parts := strings.Split(path, "/")
+	id := parts[0]
+
+	switch {
+	case path == "" && r.Method == "POST":
+		var req apiUploadRequest
+		err := decodeAPIBody(w, r, &req)
+		if err != nil {
+			writeJSONError(w, http.StatusBadRequest, err)
+			return
+		}
+		id, us, err := h.createUploadSession(user, req)
+		if err != nil {
+			writeJSONError(w, apiErrorStatus(err), err)
+			return
+		}
+		writeJSON(w, http.StatusCreated, apiUploadFromSession(id, us))
+
+	case len(parts) == 1 && id != "" && r.Method == "GET":
+		var us uploadSession
+		err := h.db.View(func(tx *bolt.Tx) error {
+			var err error
+			us, err = getUploadSession(tx, id, user)
+			return err
+		})
+		if err != nil {
+			writeJSONError(w, apiErrorStatus(err), err)
+			return
+		}
+		writeJSON(w, http.StatusOK, apiUploadFromSession(id, us))
+
+	case len(parts) == 1 && id != "" && r.Method == "DELETE":
+		err := h.db.View(func(tx *bolt.Tx) error {
+			_, err := getUploadSession(tx, id, user)
+			return err
+		})
+		if err == nil {
+			err = h.abandonUpload(id)
+		}
+		if err != nil {
+			writeJSONError(w, apiErrorStatus(err), err)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+
+	case len(parts) == 3 && parts[1] == "chunks" && r.Method == "PUT":
+		n, err := strconv.Atoi(parts[2])
+		if err != nil {
+			writeJSONError(w, http.StatusBadRequest, errInvalidChunk)
+			return
+		}
+		offset, err := strconv.ParseInt(r.URL.Query().Get("offset"), 10, 64)
+		if err != nil {
+			writeJSONError(w, http.StatusBadRequest, errInvalidChunk)
+			return
+		}
+		us, err := h.writeChunk(user, id, n, offset, r.ContentLength, r.Body)
+		if err != nil {
+			writeJSONError(w, apiErrorStatus(err), err)
+			return
+		}
+		writeJSON(w, http.StatusOK, apiUploadFromSession(id, us))
+
+	case len(parts) == 2 && parts[1] == "finalize" && r.Method == "POST":
+		hash, err := h.finalizeUpload(user, id)
+		if err != nil {
+			writeJSONError(w, apiErrorStatus(err), err)
+			return
+		}
+		var am apiMedia
+		err = h.db.View(func(tx *bolt.Tx) error {
+			var err error
+			am, err = getAPIMedia(tx, hash)
+			return err
+		})
+		if err != nil {
+			writeJSONError(w, apiErrorStatus(err), err)
+			return
+		}
+		writeJSON(w, http.StatusCreated, am)
+
+	case path == "" || len(parts) == 1 || (len(parts) == 2 && parts[1] == "finalize") || (len(parts) == 3 && parts[1] == "chunks"):
+		writeJSONError(w, http.StatusMethodNotAllowed, errWrongMethod)
+
+	default:
+		writeJSONError(w, http.StatusNotFound, errMissingResource)
+	}
+}
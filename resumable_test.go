@@ -0,0 +1,203 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/boltdb/bolt"
+)
+
+// TestUploadReceived checks the merging of chunks into received ranges and
+// the detection of complete uploads.
+func TestUploadReceived(t *testing.T) {
+	tests := []struct {
+		name     string
+		chunks   []uploadChunk
+		want     []uploadChunk
+		complete bool
+	}{
+		{"none", nil, nil, false},
+		{"in order", []uploadChunk{{0, 4}, {4, 4}, {8, 2}}, []uploadChunk{{0, 10}}, true},
+		{"out of order", []uploadChunk{{8, 2}, {0, 4}, {4, 4}}, []uploadChunk{{0, 10}}, true},
+		{"overlapping", []uploadChunk{{0, 6}, {3, 5}, {7, 3}}, []uploadChunk{{0, 10}}, true},
+		{"contained", []uploadChunk{{0, 10}, {2, 3}}, []uploadChunk{{0, 10}}, true},
+		{"gap", []uploadChunk{{6, 4}, {0, 4}}, []uploadChunk{{0, 4}, {6, 4}}, false},
+		{"missing start", []uploadChunk{{1, 9}}, []uploadChunk{{1, 9}}, false},
+		{"missing end", []uploadChunk{{0, 4}, {4, 5}}, []uploadChunk{{0, 9}}, false},
+		{"empty chunk", []uploadChunk{{0, 0}, {0, 10}}, []uploadChunk{{0, 10}}, true},
+	}
+	for _, test := range tests {
+		us := uploadSession{Size: 10, Chunks: make(map[int]uploadChunk)}
+		for i, c := range test.chunks {
+			us.Chunks[i] = c
+		}
+		if got := us.received(); !reflect.DeepEqual(got, test.want) {
+			t.Errorf("%v: received %v, want %v", test.name, got, test.want)
+		}
+		if got := us.complete(); got != test.complete {
+			t.Errorf("%v: complete is %v, want %v", test.name, got, test.complete)
+		}
+	}
+}
+
+// TestFinalizeUploadHash checks that an upload is only finalized once all of
+// its data has arrived and that data which does not match the hash given at
+// the start of the upload is rejected.
+func TestFinalizeUploadHash(t *testing.T) {
+	t.Chdir(t.TempDir())
+	err := os.MkdirAll(dirMedia, 0700)
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := &herus{db: newTestDB(t), maxUploadSize: defaultMaxUploadSize}
+	alice := User{Name: "alice"}
+
+	expected := sha256.Sum256([]byte("the data that was promised"))
+	data := strings.Repeat("-", minChunkSize) + "the data that was sent"
+	id, _, err := h.createUploadSession(alice, apiUploadRequest{
+		Size:        int64(len(data)),
+		Hash:        hex.EncodeToString(expected[:]),
+		Title:       "notes",
+		ParentTopic: "calculus",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Send the end first.
+	_, err = h.writeChunk(alice, id, 1, minChunkSize, int64(len(data)-minChunkSize), strings.NewReader(data[minChunkSize:]))
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = h.finalizeUpload(alice, id)
+	if err != errIncompleteUpload {
+		t.Errorf("finalizing a partial upload returned %v, want %v", err, errIncompleteUpload)
+	}
+	_, err = h.writeChunk(alice, id, 0, 0, minChunkSize, strings.NewReader(data[:minChunkSize]))
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = h.finalizeUpload(alice, id)
+	if err != errUploadHashMismatch {
+		t.Errorf("finalizing an upload with the wrong data returned %v, want %v", err, errUploadHashMismatch)
+	}
+	if _, err := os.Stat(uploadDataPath(id)); err != nil {
+		t.Errorf("data of a rejected upload was removed: %v", err)
+	}
+}
+
+// TestFinalizeUpload checks that a finalized upload is stored under the hash
+// of its data, and that neither the data of the session nor the copy that was
+// checked is left behind.
+func TestFinalizeUpload(t *testing.T) {
+	t.Chdir(t.TempDir())
+	err := os.MkdirAll(dirMedia, 0700)
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := &herus{db: newTestDB(t), maxUploadSize: defaultMaxUploadSize}
+	alice := User{Name: "alice"}
+	err = h.db.Update(func(tx *bolt.Tx) error {
+		err := putUser(tx, alice)
+		if err != nil {
+			return err
+		}
+		return putTopic(tx, "calculus", topicData{Title: "Calculus"}, "admin")
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	data := strings.Repeat("limits, derivatives, and integrals\n", minChunkSize/16)
+	sum := sha256.Sum256([]byte(data))
+	id, _, err := h.createUploadSession(alice, apiUploadRequest{
+		Size:        int64(len(data)),
+		Hash:        hex.EncodeToString(sum[:]),
+		Title:       "notes.txt",
+		ParentTopic: "calculus",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = h.writeChunk(alice, id, 1, minChunkSize, int64(len(data)-minChunkSize), strings.NewReader(data[minChunkSize:]))
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = h.writeChunk(alice, id, 0, 0, minChunkSize, strings.NewReader(data[:minChunkSize]))
+	if err != nil {
+		t.Fatal(err)
+	}
+	hash, err := h.finalizeUpload(alice, id)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	stored, err := os.ReadFile(filepath.Join(dirMedia, hash))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if storedSum := sha256.Sum256(stored); hex.EncodeToString(storedSum[:]) != hash {
+		t.Error("stored media does not match its hash")
+	}
+	entries, err := os.ReadDir(dirMedia)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 {
+		var names []string
+		for _, entry := range entries {
+			names = append(names, entry.Name())
+		}
+		t.Errorf("media folder holds %v, want only the stored media", names)
+	}
+}
+
+// TestWriteChunkLimits checks that small chunks are only accepted at the end
+// of an upload and that chunk numbers are limited by the size of the upload.
+func TestWriteChunkLimits(t *testing.T) {
+	t.Chdir(t.TempDir())
+	err := os.MkdirAll(dirMedia, 0700)
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := &herus{db: newTestDB(t), maxUploadSize: defaultMaxUploadSize}
+	alice := User{Name: "alice"}
+	size := int64(2*minChunkSize + 1)
+	sum := sha256.Sum256(nil)
+	id, _, err := h.createUploadSession(alice, apiUploadRequest{
+		Size:        size,
+		Hash:        hex.EncodeToString(sum[:]),
+		Title:       "notes",
+		ParentTopic: "calculus",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		n              int
+		offset, length int64
+		want           error
+	}{
+		{0, 0, minChunkSize, nil},
+		{1, minChunkSize, minChunkSize, nil},
+		{2, 2 * minChunkSize, 1, nil},
+		{0, 0, 1, errChunkTooSmall},
+		{1, minChunkSize, minChunkSize + 1, nil},
+		{3, 0, minChunkSize, errChunkNumber},
+		{1 << 30, 0, minChunkSize, errChunkNumber},
+		{-1, 0, minChunkSize, errInvalidChunk},
+		{0, size, 1, errChunkOutOfRange},
+	}
+	for _, test := range tests {
+		_, err := h.writeChunk(alice, id, test.n, test.offset, test.length, strings.NewReader(strings.Repeat("x", int(test.length))))
+		if err != test.want {
+			t.Errorf("chunk %v at %v of %v bytes returned %v, want %v", test.n, test.offset, test.length, err, test.want)
+		}
+	}
+}
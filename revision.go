@@ -0,0 +1,611 @@
+package main
+
+// revision.go keeps the edit history of every topic. Each write to a topic that
+// changes its content is stored as an immutable revision in a bucket of its own
+// inside the revisions bucket. A revision holds a full copy of the topic, the
+// author, the time of the write, and the line diff against the previous
+// revision.
+//
+// The content of a topic is its title, its description, and the set of media
+// and related topics on the page. Vote counters are not part of the content,
+// so votes do not produce revisions, and reverting a topic never changes the
+// votes on anything that is still on the page. Anything that a revert brings
+// back has its counters recounted from the votes bucket, since its votes may
+// have followed it to another page in a merge or split since the revision.
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"html/template"
+	"io"
+	"net/http"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/boltdb/bolt"
+)
+
+const (
+	diffSuffix    = "/diff"
+	historySuffix = "/history"
+	revertSuffix  = "/revert"
+
+	historyTitle = "History"
+
+	diffAdd    = "+"
+	diffRemove = "-"
+	diffSame   = " "
+
+	// maxDiffCells limits the size of the table used to diff two revisions.
+	// Changes that are too large to diff line by line are shown as the old
+	// lines removed and the new lines added.
+	maxDiffCells = 1 << 20
+)
+
+var (
+	diffTpl    = filepath.Join(dirTemplates, "diff.tpl")
+	historyTpl = filepath.Join(dirTemplates, "history.tpl")
+
+	errInvalidRevision = errors.New("revision must be a number")
+	errMissingRevision = errors.New("revision does not exist")
+)
+
+// diffLine is a single line of a diff between two revisions.
+type diffLine struct {
+	Op   string
+	Text string
+}
+
+// revision is a single entry in the history of a topic.
+type revision struct {
+	ID     uint64
+	Author string
+	Date   time.Time
+
+	Content topicData
+	Diff    []diffLine
+}
+
+// historyTemplateData defines the data which is used to fill out the history
+// template file.
+type historyTemplateData struct {
+	CanRevert   bool
+	Name        string
+	TopicPrefix string
+	Title       string
+
+	Revisions []revision
+}
+
+// diffTemplateData defines the data which is used to fill out the diff
+// template file.
+type diffTemplateData struct {
+	From        uint64
+	Name        string
+	To          uint64
+	TopicPrefix string
+	Title       string
+
+	Diff []diffLine
+}
+
+// Added returns the number of lines added by the revision.
+func (rev revision) Added() int {
+	n := 0
+	for _, dl := range rev.Diff {
+		if dl.Op == diffAdd {
+			n++
+		}
+	}
+	return n
+}
+
+// Removed returns the number of lines removed by the revision.
+func (rev revision) Removed() int {
+	n := 0
+	for _, dl := range rev.Diff {
+		if dl.Op == diffRemove {
+			n++
+		}
+	}
+	return n
+}
+
+// revisionText renders the content of a topic as lines of text, which is what
+// revisions are diffed against.
+func revisionText(td topicData) []string {
+	lines := []string{"Title: " + td.Title, "Description:"}
+	if td.Description != "" {
+		lines = append(lines, strings.Split(td.Description, "\n")...)
+	}
+	lines = append(lines, "Media:")
+	for _, mr := range td.AssociatedMedia {
+		line := mr.Hash + " " + mr.Title
+		if mr.Hidden {
+			line += " (hidden)"
+		}
+		lines = append(lines, line)
+	}
+	lines = append(lines, "Related Topics:")
+	for _, tr := range td.RelatedTopics {
+		line := tr.RelationType() + " " + tr.Title
+		if tr.Hidden {
+			line += " (hidden)"
+		}
+		lines = append(lines, line)
+	}
+	return lines
+}
+
+// readerContent returns the content of a revision as readers may see it. Media
+// and related topics that are hidden in the revision or on the topic now are
+// left out, as is media that has been hidden everywhere, so that the history
+// of a topic does not reveal what a moderator has hidden.
+func readerContent(tx *bolt.Tx, td, current topicData) (topicData, error) {
+	var media []mediaRelation
+	for _, mr := range td.AssociatedMedia {
+		if mr.Hidden {
+			continue
+		}
+		if i := mediaIndex(current.AssociatedMedia, mr.Hash); i >= 0 && current.AssociatedMedia[i].Hidden {
+			continue
+		}
+		mm, _, err := getMediaMetadata(tx, mr.Hash)
+		if err != nil {
+			return topicData{}, err
+		}
+		if mm.Hidden {
+			continue
+		}
+		media = append(media, mr)
+	}
+	var relations []topicRelation
+	for _, tr := range td.RelatedTopics {
+		if tr.Hidden {
+			continue
+		}
+		if i := topicIndex(current.RelatedTopics, tr.Title); i >= 0 && current.RelatedTopics[i].Hidden {
+			continue
+		}
+		relations = append(relations, tr)
+	}
+	td.AssociatedMedia = media
+	td.RelatedTopics = relations
+	return td, nil
+}
+
+// readerRevisions rewrites the revisions of a topic, most recent first, as
+// readers may see them, diffing each against the previous one again.
+func readerRevisions(tx *bolt.Tx, topic string, revisions []revision) error {
+	current, _, err := getTopic(tx, topic)
+	if err != nil {
+		return err
+	}
+	var oldText []string
+	for i := len(revisions) - 1; i >= 0; i-- {
+		revisions[i].Content, err = readerContent(tx, revisions[i].Content, current)
+		if err != nil {
+			return err
+		}
+		newText := revisionText(revisions[i].Content)
+		revisions[i].Diff = diffLines(oldText, newText)
+		oldText = newText
+	}
+	return nil
+}
+
+// sameLines returns whether two texts have the same lines.
+func sameLines(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// diffLines returns the line diff that turns a into b. The lines that the
+// two share at their start and end are matched directly, and the lines in
+// between are diffed using their longest common subsequence.
+func diffLines(a, b []string) []diffLine {
+	var prefix, suffix []diffLine
+	for len(a) > 0 && len(b) > 0 && a[0] == b[0] {
+		prefix = append(prefix, diffLine{Op: diffSame, Text: a[0]})
+		a, b = a[1:], b[1:]
+	}
+	for len(a) > 0 && len(b) > 0 && a[len(a)-1] == b[len(b)-1] {
+		suffix = append(suffix, diffLine{Op: diffSame, Text: a[len(a)-1]})
+		a, b = a[:len(a)-1], b[:len(b)-1]
+	}
+	diff := append(prefix, diffMiddle(a, b)...)
+	for i := len(suffix) - 1; i >= 0; i-- {
+		diff = append(diff, suffix[i])
+	}
+	return diff
+}
+
+// diffMiddle returns the line diff that turns a into b using the longest
+// common subsequence of the two, or replaces all of a with all of b if the two
+// are too large to diff.
+func diffMiddle(a, b []string) []diffLine {
+	var diff []diffLine
+	if (len(a)+1)*(len(b)+1) > maxDiffCells {
+		for _, line := range a {
+			diff = append(diff, diffLine{Op: diffRemove, Text: line})
+		}
+		for _, line := range b {
+			diff = append(diff, diffLine{Op: diffAdd, Text: line})
+		}
+		return diff
+	}
+
+	// lcs[i][j] is the length of the longest common subsequence of a[i:] and
+	// b[j:].
+	lcs := make([][]int, len(a)+1)
+	for i := range lcs {
+		lcs[i] = make([]int, len(b)+1)
+	}
+	for i := len(a) - 1; i >= 0; i-- {
+		for j := len(b) - 1; j >= 0; j-- {
+			if a[i] == b[j] {
+				lcs[i][j] = lcs[i+1][j+1] + 1
+			} else if lcs[i+1][j] >= lcs[i][j+1] {
+				lcs[i][j] = lcs[i+1][j]
+			} else {
+				lcs[i][j] = lcs[i][j+1]
+			}
+		}
+	}
+
+	i, j := 0, 0
+	for i < len(a) && j < len(b) {
+		switch {
+		case a[i] == b[j]:
+			diff = append(diff, diffLine{Op: diffSame, Text: a[i]})
+			i++
+			j++
+		case lcs[i+1][j] >= lcs[i][j+1]:
+			diff = append(diff, diffLine{Op: diffRemove, Text: a[i]})
+			i++
+		default:
+			diff = append(diff, diffLine{Op: diffAdd, Text: b[j]})
+			j++
+		}
+	}
+	for ; i < len(a); i++ {
+		diff = append(diff, diffLine{Op: diffRemove, Text: a[i]})
+	}
+	for ; j < len(b); j++ {
+		diff = append(diff, diffLine{Op: diffAdd, Text: b[j]})
+	}
+	return diff
+}
+
+// revisionKey returns the key of a revision within the bucket of its topic.
+func revisionKey(id uint64) []byte {
+	key := make([]byte, 8)
+	binary.BigEndian.PutUint64(key, id)
+	return key
+}
+
+// latestRevision returns the most recent revision of a topic.
+func latestRevision(tx *bolt.Tx, topic string) (rev revision, exists bool, err error) {
+	b := tx.Bucket(bucketRevisions).Bucket([]byte(topic))
+	if b == nil {
+		return revision{}, false, nil
+	}
+	_, revBytes := b.Cursor().Last()
+	if revBytes == nil {
+		return revision{}, false, nil
+	}
+	err = json.Unmarshal(revBytes, &rev)
+	if err != nil {
+		return revision{}, true, err
+	}
+	return rev, true, nil
+}
+
+// getRevision returns a single revision of a topic.
+func getRevision(tx *bolt.Tx, topic string, id uint64) (rev revision, exists bool, err error) {
+	b := tx.Bucket(bucketRevisions).Bucket([]byte(topic))
+	if b == nil {
+		return revision{}, false, nil
+	}
+	revBytes := b.Get(revisionKey(id))
+	if revBytes == nil {
+		return revision{}, false, nil
+	}
+	err = json.Unmarshal(revBytes, &rev)
+	if err != nil {
+		return revision{}, true, err
+	}
+	return rev, true, nil
+}
+
+// topicRevisions returns every revision of a topic, most recent first.
+func topicRevisions(tx *bolt.Tx, topic string) ([]revision, error) {
+	b := tx.Bucket(bucketRevisions).Bucket([]byte(topic))
+	if b == nil {
+		return nil, nil
+	}
+	var revisions []revision
+	c := b.Cursor()
+	for k, v := c.Last(); k != nil; k, v = c.Prev() {
+		var rev revision
+		err := json.Unmarshal(v, &rev)
+		if err != nil {
+			return nil, err
+		}
+		revisions = append(revisions, rev)
+	}
+	return revisions, nil
+}
+
+// recordRevision adds a revision to the history of a topic if the content of
+// the topic differs from the most recent revision.
+func recordRevision(tx *bolt.Tx, topic string, td topicData, author string) error {
+	latest, _, err := latestRevision(tx, topic)
+	if err != nil {
+		return err
+	}
+	var oldText []string
+	if latest.ID != 0 {
+		oldText = revisionText(latest.Content)
+	}
+	newText := revisionText(td)
+	if latest.ID != 0 && sameLines(oldText, newText) {
+		return nil
+	}
+	diff := diffLines(oldText, newText)
+
+	b, err := tx.Bucket(bucketRevisions).CreateBucketIfNotExists([]byte(topic))
+	if err != nil {
+		return err
+	}
+	id, err := b.NextSequence()
+	if err != nil {
+		return err
+	}
+	revBytes, err := json.Marshal(revision{
+		ID:     id,
+		Author: author,
+		Date:   time.Now(),
+
+		Content: td,
+		Diff:    diff,
+	})
+	if err != nil {
+		return err
+	}
+	return b.Put(revisionKey(id), revBytes)
+}
+
+// revertTopic restores the content of a topic to an earlier revision. Media
+// and related topics that are still on the page keep their current votes,
+// while anything that was removed since the revision comes back with the
+// votes that are still on record for it on this page. Related topics are
+// followed through any merges since the revision, and relations that connect
+// would refuse, to a missing topic, to the topic itself, or leading back
+// along an existing relation, are left out.
+func revertTopic(tx *bolt.Tx, topic string, id uint64, moderator string) error {
+	rev, exists, err := getRevision(tx, topic, id)
+	if err != nil {
+		return err
+	}
+	if !exists {
+		return errMissingRevision
+	}
+	current, _, err := getTopic(tx, topic)
+	if err != nil {
+		return err
+	}
+
+	td := rev.Content
+	td.AssociatedMedia = nil
+	for _, mr := range rev.Content.AssociatedMedia {
+		if mediaIndex(td.AssociatedMedia, mr.Hash) >= 0 {
+			continue
+		}
+		if i := mediaIndex(current.AssociatedMedia, mr.Hash); i >= 0 {
+			td.AssociatedMedia = append(td.AssociatedMedia, current.AssociatedMedia[i])
+			continue
+		}
+		err = recountVotes(tx, itemKindMedia, topic, mr.Hash, &mr)
+		if err != nil {
+			return err
+		}
+		td.AssociatedMedia = append(td.AssociatedMedia, mr)
+	}
+	td.RelatedTopics = nil
+	for _, tr := range rev.Content.RelatedTopics {
+		title, err := resolveTopic(tx, tr.Title)
+		if err != nil {
+			return err
+		}
+		if title == topic || topicIndex(td.RelatedTopics, title) >= 0 || relatesTo(tx, title, topic) {
+			continue
+		}
+		_, exists, err := getTopic(tx, title)
+		if err != nil {
+			return err
+		}
+		if !exists {
+			continue
+		}
+		if i := topicIndex(current.RelatedTopics, title); i >= 0 {
+			td.RelatedTopics = append(td.RelatedTopics, current.RelatedTopics[i])
+			continue
+		}
+		tr.Title = title
+		err = recountVotes(tx, itemKindTopic, topic, title, &tr)
+		if err != nil {
+			return err
+		}
+		td.RelatedTopics = append(td.RelatedTopics, tr)
+	}
+	return putTopic(tx, topic, td, moderator)
+}
+
+// parseRevisionID parses a revision number from a form or query value.
+func parseRevisionID(s string) (uint64, error) {
+	id, err := strconv.ParseUint(s, 10, 64)
+	if err != nil {
+		return 0, errInvalidRevision
+	}
+	return id, nil
+}
+
+// executeRevisionBody builds the body portion of the history or diff page.
+func executeRevisionBody(w io.Writer, tpl string, data interface{}) error {
+	t, err := template.ParseFiles(tpl)
+	if err != nil {
+		return err
+	}
+	return t.Execute(w, data)
+}
+
+// serveRevisionPage writes the history or diff page.
+func serveRevisionPage(w http.ResponseWriter, title string, tpl string, data interface{}) {
+	err := executeHeader(w, HeaderTemplateData{Title: title})
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	err = executeRevisionBody(w, tpl, data)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	err = executeFooter(w)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+}
+
+// historyHandler handles requests for the revision history of a topic.
+func (h *herus) historyHandler(w http.ResponseWriter, r *http.Request, topicName string) {
+	user, ok := currentUser(r)
+	htd := historyTemplateData{
+		CanRevert:   ok && hasRole(user, memberModerator),
+		Name:        topicName,
+		TopicPrefix: topicPrefix,
+		Title:       topicName,
+	}
+	err := h.db.View(func(tx *bolt.Tx) error {
+		var err error
+		htd.Revisions, err = topicRevisions(tx, topicName)
+		if err != nil || htd.CanRevert {
+			return err
+		}
+		return readerRevisions(tx, topicName, htd.Revisions)
+	})
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if len(htd.Revisions) > 0 && htd.Revisions[0].Content.Title != "" {
+		htd.Title = htd.Revisions[0].Content.Title
+	}
+	serveRevisionPage(w, htd.Title+" - "+historyTitle, historyTpl, htd)
+}
+
+// diffHandler handles requests for the diff between two revisions of a
+// topic. The revisions are given by the 'from' and 'to' query parameters. If
+// 'from' is omitted, the revision before 'to' is used. Only moderators see
+// hidden media and relations in the diff.
+func (h *herus) diffHandler(w http.ResponseWriter, r *http.Request, topicName string) {
+	user, ok := currentUser(r)
+	moderator := ok && hasRole(user, memberModerator)
+	to, err := parseRevisionID(r.URL.Query().Get("to"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	from := to - 1
+	if r.URL.Query().Get("from") != "" {
+		from, err = parseRevisionID(r.URL.Query().Get("from"))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+
+	dtd := diffTemplateData{
+		From:        from,
+		Name:        topicName,
+		To:          to,
+		TopicPrefix: topicPrefix,
+		Title:       topicName,
+	}
+	err = h.db.View(func(tx *bolt.Tx) error {
+		current, _, err := getTopic(tx, topicName)
+		if err != nil {
+			return err
+		}
+		content := func(id uint64) (topicData, error) {
+			rev, exists, err := getRevision(tx, topicName, id)
+			if err != nil {
+				return topicData{}, err
+			}
+			if !exists {
+				return topicData{}, errMissingRevision
+			}
+			if moderator {
+				return rev.Content, nil
+			}
+			return readerContent(tx, rev.Content, current)
+		}
+		toContent, err := content(to)
+		if err != nil {
+			return err
+		}
+		var fromText []string
+		if from != 0 {
+			fromContent, err := content(from)
+			if err != nil {
+				return err
+			}
+			fromText = revisionText(fromContent)
+		}
+		dtd.Diff = diffLines(fromText, revisionText(toContent))
+		if toContent.Title != "" {
+			dtd.Title = toContent.Title
+		}
+		return nil
+	})
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	serveRevisionPage(w, dtd.Title+" - "+historyTitle, diffTpl, dtd)
+}
+
+// revertHandler handles requests from moderators to revert a topic to an
+// earlier revision.
+func (h *herus) revertHandler(w http.ResponseWriter, r *http.Request, topicName string) {
+	if r.Method != "POST" {
+		http.Error(w, "reverts must be submitted with a POST request", http.StatusMethodNotAllowed)
+		return
+	}
+	moderator, _ := currentUser(r)
+	id, err := parseRevisionID(r.FormValue("revision"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	err = h.db.Update(func(tx *bolt.Tx) error {
+		return revertTopic(tx, topicName, id, moderator.Name)
+	})
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	http.Redirect(w, r, topicURL(topicName)+historySuffix, http.StatusSeeOther)
+}
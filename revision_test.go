@@ -0,0 +1,281 @@
+package main
+
+import (
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/boltdb/bolt"
+)
+
+// renderDiff writes a diff as one op and line per line, which is easy to
+// compare in tests.
+func renderDiff(diff []diffLine) string {
+	var lines []string
+	for _, dl := range diff {
+		lines = append(lines, dl.Op+dl.Text)
+	}
+	return strings.Join(lines, "\n")
+}
+
+// TestDiffLines checks the diffs of small texts.
+func TestDiffLines(t *testing.T) {
+	tests := []struct {
+		a, b string
+		want string
+	}{
+		{"", "x", "+x"},
+		{"x", "", "-x"},
+		{"a b c", "a b c", " a\n b\n c"},
+		{"a b c", "a x c", " a\n-b\n+x\n c"},
+		{"a b c d", "a c d e", " a\n-b\n c\n d\n+e"},
+		{"a b", "b a", "-a\n b\n+a"},
+	}
+	for _, test := range tests {
+		got := renderDiff(diffLines(strings.Fields(test.a), strings.Fields(test.b)))
+		if got != test.want {
+			t.Errorf("diffLines(%q, %q) =\n%v\nwant\n%v", test.a, test.b, got, test.want)
+		}
+	}
+}
+
+// TestDiffLinesLarge checks that texts too large to diff line by line still
+// produce a diff that keeps their shared start and end.
+func TestDiffLinesLarge(t *testing.T) {
+	var a, b []string
+	for i := 0; i < 3000; i++ {
+		a = append(a, "old "+strconv.Itoa(i))
+		b = append(b, "new "+strconv.Itoa(i))
+	}
+	a = append([]string{"start"}, append(a, "end")...)
+	b = append([]string{"start"}, append(b, "end")...)
+	diff := diffLines(a, b)
+	if len(diff) != 6002 {
+		t.Fatalf("diff has %v lines, want 6002", len(diff))
+	}
+	if diff[0].Op != diffSame || diff[len(diff)-1].Op != diffSame {
+		t.Error("shared start and end of the texts are not kept")
+	}
+	if diff[1].Op != diffRemove || diff[3001].Op != diffAdd {
+		t.Error("changed lines are not shown as removed and then added")
+	}
+}
+
+// TestSameLines checks the comparison that lets unchanged writes skip the
+// diff.
+func TestSameLines(t *testing.T) {
+	if !sameLines(nil, []string{}) {
+		t.Error("empty texts differ")
+	}
+	if !sameLines([]string{"a", "b"}, []string{"a", "b"}) {
+		t.Error("equal texts differ")
+	}
+	if sameLines([]string{"a", "b"}, []string{"a"}) || sameLines([]string{"a"}, []string{"b"}) {
+		t.Error("different texts are the same")
+	}
+}
+
+// TestRevertAfterMerge checks that reverting a topic follows its relations
+// through a merge, with counters that agree with the votes that moved, and
+// leaves out relations that would lead back along an existing one.
+func TestRevertAfterMerge(t *testing.T) {
+	h := &herus{db: newTestDB(t)}
+	alice, bob := User{Name: "alice"}, User{Name: "bob"}
+	err := h.db.Update(func(tx *bolt.Tx) error {
+		for _, u := range []User{alice, bob} {
+			err := putUser(tx, u)
+			if err != nil {
+				return err
+			}
+		}
+		for _, name := range []string{"x", "a", "b"} {
+			err := putTopic(tx, name, topicData{Title: name}, "admin")
+			if err != nil {
+				return err
+			}
+		}
+		return connectTopics(tx, alice, "x", "a", relationRelated)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = h.castVote(bob, itemKindTopic, "x", "a", func(uv *userVote) { uv.Value = voteUp })
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	relations := func(tx *bolt.Tx) []topicRelation {
+		td, _, err := getTopic(tx, "x")
+		if err != nil {
+			t.Fatal(err)
+		}
+		return td.RelatedTopics
+	}
+	err = h.db.Update(func(tx *bolt.Tx) error {
+		_, err := mergeTopics(tx, "a", "b", "admin")
+		if err != nil {
+			return err
+		}
+		// Revision 1 has no relations and revision 2 has the relation to a.
+		err = revertTopic(tx, "x", 1, "admin")
+		if err != nil {
+			return err
+		}
+		err = revertTopic(tx, "x", 2, "admin")
+		if err != nil {
+			return err
+		}
+		rs := relations(tx)
+		if len(rs) != 1 || rs[0].Title != "b" || rs[0].Upvotes != submittedUpvotes+1 {
+			t.Errorf("relations after revert are %v, want one to b with %v upvotes", rs, submittedUpvotes+1)
+		}
+		if !relatesTo(tx, "x", "b") || relatesTo(tx, "x", "a") {
+			t.Error("backlink of the restored relation is not under the merged topic")
+		}
+
+		err = revertTopic(tx, "x", 1, "admin")
+		if err != nil {
+			return err
+		}
+		err = connectTopics(tx, alice, "b", "x", relationRelated)
+		if err != nil {
+			return err
+		}
+		err = revertTopic(tx, "x", 2, "admin")
+		if err != nil {
+			return err
+		}
+		if rs := relations(tx); len(rs) != 0 {
+			t.Errorf("relations after revert are %v, want none because b already leads to x", rs)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+// TestRevertAfterSplit checks that media which a split moved away comes back
+// on a revert without the votes that followed it to the new topic.
+func TestRevertAfterSplit(t *testing.T) {
+	h := &herus{db: newTestDB(t)}
+	bob := User{Name: "bob"}
+	err := h.db.Update(func(tx *bolt.Tx) error {
+		err := putUser(tx, bob)
+		if err != nil {
+			return err
+		}
+		return putTopic(tx, "t", topicData{
+			Title: "t",
+			AssociatedMedia: []mediaRelation{
+				{Hash: "m1", Upvotes: submittedUpvotes},
+				{Hash: "m2", Upvotes: submittedUpvotes},
+			},
+		}, "admin")
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = h.castVote(bob, itemKindMedia, "t", "m1", func(uv *userVote) { uv.Value = voteUp })
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = h.db.Update(func(tx *bolt.Tx) error {
+		// Revision 2 holds the vote in the counters of m1.
+		td, _, err := getTopic(tx, "t")
+		if err != nil {
+			return err
+		}
+		td.Description = "edited"
+		err = putTopic(tx, "t", td, "admin")
+		if err != nil {
+			return err
+		}
+		_, err = splitTopic(tx, "t", "New", []string{"m1"}, "admin")
+		if err != nil {
+			return err
+		}
+		err = revertTopic(tx, "t", 2, "admin")
+		if err != nil {
+			return err
+		}
+		td, _, err = getTopic(tx, "t")
+		if err != nil {
+			return err
+		}
+		i := mediaIndex(td.AssociatedMedia, "m1")
+		if i < 0 || len(td.AssociatedMedia) != 2 {
+			t.Fatalf("media after revert are %v, want m1 and m2", td.AssociatedMedia)
+		}
+		if td.AssociatedMedia[i].Upvotes != submittedUpvotes {
+			t.Errorf("restored media has %v upvotes, want %v because its vote moved to the new topic", td.AssociatedMedia[i].Upvotes, submittedUpvotes)
+		}
+		moved, _, err := getTopic(tx, "new")
+		if err != nil {
+			return err
+		}
+		if len(moved.AssociatedMedia) != 1 || moved.AssociatedMedia[0].Upvotes != submittedUpvotes+1 {
+			t.Errorf("media of the new topic are %v, want m1 with its vote", moved.AssociatedMedia)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+// TestReaderRevisions checks that the history shown to readers leaves out
+// media and relations that are hidden now, including from the revisions
+// before they were hidden.
+func TestReaderRevisions(t *testing.T) {
+	db := newTestDB(t)
+	err := db.Update(func(tx *bolt.Tx) error {
+		td := topicData{
+			Title: "t",
+			AssociatedMedia: []mediaRelation{
+				{Hash: "secret_hash", Title: "secret media"},
+				{Hash: "public_hash", Title: "public media"},
+			},
+			RelatedTopics: []topicRelation{{Title: "secret_topic"}},
+		}
+		err := putTopic(tx, "t", td, "admin")
+		if err != nil {
+			return err
+		}
+		td.AssociatedMedia[0].Hidden = true
+		td.RelatedTopics[0].Hidden = true
+		err = putTopic(tx, "t", td, "moderator")
+		if err != nil {
+			return err
+		}
+
+		revisions, err := topicRevisions(tx, "t")
+		if err != nil {
+			return err
+		}
+		if len(revisions) != 2 {
+			t.Fatalf("topic has %v revisions, want 2", len(revisions))
+		}
+		err = readerRevisions(tx, "t", revisions)
+		if err != nil {
+			return err
+		}
+		for _, rev := range revisions {
+			for _, dl := range rev.Diff {
+				if strings.Contains(dl.Text, "secret") {
+					t.Errorf("revision %v shows hidden line %q", rev.ID, dl.Text)
+				}
+			}
+		}
+		if !strings.Contains(renderDiff(revisions[1].Diff), "public_hash public media") {
+			t.Error("visible media is missing from the first revision")
+		}
+		if revisions[0].Added() != 0 || revisions[0].Removed() != 0 {
+			t.Errorf("hiding shows as +%v -%v to readers, want no change", revisions[0].Added(), revisions[0].Removed())
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
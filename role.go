@@ -0,0 +1,234 @@
+package main
+
+// role.go defines the roles that a member of herus can hold and the
+// permission checks that guard the handlers.
+//
+// Roles are ordered, each role has all of the permissions of the roles below
+// it. Readers can browse herus, contributors can upload, connect topics, vote,
+// and flag, moderators can work the moderation queue, and admins can assign
+// roles. A membership with a DateEnded in the past has lapsed, and the member
+// is treated as a reader until an admin renews the membership.
+
+import (
+	"encoding/json"
+	"errors"
+	"html/template"
+	"io"
+	"net/http"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/boltdb/bolt"
+)
+
+const (
+	rolesPage = "/roles.go"
+
+	rolesTitle = "Member Roles"
+
+	memberReader      = "reader"
+	memberContributor = "contributor"
+	memberModerator   = "moderator"
+	memberAdmin       = "admin"
+
+	// dateEndedFormat is the format of the date submitted by admins when
+	// setting the end of a membership.
+	dateEndedFormat = "2006-01-02"
+)
+
+var (
+	rolesTpl = filepath.Join(dirTemplates, "roles.tpl")
+
+	errInvalidDate  = errors.New("dates must be formatted as YYYY-MM-DD")
+	errInvalidRole  = errors.New("role must be reader, contributor, moderator, or admin")
+	errNoPermission = errors.New("you do not have permission to do that")
+
+	// roleLevels orders the roles from least to most permissions.
+	roleLevels = map[string]int{
+		memberReader:      0,
+		memberContributor: 1,
+		memberModerator:   2,
+		memberAdmin:       3,
+	}
+)
+
+// rolesTemplateData defines the data which is used to fill out the roles
+// template file.
+type rolesTemplateData struct {
+	RolesPage  string
+	UserPrefix string
+
+	Error       string
+	ErrorExists bool
+
+	Users []User
+}
+
+// membershipLapsed returns whether the membership of the user has ended.
+func membershipLapsed(user User) bool {
+	if user.DateEnded == "" {
+		return false
+	}
+	ended, err := time.Parse(time.RFC3339, user.DateEnded)
+	if err != nil {
+		// A membership with an unreadable end date is treated as lapsed so
+		// that a bad record cannot grant permissions.
+		return true
+	}
+	return time.Now().After(ended)
+}
+
+// Role returns the role that the user currently holds. Users that registered
+// before roles existed are contributors.
+func (u User) Role() string {
+	if membershipLapsed(u) {
+		return memberReader
+	}
+	if _, ok := roleLevels[u.MemberType]; !ok {
+		return memberContributor
+	}
+	return u.MemberType
+}
+
+// hasRole returns whether the user holds the provided role or a role with
+// more permissions.
+func hasRole(user User, role string) bool {
+	return roleLevels[user.Role()] >= roleLevels[role]
+}
+
+// requireRole wraps a handler so that it is only reachable by logged in users
+// that hold the provided role.
+func requireRole(role string, handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		user, ok := currentUser(r)
+		if !ok {
+			if r.Method == "" || r.Method == "GET" {
+				http.Redirect(w, r, loginPage, http.StatusSeeOther)
+				return
+			}
+			http.Error(w, errNotLoggedIn.Error(), http.StatusUnauthorized)
+			return
+		}
+		if !hasRole(user, role) {
+			http.Error(w, errNoPermission.Error(), http.StatusForbidden)
+			return
+		}
+		handler(w, r)
+	}
+}
+
+// newMemberType returns the role given to a newly registered user. The first
+// user to register becomes an admin so that roles can be handed out.
+func newMemberType(tx *bolt.Tx) string {
+	k, _ := tx.Bucket(bucketUsers).Cursor().First()
+	if k == nil {
+		return memberAdmin
+	}
+	return memberContributor
+}
+
+// setUserRole changes the role of a user and the date that their membership
+// ends. An empty dateEnded gives the user a membership that does not end.
+func setUserRole(tx *bolt.Tx, name, role, dateEnded string) error {
+	if _, ok := roleLevels[role]; !ok {
+		return errInvalidRole
+	}
+	user, exists, err := getUser(tx, name)
+	if err != nil {
+		return err
+	}
+	if !exists {
+		return errMissingUser
+	}
+	user.MemberType = role
+	user.DateEnded = ""
+	if dateEnded != "" {
+		ended, err := time.Parse(dateEndedFormat, dateEnded)
+		if err != nil {
+			return errInvalidDate
+		}
+		user.DateEnded = ended.Format(time.RFC3339)
+	}
+	return putUser(tx, user)
+}
+
+// allUsers returns every user in the users bucket.
+func allUsers(tx *bolt.Tx) ([]User, error) {
+	var users []User
+	err := tx.Bucket(bucketUsers).ForEach(func(k, v []byte) error {
+		var user User
+		err := json.Unmarshal(v, &user)
+		if err != nil {
+			return err
+		}
+		users = append(users, user)
+		return nil
+	})
+	return users, err
+}
+
+// DateEndedInput returns the end of the user's membership in the format used
+// by the roles form.
+func (u User) DateEndedInput() string {
+	ended, err := time.Parse(time.RFC3339, u.DateEnded)
+	if err != nil {
+		return ""
+	}
+	return ended.Format(dateEndedFormat)
+}
+
+// executeRolesBody builds the body portion of the roles page.
+func executeRolesBody(w io.Writer, rtd rolesTemplateData) error {
+	t, err := template.ParseFiles(rolesTpl)
+	if err != nil {
+		return err
+	}
+	return t.Execute(w, rtd)
+}
+
+// rolesHandler handles requests for the page where admins assign roles.
+func (h *herus) rolesHandler(w http.ResponseWriter, r *http.Request) {
+	rtd := rolesTemplateData{
+		RolesPage:  rolesPage,
+		UserPrefix: userPrefix,
+	}
+	if r.Method == "POST" {
+		err := r.ParseForm()
+		if err == nil {
+			err = h.db.Update(func(tx *bolt.Tx) error {
+				name := strings.ToLower(r.FormValue("user"))
+				return setUserRole(tx, name, r.FormValue("role"), r.FormValue("dateEnded"))
+			})
+		}
+		if err != nil {
+			rtd.ErrorExists = true
+			rtd.Error = err.Error()
+		}
+	}
+	err := h.db.View(func(tx *bolt.Tx) error {
+		var err error
+		rtd.Users, err = allUsers(tx)
+		return err
+	})
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	err = executeHeader(w, HeaderTemplateData{Title: rolesTitle})
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	err = executeRolesBody(w, rtd)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	err = executeFooter(w)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+}
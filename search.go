@@ -0,0 +1,581 @@
+package main
+
+// search.go maintains the search index and produces the search page.
+//
+// Every topic and every piece of media has a search document in the search
+// documents bucket, which holds the terms of the document along with their
+// weights. The terms of a topic come from its name, title, description, and
+// the titles of its media. The terms of a piece of media come from its title,
+// the titles of its elaborations, and any text that was extracted from the
+// upload.
+//
+// The inverted index lives in the search index bucket under the key
+// [term][0][kind:name], with the weight of the term in the document as the
+// value, so that all of the documents containing a term can be found with a
+// prefix scan. The documents and the index are updated by putTopic,
+// deleteTopic, and putMediaMetadata, which keeps them in step with the data
+// they describe inside the same transaction. The number of documents, which
+// tf-idf needs for every query, is kept as the sequence of the search
+// documents bucket so that it does not have to be counted.
+//
+// Results are ranked by how many of the query terms a document contains, and
+// then by tf-idf.
+
+import (
+	"bytes"
+	"encoding/json"
+	"html/template"
+	"io"
+	"math"
+	"net/http"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/boltdb/bolt"
+	"golang.org/x/text/unicode/norm"
+)
+
+const (
+	searchPage = "/search"
+
+	searchTitle = "Search"
+
+	maxSearchResults = 50
+
+	// maxIndexedTextLen limits how much of the text extracted from an
+	// upload is indexed.
+	maxIndexedTextLen = 256 << 10 // 256 KB
+
+	// The weights given to the terms of each part of a document.
+	weightBody     = 1
+	weightChildren = 2
+	weightTitle    = 3
+
+	// snippetContext is the number of bytes of text shown ahead of the first
+	// match in a snippet, and snippetLen is the total length of a snippet.
+	snippetContext = 60
+	snippetLen     = 240
+)
+
+var (
+	searchTpl = filepath.Join(dirTemplates, "search.tpl")
+
+	// stopWords are terms that are too common to be worth indexing.
+	stopWords = map[string]bool{
+		"an": true, "and": true, "are": true, "as": true, "at": true,
+		"be": true, "by": true, "for": true, "from": true, "in": true,
+		"is": true, "it": true, "of": true, "on": true, "or": true,
+		"that": true, "the": true, "this": true, "to": true, "was": true,
+		"with": true,
+	}
+)
+
+// searchDocument is the entry in the search documents bucket for a topic or a
+// piece of media. Body is the text that snippets are cut from, and Text is
+// the text extracted from an upload, which is kept so that the document can
+// be rebuilt when the metadata of the media changes.
+type searchDocument struct {
+	Kind  string
+	Name  string
+	Title string
+	Body  string
+	Text  string
+
+	Terms map[string]float64
+}
+
+// snippetPart is a piece of a snippet. Parts that match a query term are
+// highlighted on the search page.
+type snippetPart struct {
+	Text  string
+	Match bool
+}
+
+// searchResult is a single result on the search page.
+type searchResult struct {
+	Kind    string
+	Title   string
+	URL     string
+	Score   float64
+	Snippet []snippetPart
+
+	matched int
+}
+
+// searchTemplateData defines the data which is used to fill out the search
+// template file.
+type searchTemplateData struct {
+	Query      string
+	SearchPage string
+
+	Results []searchResult
+}
+
+// isWordRune returns whether a rune is part of a word.
+func isWordRune(c rune) bool {
+	return unicode.IsLetter(c) || unicode.IsDigit(c)
+}
+
+// normalizeTerm converts a word into the form that it is indexed under.
+func normalizeTerm(word string) string {
+	return strings.ToLower(norm.NFKC.String(word))
+}
+
+// searchTerms splits text into the terms that are indexed, dropping terms
+// that are too short or too common to be useful.
+func searchTerms(text string) []string {
+	var terms []string
+	for _, word := range strings.FieldsFunc(text, func(c rune) bool { return !isWordRune(c) }) {
+		term := normalizeTerm(word)
+		if utf8.RuneCountInString(term) < 2 || stopWords[term] {
+			continue
+		}
+		terms = append(terms, term)
+	}
+	return terms
+}
+
+// addTerms adds the terms of text to a document with the provided weight.
+func (doc *searchDocument) addTerms(text string, weight float64) {
+	if doc.Terms == nil {
+		doc.Terms = make(map[string]float64)
+	}
+	for _, term := range searchTerms(text) {
+		doc.Terms[term] += weight
+	}
+}
+
+// searchDocKey returns the key of a document in the search documents bucket.
+func searchDocKey(kind, name string) []byte {
+	return []byte(kind + ":" + name)
+}
+
+// postingKey returns the key of a term of a document in the search index
+// bucket.
+func postingKey(term string, docKey []byte) []byte {
+	return append([]byte(term+"\x00"), docKey...)
+}
+
+// getSearchDocument returns the search document stored under a key.
+func getSearchDocument(tx *bolt.Tx, key []byte) (doc searchDocument, exists bool, err error) {
+	docBytes := tx.Bucket(bucketSearchDocs).Get(key)
+	if docBytes == nil {
+		return searchDocument{}, false, nil
+	}
+	err = json.Unmarshal(docBytes, &doc)
+	if err != nil {
+		return searchDocument{}, true, err
+	}
+	return doc, true, nil
+}
+
+// indexDocument stores a search document, updating the index entries of any
+// terms that were added, removed, or reweighted since the document was last
+// stored.
+func indexDocument(tx *bolt.Tx, doc searchDocument) error {
+	key := searchDocKey(doc.Kind, doc.Name)
+	docBytes, err := json.Marshal(doc)
+	if err != nil {
+		return err
+	}
+	bd := tx.Bucket(bucketSearchDocs)
+	oldBytes := bd.Get(key)
+	if bytes.Equal(oldBytes, docBytes) {
+		// Most writes, such as votes, do not change the document.
+		return nil
+	}
+	var old searchDocument
+	if oldBytes != nil {
+		err = json.Unmarshal(oldBytes, &old)
+		if err != nil {
+			return err
+		}
+	}
+
+	bi := tx.Bucket(bucketSearchIndex)
+	for term := range old.Terms {
+		if _, ok := doc.Terms[term]; ok {
+			continue
+		}
+		err = bi.Delete(postingKey(term, key))
+		if err != nil {
+			return err
+		}
+	}
+	for term, weight := range doc.Terms {
+		if old.Terms[term] == weight {
+			continue
+		}
+		err = bi.Put(postingKey(term, key), []byte(strconv.FormatFloat(weight, 'g', -1, 64)))
+		if err != nil {
+			return err
+		}
+	}
+	if oldBytes == nil {
+		err = bd.SetSequence(bd.Sequence() + 1)
+		if err != nil {
+			return err
+		}
+	}
+	return bd.Put(key, docBytes)
+}
+
+// removeSearchDocument removes a document and its terms from the index.
+func removeSearchDocument(tx *bolt.Tx, kind, name string) error {
+	key := searchDocKey(kind, name)
+	old, exists, err := getSearchDocument(tx, key)
+	if err != nil || !exists {
+		return err
+	}
+	bi := tx.Bucket(bucketSearchIndex)
+	for term := range old.Terms {
+		err = bi.Delete(postingKey(term, key))
+		if err != nil {
+			return err
+		}
+	}
+	bd := tx.Bucket(bucketSearchDocs)
+	if bd.Sequence() > 0 {
+		err = bd.SetSequence(bd.Sequence() - 1)
+		if err != nil {
+			return err
+		}
+	}
+	return bd.Delete(key)
+}
+
+// indexTopic updates the search document of a topic.
+func indexTopic(tx *bolt.Tx, topic string, td topicData) error {
+	doc := searchDocument{
+		Kind:  itemKindTopic,
+		Name:  topic,
+		Title: td.Title,
+		Body:  td.Description,
+	}
+	if doc.Title == "" {
+		doc.Title = topicTitleFromName(topic)
+	}
+	doc.addTerms(topic, weightTitle)
+	doc.addTerms(td.Title, weightTitle)
+	doc.addTerms(td.Description, weightBody)
+	var mediaTitles []string
+	for _, mr := range visibleMedia(td.AssociatedMedia) {
+		doc.addTerms(mr.Title, weightChildren)
+		mediaTitles = append(mediaTitles, mr.Title)
+	}
+	if doc.Body == "" {
+		doc.Body = strings.Join(mediaTitles, " - ")
+	}
+	return indexDocument(tx, doc)
+}
+
+// mediaDocument builds the search document of a piece of media.
+func mediaDocument(hash string, mm mediaMetadata, text string) searchDocument {
+	doc := searchDocument{
+		Kind:  itemKindMedia,
+		Name:  hash,
+		Title: mm.Title,
+		Body:  text,
+		Text:  text,
+	}
+	doc.addTerms(mm.Title, weightTitle)
+	var elaborationTitles []string
+	for _, me := range visibleElaborations(mm.Elaborations) {
+		doc.addTerms(me.Title, weightChildren)
+		elaborationTitles = append(elaborationTitles, me.Title)
+	}
+	doc.addTerms(text, weightBody)
+	if doc.Body == "" {
+		doc.Body = strings.Join(elaborationTitles, " - ")
+	}
+	return doc
+}
+
+// indexMedia updates the search document of a piece of media, keeping the
+// text that was previously extracted from the upload.
+func indexMedia(tx *bolt.Tx, hash string, mm mediaMetadata) error {
+	old, _, err := getSearchDocument(tx, searchDocKey(itemKindMedia, hash))
+	if err != nil {
+		return err
+	}
+	return indexDocument(tx, mediaDocument(hash, mm, old.Text))
+}
+
+// indexMediaText sets the text extracted from an upload and updates the
+// search document of the media.
+func indexMediaText(tx *bolt.Tx, hash, text string) error {
+	mm, _, err := getMediaMetadata(tx, hash)
+	if err != nil {
+		return err
+	}
+	if len(text) > maxIndexedTextLen {
+		text = strings.ToValidUTF8(text[:maxIndexedTextLen], "")
+	}
+	return indexDocument(tx, mediaDocument(hash, mm, text))
+}
+
+// countSearchDocuments sets the number of search documents for databases
+// whose search index was built before the number was kept.
+func countSearchDocuments(tx *bolt.Tx) error {
+	bd := tx.Bucket(bucketSearchDocs)
+	if bd.Sequence() != 0 {
+		return nil
+	}
+	return bd.SetSequence(uint64(bd.Stats().KeyN))
+}
+
+// indexEverything builds the search documents of every topic and piece of
+// media. It is used to build the index of databases that predate it.
+func indexEverything(tx *bolt.Tx) error {
+	var topics, media []string
+	err := tx.Bucket(bucketTopics).ForEach(func(k, v []byte) error {
+		topics = append(topics, string(k))
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	err = tx.Bucket(bucketMedia).ForEach(func(k, v []byte) error {
+		media = append(media, string(k))
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	for _, name := range topics {
+		td, _, err := getTopic(tx, name)
+		if err != nil {
+			return err
+		}
+		err = indexTopic(tx, name, td)
+		if err != nil {
+			return err
+		}
+	}
+	for _, hash := range media {
+		mm, _, err := getMediaMetadata(tx, hash)
+		if err != nil {
+			return err
+		}
+		err = indexMedia(tx, hash, mm)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// buildSnippet cuts the part of body around the first query term out of the
+// body, marking every query term in it.
+func buildSnippet(body string, terms map[string]bool) []snippetPart {
+	// Find the byte span of every word in the body.
+	var spans [][2]int
+	start := -1
+	for i, c := range body {
+		if isWordRune(c) {
+			if start < 0 {
+				start = i
+			}
+			continue
+		}
+		if start >= 0 {
+			spans = append(spans, [2]int{start, i})
+			start = -1
+		}
+	}
+	if start >= 0 {
+		spans = append(spans, [2]int{start, len(body)})
+	}
+	if len(spans) == 0 {
+		return nil
+	}
+
+	// Start the snippet a little ahead of the first match.
+	first := 0
+	for i, span := range spans {
+		if terms[normalizeTerm(body[span[0]:span[1]])] {
+			first = i
+			break
+		}
+	}
+	from := spans[first][0]
+	for i := first; i >= 0 && spans[first][0]-spans[i][0] <= snippetContext; i-- {
+		from = spans[i][0]
+	}
+	to := len(body)
+	if from+snippetLen < to {
+		to = from + snippetLen
+		for _, span := range spans {
+			if span[0] < to && span[1] > to {
+				to = span[1]
+			}
+		}
+	}
+
+	var parts []snippetPart
+	if from > 0 {
+		parts = append(parts, snippetPart{Text: "... "})
+	}
+	pos := from
+	for _, span := range spans {
+		if span[0] < from || span[1] > to {
+			continue
+		}
+		if !terms[normalizeTerm(body[span[0]:span[1]])] {
+			continue
+		}
+		if span[0] > pos {
+			parts = append(parts, snippetPart{Text: body[pos:span[0]]})
+		}
+		parts = append(parts, snippetPart{Text: body[span[0]:span[1]], Match: true})
+		pos = span[1]
+	}
+	if pos < to {
+		parts = append(parts, snippetPart{Text: body[pos:to]})
+	}
+	if to < len(body) {
+		parts = append(parts, snippetPart{Text: " ..."})
+	}
+	return parts
+}
+
+// search finds the documents that match a query, best match first.
+func search(tx *bolt.Tx, query string) ([]searchResult, error) {
+	terms := make(map[string]bool)
+	for _, term := range searchTerms(query) {
+		terms[term] = true
+	}
+	if len(terms) == 0 {
+		return nil, nil
+	}
+
+	numDocs := float64(tx.Bucket(bucketSearchDocs).Sequence())
+	results := make(map[string]*searchResult)
+	c := tx.Bucket(bucketSearchIndex).Cursor()
+	for term := range terms {
+		prefix := []byte(term + "\x00")
+		type posting struct {
+			key    string
+			weight float64
+		}
+		var postings []posting
+		for k, v := c.Seek(prefix); k != nil && bytes.HasPrefix(k, prefix); k, v = c.Next() {
+			weight, err := strconv.ParseFloat(string(v), 64)
+			if err != nil {
+				return nil, err
+			}
+			postings = append(postings, posting{string(k[len(prefix):]), weight})
+		}
+		idf := math.Log(1 + numDocs/float64(len(postings)))
+		for _, p := range postings {
+			sr, ok := results[p.key]
+			if !ok {
+				sr = &searchResult{}
+				results[p.key] = sr
+			}
+			sr.matched++
+			sr.Score += (1 + math.Log(p.weight)) * idf
+		}
+	}
+
+	var keys []string
+	for key := range results {
+		keys = append(keys, key)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		a, b := results[keys[i]], results[keys[j]]
+		if a.matched != b.matched {
+			return a.matched > b.matched
+		}
+		if a.Score != b.Score {
+			return a.Score > b.Score
+		}
+		return keys[i] < keys[j]
+	})
+
+	var ranked []searchResult
+	for _, key := range keys {
+		if len(ranked) == maxSearchResults {
+			break
+		}
+		doc, exists, err := getSearchDocument(tx, []byte(key))
+		if err != nil {
+			return nil, err
+		}
+		if !exists {
+			continue
+		}
+		if doc.Kind == itemKindMedia {
+			// Media that has been hidden everywhere it was submitted is
+			// left out of the results.
+			mm, _, err := getMediaMetadata(tx, doc.Name)
+			if err != nil {
+				return nil, err
+			}
+			if mm.Hidden {
+				continue
+			}
+		}
+		sr := results[key]
+		sr.Kind = doc.Kind
+		sr.Title = doc.Title
+		sr.Snippet = buildSnippet(doc.Body, terms)
+		if doc.Kind == itemKindTopic {
+			sr.URL = topicURL(doc.Name)
+		} else {
+			sr.URL = elaborationPrefix + doc.Name
+		}
+		ranked = append(ranked, *sr)
+	}
+	return ranked, nil
+}
+
+// executeSearchBody builds the body portion of the search page.
+func executeSearchBody(w io.Writer, std searchTemplateData) error {
+	t, err := template.ParseFiles(searchTpl)
+	if err != nil {
+		return err
+	}
+	return t.Execute(w, std)
+}
+
+// searchHandler handles requests for the search page.
+func (h *herus) searchHandler(w http.ResponseWriter, r *http.Request) {
+	std := searchTemplateData{
+		Query:      r.URL.Query().Get("q"),
+		SearchPage: searchPage,
+	}
+	err := h.db.View(func(tx *bolt.Tx) error {
+		var err error
+		std.Results, err = search(tx, std.Query)
+		return err
+	})
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	title := searchTitle
+	if std.Query != "" {
+		title += ": " + std.Query
+	}
+	err = executeHeader(w, HeaderTemplateData{Title: title})
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	err = executeSearchBody(w, std)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	err = executeFooter(w)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+}
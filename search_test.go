@@ -0,0 +1,57 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/boltdb/bolt"
+)
+
+// TestSearchDocumentCount checks that the number of search documents is kept
+// in step as documents are added, updated, and removed.
+func TestSearchDocumentCount(t *testing.T) {
+	db := newTestDB(t)
+	err := db.Update(func(tx *bolt.Tx) error {
+		count := func(want uint64) {
+			t.Helper()
+			if got := tx.Bucket(bucketSearchDocs).Sequence(); got != want {
+				t.Errorf("document count is %v, want %v", got, want)
+			}
+		}
+		err := indexTopic(tx, "calculus", topicData{Description: "limits and derivatives"})
+		if err != nil {
+			return err
+		}
+		err = indexTopic(tx, "algebra", topicData{Description: "groups"})
+		if err != nil {
+			return err
+		}
+		count(2)
+		err = indexTopic(tx, "calculus", topicData{Description: "integrals"})
+		if err != nil {
+			return err
+		}
+		count(2)
+		err = removeSearchDocument(tx, itemKindTopic, "calculus")
+		if err != nil {
+			return err
+		}
+		count(1)
+		err = removeSearchDocument(tx, itemKindTopic, "calculus")
+		if err != nil {
+			return err
+		}
+		count(1)
+
+		results, err := search(tx, "groups")
+		if err != nil {
+			return err
+		}
+		if len(results) != 1 || results[0].Title != "Algebra" {
+			t.Errorf("search for groups found %v, want algebra", results)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,251 @@
+package main
+
+// session.go tracks logged in users. Each session is stored in the sessions
+// bucket, keyed by the hash of the token that is handed to the browser in a
+// cookie, so that the contents of the database cannot be used to hijack a
+// session.
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/boltdb/bolt"
+)
+
+const (
+	// sessionCookie is the name of the cookie that holds the session token
+	// of a logged in user.
+	sessionCookie = "herus_session"
+
+	sessionDuration      = 30 * 24 * time.Hour
+	sessionPruneInterval = time.Hour
+	sessionTokenLen      = 32
+)
+
+// userContextKey is the key under which the user making a request is stored
+// in the request context.
+type userContextKey struct{}
+
+// session is the information stored in the database about a logged in
+// session.
+type session struct {
+	Name    string
+	Created time.Time
+	Expires time.Time
+}
+
+// sessionKey returns the database key for a session token.
+func sessionKey(token string) []byte {
+	hash := sha256.Sum256([]byte(token))
+	return []byte(hex.EncodeToString(hash[:]))
+}
+
+// getSession returns the session associated with a token. Expired sessions are
+// reported as not existing.
+func getSession(tx *bolt.Tx, token string) (s session, exists bool, err error) {
+	bs := tx.Bucket(bucketSessions)
+	sessionBytes := bs.Get(sessionKey(token))
+	if sessionBytes == nil {
+		return session{}, false, nil
+	}
+	err = json.Unmarshal(sessionBytes, &s)
+	if err != nil {
+		return session{}, true, err
+	}
+	if time.Now().After(s.Expires) {
+		return session{}, false, nil
+	}
+	return s, true, nil
+}
+
+// revokeUserSessions deletes every session belonging to the named user.
+func revokeUserSessions(tx *bolt.Tx, name string) error {
+	bs := tx.Bucket(bucketSessions)
+	var stale [][]byte
+	err := bs.ForEach(func(k, v []byte) error {
+		var s session
+		err := json.Unmarshal(v, &s)
+		if err != nil {
+			return err
+		}
+		if s.Name == name {
+			stale = append(stale, k)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	for _, k := range stale {
+		err = bs.Delete(k)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// currentUser returns the user that made the request, if the request was made
+// by a logged in user.
+func currentUser(r *http.Request) (User, bool) {
+	user, ok := r.Context().Value(userContextKey{}).(User)
+	return user, ok
+}
+
+// startSession creates a session for the user and hands the session token to
+// the browser.
+func (h *herus) startSession(w http.ResponseWriter, r *http.Request, user User) error {
+	token, err := randomHex(sessionTokenLen)
+	if err != nil {
+		return err
+	}
+	s := session{
+		Name:    user.Name,
+		Created: time.Now(),
+		Expires: time.Now().Add(sessionDuration),
+	}
+	sessionBytes, err := json.Marshal(s)
+	if err != nil {
+		return err
+	}
+	err = h.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(bucketSessions).Put(sessionKey(token), sessionBytes)
+	})
+	if err != nil {
+		return err
+	}
+
+	http.SetCookie(w, &http.Cookie{
+		Name:     sessionCookie,
+		Value:    token,
+		Path:     "/",
+		Expires:  s.Expires,
+		HttpOnly: true,
+		Secure:   r.TLS != nil,
+		SameSite: http.SameSiteLaxMode,
+	})
+	return nil
+}
+
+// sessionMiddleware looks up the session attached to each request and, if the
+// session is valid and the user is not suspended, adds the logged in user to
+// the request context. Requests that carry an API token instead have the
+// token added to the request context, see token.go.
+func (h *herus) sessionMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if token, ok := bearerToken(r); ok {
+			tr, valid, err := h.tokenUser(token)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			if !valid {
+				w.Header().Set("WWW-Authenticate", "Bearer")
+				http.Error(w, errInvalidToken.Error(), http.StatusUnauthorized)
+				return
+			}
+			r = r.WithContext(context.WithValue(r.Context(), tokenContextKey{}, tr))
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		cookie, err := r.Cookie(sessionCookie)
+		if err != nil {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		var user User
+		var exists bool
+		err = h.db.View(func(tx *bolt.Tx) error {
+			s, sessionExists, err := getSession(tx, cookie.Value)
+			if err != nil || !sessionExists {
+				return err
+			}
+			user, exists, err = getUser(tx, s.Name)
+			return err
+		})
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if exists && !user.Suspended {
+			r = r.WithContext(context.WithValue(r.Context(), userContextKey{}, user))
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// logoutHandler ends the session of the requesting user. Only POST requests
+// are accepted so that other sites cannot log users out with a link or image.
+func (h *herus) logoutHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "logging out must be done with a POST request", http.StatusMethodNotAllowed)
+		return
+	}
+	cookie, err := r.Cookie(sessionCookie)
+	if err == nil {
+		err = h.db.Update(func(tx *bolt.Tx) error {
+			return tx.Bucket(bucketSessions).Delete(sessionKey(cookie.Value))
+		})
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+	http.SetCookie(w, &http.Cookie{
+		Name:     sessionCookie,
+		Value:    "",
+		Path:     "/",
+		MaxAge:   -1,
+		HttpOnly: true,
+		Secure:   r.TLS != nil,
+		SameSite: http.SameSiteLaxMode,
+	})
+	http.Redirect(w, r, indexPage, http.StatusSeeOther)
+}
+
+// pruneSessions deletes all of the expired sessions from the database.
+func (h *herus) pruneSessions() error {
+	return h.db.Update(func(tx *bolt.Tx) error {
+		bs := tx.Bucket(bucketSessions)
+		var stale [][]byte
+		err := bs.ForEach(func(k, v []byte) error {
+			var s session
+			err := json.Unmarshal(v, &s)
+			if err != nil {
+				return err
+			}
+			if time.Now().After(s.Expires) {
+				stale = append(stale, k)
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		for _, k := range stale {
+			err = bs.Delete(k)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// threadedPruneSessions clears out expired sessions at regular intervals.
+func (h *herus) threadedPruneSessions() {
+	for {
+		err := h.pruneSessions()
+		if err != nil {
+			fmt.Println(err)
+		}
+		time.Sleep(sessionPruneInterval)
+	}
+}
@@ -0,0 +1,13 @@
+	{{if .ErrorExists}}
+	<center><h2>{{.Error}}</h2></center><br><br>
+	{{end}}
+	{{if .PostWithoutError}}
+	<center><h2>Thanks! <a href='{{.TopicPrefix}}{{.Alias}}'>{{.Alias}}</a> now leads to <a href='{{.TopicPrefix}}{{.Topic}}'>{{.Topic}}</a>.</h2></center><br><br>
+	{{end}}
+
+	<p>An alias lets another name, such as an abbreviation, lead to an existing topic.</p>
+	<form action='alias.go' method='post'>
+		Alias: <input type='text' name='alias' value='{{.Alias}}'><br>
+		Topic: <input type='text' name='topic' value='{{.Topic}}'><br>
+		<input type='submit' value='Add Alias'><br>
+	</form>
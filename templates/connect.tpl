@@ -6,7 +6,14 @@
 	{{end}}
 
 	<form action='connect.go' method='post'>
-		Source Topic: <input type='test' name='sourceTopic'><br>
-		Destination Topic: <input type='text' name='destinationTopic'></br>
+		Source Topic: <input type='text' name='sourceTopic' data-suggest='topic' autocomplete='off'><br>
+		Destination Topic: <input type='text' name='destinationTopic' data-suggest='topic' autocomplete='off'></br>
+		Relation: <select name='relation'>
+			<option value='related-to'>is related to</option>
+			<option value='prerequisite-of'>is a prerequisite of</option>
+			<option value='part-of'>is part of</option>
+			<option value='alternative-to'>is an alternative to</option>
+		</select><br>
 		<input type='submit' value='Connect'><br>
 	</form>
+	<script src='/web-assets/suggest.js'></script>
@@ -0,0 +1,11 @@
+	{{if .ErrorExists}}
+	<center><h2>{{.Error}}</h2></center><br><br>
+	{{end}}
+
+	<p>Descriptions are written in markdown.</p>
+	<form action='{{.Action}}' method='post'>
+		Topic Title: <input type='text' name='title' value='{{.Title}}'><br>
+		Description:<br>
+		<textarea name='description' rows='15' cols='80'>{{.Description}}</textarea><br>
+		<input type='submit' value='{{if .Editing}}Save{{else}}Create{{end}}'><br>
+	</form>
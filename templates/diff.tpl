@@ -0,0 +1,6 @@
+	<center><h1>{{.Title}}</h1></center>
+	<center><a href='{{.TopicPrefix}}{{.Name}}/history'>Back to history</a></center>
+	<br>
+	<center><h2>Revision {{.From}} to {{.To}}</h2></center>
+	<pre class='diff'>{{range .Diff}}<span class='diff-line{{if eq .Op "+"}} diff-add{{else if eq .Op "-"}} diff-remove{{end}}'>{{.Op}} {{.Text}}</span>
+{{end}}</pre>
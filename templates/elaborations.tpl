@@ -1,10 +1,59 @@
-	<br><br><br>
-	<center><a href='{{.MediaPrefix}}{{.Hash}}'>{{.Hash}}</a><br></center>
+	<br>
+	<center>
+		<h1>{{.Title}}</h1>
+		{{.Preview.SizeText}}{{if .Submitter}} - uploaded by <a href='{{.UserPrefix}}{{.Submitter}}'>{{.Submitter}}</a>{{end}}{{if not .SubmissionDate.IsZero}} on {{.SubmissionDate.Format "2006-01-02"}}{{end}}
+		- <a href='{{.MediaPrefix}}{{.Hash}}'>{{if .Preview.Kind}}Open original{{else}}Download{{end}}</a>{{if .HasText}}
+		- <a href='{{.MediaPrefix}}{{.Hash}}/text'>Text</a>{{end}}
+	</center>
+	<div class='media-preview'>
+		{{if eq .Preview.Kind "image"}}
+		<img src='{{.MediaPrefix}}{{.Hash}}' alt='{{.Title}}'>
+		{{else if eq .Preview.Kind "audio"}}
+		<audio controls preload='metadata' src='{{.MediaPrefix}}{{.Hash}}'></audio>
+		{{else if eq .Preview.Kind "video"}}
+		<video controls preload='metadata' src='{{.MediaPrefix}}{{.Hash}}'></video>
+		{{else if eq .Preview.Kind "pdf"}}
+		<iframe class='media-pdf' src='{{.MediaPrefix}}{{.Hash}}' title='{{.Title}}'></iframe>
+		{{else if eq .Preview.Kind "code"}}
+		<div class='media-language'>{{.Preview.Language}}</div>
+		<pre class='media-text'><code>{{.Preview.Code}}</code></pre>
+		{{else if eq .Preview.Kind "markdown"}}
+		<div class='media-markdown'>{{.Preview.Markdown}}</div>
+		{{else if eq .Preview.Kind "text"}}
+		<pre class='media-text'>{{.Preview.Text}}</pre>
+		{{else}}
+		<center>This media cannot be shown in the browser.</center>
+		{{end}}
+		{{if .Preview.Truncated}}
+		<center><a href='{{.MediaPrefix}}{{.Hash}}'>Only the start of this file is shown - open the original to see all of it.</a></center>
+		{{end}}
+	</div>
 	<br>
 	<center><h2>Annotations and Elaborations</h2></center>
+	<center class='sort-links'>Sort by:
+		{{if eq .Sort "top"}}<b>Top</b>{{else}}<a href='?sort=top'>Top</a>{{end}}
+		{{if eq .Sort "new"}}<b>New</b>{{else}}<a href='?sort=new'>New</a>{{end}}
+		{{if eq .Sort "controversial"}}<b>Controversial</b>{{else}}<a href='?sort=controversial'>Controversial</a>{{end}}
+	</center>
 	<center>
-		{{range .Elaborations}}
-		<a href='{{$.ElaborationPrefix}}{{.Hash}}'>{{.Title}}</a><br>
+		{{range $elaboration := .Elaborations}}
+		<form class='vote-form' action='{{$.VotePage}}' method='post'>
+			<input type='hidden' name='kind' value='elaboration'>
+			<input type='hidden' name='page' value='{{$.Hash}}'>
+			<input type='hidden' name='item' value='{{.Hash}}'>
+			<button type='submit' name='value' value='up'>+</button>
+			<button type='submit' name='value' value='down'>-</button>
+			<button type='submit' name='value' value='none'>x</button>
+		</form>
+		{{with index $.Thumbnails .Hash}}<a href='{{$.ElaborationPrefix}}{{$elaboration.Hash}}'><img class='media-thumbnail' src='{{.}}' alt=''></a>{{end}}
+		<a href='{{$.ElaborationPrefix}}{{.Hash}}'>{{.Title}}</a> ({{.Upvotes}} up, {{.Downvotes}} down)
+		<form class='vote-form' action='{{$.FlagPage}}' method='post'>
+			<input type='hidden' name='kind' value='elaboration'>
+			<input type='hidden' name='page' value='{{$.Hash}}'>
+			<input type='hidden' name='item' value='{{.Hash}}'>
+			<button type='submit'>Flag</button>
+		</form>
+		<br>
 		{{end}}
 	</center>
 	<br><br><br>
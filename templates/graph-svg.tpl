@@ -0,0 +1,25 @@
+<svg xmlns='http://www.w3.org/2000/svg' class='topic-graph' width='{{.Width}}' height='{{.Height}}' viewBox='0 0 {{.Width}} {{.Height}}'>
+	<defs>
+		<marker id='graph-arrow' viewBox='0 0 10 10' refX='24' refY='5' markerWidth='8' markerHeight='8' orient='auto'>
+			<path d='M 0 0 L 10 5 L 0 10 z' fill='#888'></path>
+		</marker>
+	</defs>
+	<style>
+		.graph-edge { stroke: #888; stroke-width: 1.5; }
+		.graph-edge-prerequisite-of { stroke: #c0392b; }
+		.graph-edge-part-of { stroke: #2980b9; }
+		.graph-edge-alternative-to { stroke-dasharray: 4 4; }
+		.graph-node circle { fill: #fff; stroke: #333; stroke-width: 1.5; }
+		.graph-root circle { fill: #f1c40f; }
+		.graph-node text { font: 12px sans-serif; text-anchor: middle; }
+	</style>
+	{{range .Graph.Edges}}
+	<line class='graph-edge graph-edge-{{.Type}}' x1='{{.X1}}' y1='{{.Y1}}' x2='{{.X2}}' y2='{{.Y2}}' marker-end='url(#graph-arrow)'><title>{{.Source}} {{.Type}} {{.Target}}</title></line>
+	{{end}}
+	{{range .Graph.Nodes}}
+	<a href='{{$.GraphPrefix}}{{.Name}}?depth={{$.Depth}}' class='graph-node{{if eq .Depth 0}} graph-root{{end}}'>
+		<circle cx='{{.X}}' cy='{{.Y}}' r='14'></circle>
+		<text x='{{.X}}' y='{{.Y}}' dy='28'>{{.Title}}</text>
+	</a>
+	{{end}}
+</svg>
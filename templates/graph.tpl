@@ -0,0 +1,11 @@
+	<center><h1>{{.Title}}</h1></center>
+	<center>
+		Depth:
+		{{range $d := .DepthOptions}}
+			{{if eq $d $.Depth}}<b>{{$d}}</b>{{else}}<a href='?depth={{$d}}'>{{$d}}</a>{{end}}
+		{{end}}
+		- <a href='{{.TopicPrefix}}{{.Graph.Root}}'>Back to Topic</a>
+		- <a href='?depth={{.Depth}}&amp;format=json'>JSON</a>
+		- <a href='?depth={{.Depth}}&amp;format=svg'>SVG</a>
+	</center>
+	<center>{{template "graph-svg.tpl" .}}</center>
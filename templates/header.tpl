@@ -18,7 +18,22 @@
 		<a href='/index.go' class='pure-menu-heading'><img src='/web-assets/circle.png' height='40px'></a>
 		<ul class='pure-menu-list'>
 			<li class='pure-menu-item'><a href='/index.go' class='pure-menu-link'>Home</a></li>
+			<li class='pure-menu-item'><a href='/create.go' class='pure-menu-link'>New-Topic</a></li>
 			<li class='pure-menu-item'><a href='/connect.go' class='pure-menu-link'>Link-Topics</a></li>
 			<li class='pure-menu-item'><a href='/upload.go' class='pure-menu-link'>Upload</a></li>
+			<li class='pure-menu-item'><a href='/moderate.go' class='pure-menu-link'>Moderate</a></li>
+			<li class='pure-menu-item'><a href='/roles.go' class='pure-menu-link'>Roles</a></li>
+			<li class='pure-menu-item'><a href='/login.go' class='pure-menu-link'>Log In</a></li>
+			<li class='pure-menu-item'><a href='/register.go' class='pure-menu-link'>Register</a></li>
+			<li class='pure-menu-item'><a href='/password.go' class='pure-menu-link'>Password</a></li>
+			<li class='pure-menu-item'><a href='/settings.go' class='pure-menu-link'>Settings</a></li>
+			<li class='pure-menu-item'>
+				<form class='logout-form' action='/logout.go' method='post'>
+					<button type='submit' class='pure-menu-link'>Log Out</button>
+				</form>
+			</li>
 		</ul>
+		<form class='pure-form header-search' action='/search' method='get'>
+			<input type='text' name='q' placeholder='Search'>
+		</form>
 	</div>
@@ -0,0 +1,27 @@
+	<center><h1>{{.Title}}</h1></center>
+	<center><a href='{{.TopicPrefix}}{{.Name}}'>Back to topic</a></center>
+	<br>
+	<form action='{{.TopicPrefix}}{{.Name}}/diff' method='get'>
+		Compare revision <input type='text' name='from' size='4'> to <input type='text' name='to' size='4'>
+		<input type='submit' value='Compare'>
+	</form>
+	<br>
+	<table class='pure-table'>
+		<tr><th>Revision</th><th>Date</th><th>Author</th><th>Changes</th>{{if .CanRevert}}<th></th>{{end}}</tr>
+		{{range .Revisions}}
+		<tr>
+			<td><a href='{{$.TopicPrefix}}{{$.Name}}/diff?to={{.ID}}'>{{.ID}}</a></td>
+			<td>{{.Date.Format "2006-01-02 15:04"}}</td>
+			<td>{{.Author}}</td>
+			<td>+{{.Added}} -{{.Removed}}</td>
+			{{if $.CanRevert}}
+			<td>
+				<form action='{{$.TopicPrefix}}{{$.Name}}/revert' method='post'>
+					<input type='hidden' name='revision' value='{{.ID}}'>
+					<input type='submit' value='Revert to this'>
+				</form>
+			</td>
+			{{end}}
+		</tr>
+		{{end}}
+	</table>
@@ -0,0 +1,10 @@
+	{{if .ErrorExists}}
+	<center><h2>{{.Error}}</h2></center><br><br>
+	{{end}}
+
+	<form action='login.go' method='post'>
+		Username: <input type='text' name='username' value='{{.Name}}'><br>
+		Password: <input type='password' name='password'><br>
+		<input type='submit' value='Log In'><br>
+	</form>
+	<p>Don't have an account? <a href='/register.go'>Register</a></p>
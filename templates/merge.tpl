@@ -0,0 +1,10 @@
+	{{if .ErrorExists}}
+	<center><h2>{{.Error}}</h2></center><br><br>
+	{{end}}
+
+	<p>Merging moves all of the media and related topics of the first topic onto the second, and leaves an alias behind so that links to the first topic keep working.</p>
+	<form action='{{.MergePage}}' method='post'>
+		Merge Topic: <input type='text' name='from' value='{{.From}}'><br>
+		Into Topic: <input type='text' name='into' value='{{.Into}}'><br>
+		<input type='submit' value='Merge'><br>
+	</form>
@@ -0,0 +1,43 @@
+	{{if .ErrorExists}}
+	<center><h2>{{.Error}}</h2></center><br><br>
+	{{end}}
+
+	<center><h2>Flagged Users</h2></center>
+	{{range .Users}}
+		<a href='{{$.UserPrefix}}{{.Name}}'>{{.Name}}</a> - {{.NumFlags}} flags{{if .Suspended}} - suspended{{end}}
+		<form class='vote-form' action='{{$.ModeratePage}}' method='post'>
+			<input type='hidden' name='user' value='{{.Name}}'>
+			{{if .Suspended}}
+			<button type='submit' name='action' value='reinstate'>Reinstate</button>
+			{{else}}
+			<button type='submit' name='action' value='suspend'>Suspend</button>
+			{{end}}
+			<button type='submit' name='action' value='clearFlags'>Clear Flags</button>
+		</form><br>
+		{{range .Flags}}{{if .FlaggerName}}
+		&nbsp;&nbsp;flagged by {{.FlaggerName}} on {{.Time.Format "2006-01-02"}}<br>
+		{{end}}{{end}}
+	{{end}}
+	<br><br>
+	<center><h2>Flagged Submissions</h2></center>
+	{{range .Items}}
+		{{if eq .Kind "elaboration"}}
+		<a href='{{$.ElaborationPrefix}}{{.Item}}'>{{.Title}}</a> on <a href='{{$.ElaborationPrefix}}{{.Page}}'>{{.Page}}</a>
+		{{else if eq .Kind "media"}}
+		<a href='{{$.ElaborationPrefix}}{{.Item}}'>{{.Title}}</a> in <a href='{{$.TopicPrefix}}{{.Page}}'>{{.Page}}</a>
+		{{else}}
+		<a href='{{$.TopicPrefix}}{{.Page}}'>{{.Page}}</a> to <a href='{{$.TopicPrefix}}{{.Item}}'>{{.Item}}</a>
+		{{end}}
+		- {{len .Flags}} flags{{if .Hidden}} - hidden{{end}}
+		<form class='vote-form' action='{{$.ModeratePage}}' method='post'>
+			<input type='hidden' name='kind' value='{{.Kind}}'>
+			<input type='hidden' name='page' value='{{.Page}}'>
+			<input type='hidden' name='item' value='{{.Item}}'>
+			{{if .Hidden}}
+			<button type='submit' name='action' value='unhide'>Unhide</button>
+			{{else}}
+			<button type='submit' name='action' value='hide'>Hide</button>
+			{{end}}
+			<button type='submit' name='action' value='dismiss'>Dismiss</button>
+		</form><br>
+	{{end}}
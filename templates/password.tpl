@@ -0,0 +1,13 @@
+	{{if .ErrorExists}}
+	<center><h2>{{.Error}}</h2></center><br><br>
+	{{end}}
+	{{if .PostWithoutError}}
+	<center><h2>Password changed. All other sessions have been logged out and all API tokens have been revoked.</h2></center><br><br>
+	{{end}}
+
+	<form action='password.go' method='post'>
+		Current Password: <input type='password' name='password'><br>
+		New Password: <input type='password' name='newPassword'><br>
+		Confirm New Password: <input type='password' name='confirmPassword'><br>
+		<input type='submit' value='Change Password'><br>
+	</form>
@@ -0,0 +1,27 @@
+	<center><h1>{{.Title}}</h1></center>
+	<center>Study these topics in order to learn <a href='{{.TopicPrefix}}{{.Name}}'>{{.Title}}</a>.</center>
+	{{if .Cycles}}
+	<div class='path-cycles'>
+		<h3>Prerequisite cycles</h3>
+		<p>These topics are prerequisites of each other, so the relation that closes each cycle was ignored when building the path.</p>
+		<ul>
+		{{range .Cycles}}
+			<li>{{range $i, $name := .}}{{if $i}} &rarr; {{end}}<a href='{{$.TopicPrefix}}{{$name}}'>{{$name}}</a>{{end}}</li>
+		{{end}}
+		</ul>
+	</div>
+	{{end}}
+	<ol class='path-steps'>
+	{{range .Steps}}
+		<li>
+			<a href='{{$.TopicPrefix}}{{.Name}}'>{{.Title}}</a>
+			{{if .Media}}
+			<ul>
+			{{range .Media}}
+				<li><a href='{{$.ElaborationPrefix}}{{.Hash}}'>{{.Title}}</a> ({{.Upvotes}} up, {{.Downvotes}} down)</li>
+			{{end}}
+			</ul>
+			{{end}}
+		</li>
+	{{end}}
+	</ol>
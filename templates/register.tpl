@@ -0,0 +1,12 @@
+	{{if .ErrorExists}}
+	<center><h2>{{.Error}}</h2></center><br><br>
+	{{end}}
+
+	<form action='register.go' method='post'>
+		Username: <input type='text' name='username' value='{{.Name}}'><br>
+		Email: <input type='text' name='email' value='{{.Email}}'><br>
+		Password: <input type='password' name='password'><br>
+		Confirm Password: <input type='password' name='confirmPassword'><br>
+		<input type='submit' value='Register'><br>
+	</form>
+	<p>Already have an account? <a href='/login.go'>Log in</a></p>
@@ -0,0 +1,28 @@
+	{{if .ErrorExists}}
+	<center><h2>{{.Error}}</h2></center><br><br>
+	{{end}}
+
+	<center><h2>Members</h2></center>
+	<table class='pure-table'>
+		<tr><th>Name</th><th>Member Since</th><th>Current Role</th><th>Assign Role</th></tr>
+		{{range .Users}}
+		<tr>
+			<td><a href='{{$.UserPrefix}}{{.Name}}'>{{.Name}}</a></td>
+			<td>{{.DateStarted}}</td>
+			<td>{{.Role}}</td>
+			<td>
+				<form action='{{$.RolesPage}}' method='post'>
+					<input type='hidden' name='user' value='{{.Name}}'>
+					<select name='role'>
+						<option value='reader' {{if eq .MemberType "reader"}}selected{{end}}>Reader</option>
+						<option value='contributor' {{if eq .MemberType "contributor"}}selected{{end}}>Contributor</option>
+						<option value='moderator' {{if eq .MemberType "moderator"}}selected{{end}}>Moderator</option>
+						<option value='admin' {{if eq .MemberType "admin"}}selected{{end}}>Admin</option>
+					</select>
+					Ends: <input type='text' name='dateEnded' value='{{.DateEndedInput}}' placeholder='YYYY-MM-DD'>
+					<input type='submit' value='Save'>
+				</form>
+			</td>
+		</tr>
+		{{end}}
+	</table>
@@ -0,0 +1,16 @@
+	<form action='{{.SearchPage}}' method='get'>
+		<input type='text' name='q' value='{{.Query}}'>
+		<input type='submit' value='Search'>
+	</form>
+	{{if .Query}}
+	{{if .Results}}
+	{{range .Results}}
+	<div class='search-result'>
+		<a href='{{.URL}}'>{{.Title}}</a> <i>({{.Kind}})</i><br>
+		<span class='search-snippet'>{{range .Snippet}}{{if .Match}}<b>{{.Text}}</b>{{else}}{{.Text}}{{end}}{{end}}</span>
+	</div>
+	{{end}}
+	{{else}}
+	<center>Nothing matched '{{.Query}}'.</center>
+	{{end}}
+	{{end}}
@@ -0,0 +1,51 @@
+	{{if .ErrorExists}}
+	<center><h2>{{.Error}}</h2></center><br><br>
+	{{end}}
+	{{if .NewToken}}
+	<center>
+		<h2>Your new API token</h2>
+		<code>{{.NewToken}}</code><br>
+		Copy it now - it will not be shown again. Send it in the Authorization header as 'Bearer &lt;token&gt;'.
+	</center><br><br>
+	{{end}}
+
+	<center><h2>API Tokens</h2></center>
+	{{if .Tokens}}
+	<table class='pure-table'>
+		<tr><th>Name</th><th>Scopes</th><th>Created</th><th>Expires</th><th>Last Used</th><th></th></tr>
+		{{range .Tokens}}
+		<tr>
+			<td>{{.Name}}</td>
+			<td>{{range $i, $s := .Scopes}}{{if $i}}, {{end}}{{$s}}{{end}}</td>
+			<td>{{.Created.Format "2006-01-02"}}</td>
+			<td>{{if .Expired}}expired{{else}}{{.Expires.Format "2006-01-02"}}{{end}}</td>
+			<td>{{if .LastUsed.IsZero}}never{{else}}{{.LastUsed.Format "2006-01-02 15:04"}}{{end}}</td>
+			<td>
+				<form action='{{$.SettingsPage}}' method='post'>
+					<input type='hidden' name='revoke' value='{{.ID}}'>
+					<input type='submit' value='Revoke'>
+				</form>
+			</td>
+		</tr>
+		{{end}}
+	</table>
+	{{else}}
+	<center>You have no API tokens.</center>
+	{{end}}
+	<br>
+
+	<form action='{{.SettingsPage}}' method='post'>
+		Name: <input type='text' name='name'><br>
+		Scopes:
+		{{range .Scopes}}
+		<label><input type='checkbox' name='scope' value='{{.}}'> {{.}}</label>
+		{{end}}
+		<br>
+		Expires after:
+		<select name='days'>
+			{{range .ExpiryDays}}
+			<option value='{{.}}' {{if eq . $.DefaultDays}}selected{{end}}>{{.}} days</option>
+			{{end}}
+		</select><br>
+		<input type='submit' value='Generate Token'><br>
+	</form>
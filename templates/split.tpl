@@ -0,0 +1,20 @@
+	{{if .ErrorExists}}
+	<center><h2>{{.Error}}</h2></center><br><br>
+	{{end}}
+
+	{{if .Media}}
+	<p>The selected media will be moved out of <b>{{.Topic}}</b> and into a new topic.</p>
+	<form action='{{.SplitPage}}' method='post'>
+		<input type='hidden' name='topic' value='{{.Topic}}'>
+		New Topic Title: <input type='text' name='title' value='{{.Title}}'><br>
+		{{range .Media}}
+		<label><input type='checkbox' name='media' value='{{.Hash}}'> {{.Title}}</label><br>
+		{{end}}
+		<input type='submit' value='Split'><br>
+	</form>
+	{{else}}
+	<form action='{{.SplitPage}}' method='get'>
+		Topic: <input type='text' name='topic' value='{{.Topic}}'><br>
+		<input type='submit' value='List Media'><br>
+	</form>
+	{{end}}
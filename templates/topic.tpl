@@ -1,9 +1,79 @@
 	<center><h1>{{.Title}}</h1></center>
-	{{range .AssociatedMedia}}
-		<a href='{{$.ElaborationPrefix}}{{.Hash}}'>{{.Title}}</a><br>
+	{{if not .Exists}}
+	<center>This topic does not exist yet. <a href='{{.CreatePage}}?title={{.Title}}'>Create it</a></center>
+	{{end}}
+	<div class='topic-description'>{{.Description}}</div>
+	{{if .Exists}}
+	<center><a href='{{.TopicPrefix}}{{.Name}}{{.EditSuffix}}'>Edit</a> - <a href='{{.TopicPrefix}}{{.Name}}{{.HistorySuffix}}'>History</a> - <a href='{{.PathPrefix}}{{.Name}}'>Learning Path</a> - <a href='{{.GraphPrefix}}{{.Name}}'>Graph</a> - <a href='{{.AliasPage}}?topic={{.Name}}'>Add Alias</a> - <a href='{{.MergePage}}?from={{.Name}}'>Merge</a> - <a href='{{.SplitPage}}?topic={{.Name}}'>Split</a></center>
+	{{end}}
+	<center class='sort-links'>Sort by:
+		{{if eq .Sort "top"}}<b>Top</b>{{else}}<a href='?sort=top'>Top</a>{{end}}
+		{{if eq .Sort "new"}}<b>New</b>{{else}}<a href='?sort=new'>New</a>{{end}}
+		{{if eq .Sort "controversial"}}<b>Controversial</b>{{else}}<a href='?sort=controversial'>Controversial</a>{{end}}
+	</center>
+	{{range $media := .AssociatedMedia}}
+		<form class='vote-form' action='{{$.VotePage}}' method='post'>
+			<input type='hidden' name='kind' value='media'>
+			<input type='hidden' name='page' value='{{$.Name}}'>
+			<input type='hidden' name='item' value='{{.Hash}}'>
+			<button type='submit' name='value' value='up'>+</button>
+			<button type='submit' name='value' value='down'>-</button>
+			<button type='submit' name='value' value='none'>x</button>
+		</form>
+		{{with index $.Thumbnails .Hash}}<a href='{{$.ElaborationPrefix}}{{$media.Hash}}'><img class='media-thumbnail' src='{{.}}' alt=''></a>{{end}}
+		<a href='{{$.ElaborationPrefix}}{{.Hash}}'>{{.Title}}</a> ({{.Upvotes}} up, {{.Downvotes}} down)
+		<form class='vote-form' action='{{$.FlagPage}}' method='post'>
+			<input type='hidden' name='kind' value='media'>
+			<input type='hidden' name='page' value='{{$.Name}}'>
+			<input type='hidden' name='item' value='{{.Hash}}'>
+			<button type='submit'>Flag</button>
+		</form>
+		<br>
+		<form class='vote-form' action='{{$.VotePage}}' method='post'>
+			<input type='hidden' name='kind' value='media'>
+			<input type='hidden' name='page' value='{{$.Name}}'>
+			<input type='hidden' name='item' value='{{.Hash}}'>
+			<button type='submit' name='position' value='left'>Too Basic</button>
+			<span class='position-axis' title='{{.PositionVotes}} votes'><span class='position-marker' style='left: {{.PositionPercent}}%'></span></span>
+			<button type='submit' name='position' value='right'>Too Advanced</button>
+			<button type='submit' name='position' value='none'>x</button>
+		</form><br>
 	{{end}}
 	<br><br>
-	<center><h2>Related Pages</h2></center>
-	{{range .RelatedTopics}}
-		<a href='{{$.TopicPrefix}}{{.Title}}'>{{.Title}}</a><br>
+	{{range .RelationGroups}}
+	{{if .Relations}}
+	<center><h2>{{.Heading}}</h2></center>
+	{{range .Relations}}
+		<form class='vote-form' action='{{$.VotePage}}' method='post'>
+			<input type='hidden' name='kind' value='topic'>
+			<input type='hidden' name='page' value='{{.Page}}'>
+			<input type='hidden' name='item' value='{{.Title}}'>
+			<input type='hidden' name='return' value='{{$.Name}}'>
+			<button type='submit' name='value' value='up'>+</button>
+			<button type='submit' name='value' value='down'>-</button>
+			<button type='submit' name='value' value='none'>x</button>
+		</form>
+		<a href='{{$.TopicPrefix}}{{.Topic}}'>{{.Topic}}</a>{{if .Label}} <i>({{.Label}})</i>{{end}} ({{.Upvotes}} up, {{.Downvotes}} down)
+		<form class='vote-form' action='{{$.FlagPage}}' method='post'>
+			<input type='hidden' name='kind' value='topic'>
+			<input type='hidden' name='page' value='{{.Page}}'>
+			<input type='hidden' name='item' value='{{.Title}}'>
+			<input type='hidden' name='return' value='{{$.Name}}'>
+			<button type='submit'>Flag</button>
+		</form>
+		<br>
+		{{if eq .Page $.Name}}
+		<form class='vote-form' action='{{$.VotePage}}' method='post'>
+			<input type='hidden' name='kind' value='topic'>
+			<input type='hidden' name='page' value='{{$.Name}}'>
+			<input type='hidden' name='item' value='{{.Title}}'>
+			<button type='submit' name='position' value='left'>More Basic</button>
+			<button type='submit' name='position' value='center'>Same Level</button>
+			<span class='position-axis' title='{{.PositionVotes}} votes'><span class='position-marker' style='left: {{.PositionPercent}}%'></span></span>
+			<button type='submit' name='position' value='right'>More Advanced</button>
+			<button type='submit' name='position' value='none'>x</button>
+		</form><br>
+		{{end}}
+	{{end}}
+	{{end}}
 	{{end}}
@@ -1,10 +1,12 @@
 	<p>Uploads must have either a parent topic or a parent media. The same media <br>
-	can have multiple parents, but must be added as separate uploads.</p>
+	can have multiple parents, but must be added as separate uploads. Parent <br>
+	topics must already exist, new topics can be made on the <a href='/create.go'>create</a> page.</p>
 	<form enctype='multipart/form-data' action='upload.go' method='post'>
 		File: <input type='file' name='upload'><br>
 		File Title: <input type='test' name='title'><br>
-		Parent Topic: <input type='text' name='parentTopic'></br>
-		Parent Media: <input type='text' name='parentMedia'></br>
+		Parent Topic: <input type='text' name='parentTopic' data-suggest='topic' autocomplete='off'></br>
+		Parent Media: <input type='text' name='parentMedia' data-suggest='media' autocomplete='off'></br>
 		<input type='submit' value='upload'><br>
 	</form>
 	{{if .}}<center><h1>Thanks!</h1></center><br><br>{{end}}
+	<script src='/web-assets/suggest.js'></script>
@@ -0,0 +1,23 @@
+	<center><h1>{{.Name}}</h1></center>
+	<center>Member since {{.DateStarted}} - {{.Posts}} posts - {{.Votes}} votes</center>
+	<center>
+		<form class='vote-form' action='{{.FlagPage}}' method='post'>
+			<input type='hidden' name='user' value='{{.Name}}'>
+			<button type='submit'>Flag User</button>
+		</form>
+	</center>
+	<br><br>
+	<center><h2>Media</h2></center>
+	{{range .Media}}
+		<a href='{{$.ElaborationPrefix}}{{.Hash}}'>{{.Title}}</a> in <a href='{{$.TopicPrefix}}{{.Topic}}'>{{.Topic}}</a> - {{.SubmissionDate.Format "2006-01-02"}}<br>
+	{{end}}
+	<br><br>
+	<center><h2>Elaborations</h2></center>
+	{{range .Elaborations}}
+		<a href='{{$.ElaborationPrefix}}{{.Hash}}'>{{.Title}}</a> on <a href='{{$.ElaborationPrefix}}{{.Parent}}'>{{.Parent}}</a> - {{.SubmissionDate.Format "2006-01-02"}}<br>
+	{{end}}
+	<br><br>
+	<center><h2>Topic Connections</h2></center>
+	{{range .Connections}}
+		<a href='{{$.TopicPrefix}}{{.Source}}'>{{.Source}}</a> to <a href='{{$.TopicPrefix}}{{.Title}}'>{{.Title}}</a> - {{.SubmissionDate.Format "2006-01-02"}}<br>
+	{{end}}
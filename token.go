@@ -0,0 +1,432 @@
+package main
+
+// token.go manages API tokens, which let scripts and bots act on behalf of a
+// user without a session cookie. A token is sent in the Authorization header
+// as 'Bearer <token>'.
+//
+// Like sessions, tokens are stored in the tokens bucket keyed by the hash of
+// the token, so the token itself is only ever shown once, on the settings
+// page, when it is generated. Each token carries a set of scopes that limit
+// which operations it can be used for. A request made with a token is only
+// treated as logged in by handlers that have been wrapped with requireScope
+// (or that check authorizeScope themselves), so a token can never reach a
+// page that does not ask for one of its scopes.
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"html/template"
+	"io"
+	"net/http"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/boltdb/bolt"
+)
+
+const (
+	settingsPage = "/settings.go"
+
+	settingsTitle = "Settings"
+
+	scopeConnect = "connect"
+	scopeRead    = "read"
+	scopeUpload  = "upload"
+	scopeVote    = "vote"
+
+	defaultTokenDays = 90
+	maxTokenNameLen  = 64
+	maxUserTokens    = 20
+	tokenPrefix      = "herus_"
+
+	// tokenTouchInterval limits how often the last used time of a token is
+	// written, so that a busy script does not turn every request into a
+	// database write.
+	tokenTouchInterval = time.Minute
+)
+
+var (
+	settingsTpl = filepath.Join(dirTemplates, "settings.tpl")
+
+	// tokenScopes lists every scope that a token can carry.
+	tokenScopes = []string{scopeRead, scopeUpload, scopeConnect, scopeVote}
+
+	// tokenExpiryDays lists the lifetimes that a token can be given.
+	tokenExpiryDays = []int{7, 30, defaultTokenDays, 365}
+
+	errInvalidToken      = errors.New("api token is invalid or has expired")
+	errInvalidTokenScope = errors.New("unknown api token scope")
+	errMissingScope      = errors.New("api token does not have the scope needed for this request")
+	errMissingTokenName  = errors.New("api tokens must have a name")
+	errMissingTokenScope = errors.New("api tokens must have at least one scope")
+	errLongTokenName     = errors.New("api token name is too long")
+	errTooManyTokens     = errors.New("you have too many api tokens - revoke one first")
+	errUnknownToken      = errors.New("api token does not exist")
+)
+
+// tokenContextKey is the key under which the token used to make a request is
+// stored in the request context.
+type tokenContextKey struct{}
+
+// apiToken is the information stored in the database about an API token.
+type apiToken struct {
+	Name     string
+	Owner    string
+	Scopes   []string
+	Created  time.Time
+	Expires  time.Time
+	LastUsed time.Time
+}
+
+// tokenRequest is the token and user attached to a request made with an API
+// token.
+type tokenRequest struct {
+	Token apiToken
+	User  User
+}
+
+// tokenListing is a token as shown on the settings page. ID is the database
+// key of the token, which identifies the token without revealing it.
+type tokenListing struct {
+	ID string
+	apiToken
+}
+
+// settingsTemplateData defines the data which is used to fill out the
+// settings template file.
+type settingsTemplateData struct {
+	SettingsPage string
+
+	Error       string
+	ErrorExists bool
+
+	// NewToken is only set directly after a token has been generated.
+	NewToken string
+
+	DefaultDays int
+	ExpiryDays  []int
+	Scopes      []string
+	Tokens      []tokenListing
+}
+
+// Expired returns whether the token can no longer be used.
+func (t apiToken) Expired() bool {
+	return time.Now().After(t.Expires)
+}
+
+// hasScope returns whether the token carries the provided scope.
+func (t apiToken) hasScope(scope string) bool {
+	for _, s := range t.Scopes {
+		if s == scope {
+			return true
+		}
+	}
+	return false
+}
+
+// getToken returns the token stored under a key. Expired tokens are reported
+// as not existing.
+func getToken(tx *bolt.Tx, key []byte) (t apiToken, exists bool, err error) {
+	tokenBytes := tx.Bucket(bucketTokens).Get(key)
+	if tokenBytes == nil {
+		return apiToken{}, false, nil
+	}
+	err = json.Unmarshal(tokenBytes, &t)
+	if err != nil {
+		return apiToken{}, true, err
+	}
+	if t.Expired() {
+		return apiToken{}, false, nil
+	}
+	return t, true, nil
+}
+
+// putToken stores a token under a key.
+func putToken(tx *bolt.Tx, key []byte, t apiToken) error {
+	tokenBytes, err := json.Marshal(t)
+	if err != nil {
+		return err
+	}
+	return tx.Bucket(bucketTokens).Put(key, tokenBytes)
+}
+
+// userTokens returns every token belonging to the named user, including
+// tokens that have expired, newest first.
+func userTokens(tx *bolt.Tx, name string) ([]tokenListing, error) {
+	var tokens []tokenListing
+	err := tx.Bucket(bucketTokens).ForEach(func(k, v []byte) error {
+		var t apiToken
+		err := json.Unmarshal(v, &t)
+		if err != nil {
+			return err
+		}
+		if t.Owner == name {
+			tokens = append(tokens, tokenListing{ID: string(k), apiToken: t})
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	sort.Slice(tokens, func(i, j int) bool {
+		return tokens[i].Created.After(tokens[j].Created)
+	})
+	return tokens, nil
+}
+
+// createToken generates a token for the user and returns it. Only the hash of
+// the token is kept.
+func createToken(tx *bolt.Tx, user User, name string, scopes []string, days int) (string, error) {
+	name = strings.TrimSpace(name)
+	if name == "" {
+		return "", errMissingTokenName
+	}
+	if len(name) > maxTokenNameLen {
+		return "", errLongTokenName
+	}
+	if len(scopes) == 0 {
+		return "", errMissingTokenScope
+	}
+	for _, scope := range scopes {
+		valid := false
+		for _, s := range tokenScopes {
+			valid = valid || scope == s
+		}
+		if !valid {
+			return "", errInvalidTokenScope
+		}
+	}
+	validDays := false
+	for _, d := range tokenExpiryDays {
+		validDays = validDays || days == d
+	}
+	if !validDays {
+		days = defaultTokenDays
+	}
+	existing, err := userTokens(tx, user.Name)
+	if err != nil {
+		return "", err
+	}
+	if len(existing) >= maxUserTokens {
+		return "", errTooManyTokens
+	}
+
+	token, err := randomHex(sessionTokenLen)
+	if err != nil {
+		return "", err
+	}
+	token = tokenPrefix + token
+	t := apiToken{
+		Name:    name,
+		Owner:   user.Name,
+		Scopes:  scopes,
+		Created: time.Now(),
+		Expires: time.Now().AddDate(0, 0, days),
+	}
+	err = putToken(tx, sessionKey(token), t)
+	if err != nil {
+		return "", err
+	}
+	return token, nil
+}
+
+// revokeToken deletes a token belonging to the user.
+func revokeToken(tx *bolt.Tx, user User, id string) error {
+	bt := tx.Bucket(bucketTokens)
+	tokenBytes := bt.Get([]byte(id))
+	if tokenBytes == nil {
+		return errUnknownToken
+	}
+	var t apiToken
+	err := json.Unmarshal(tokenBytes, &t)
+	if err != nil {
+		return err
+	}
+	if t.Owner != user.Name {
+		return errUnknownToken
+	}
+	return bt.Delete([]byte(id))
+}
+
+// revokeUserTokens deletes every token belonging to the named user.
+func revokeUserTokens(tx *bolt.Tx, name string) error {
+	bt := tx.Bucket(bucketTokens)
+	var stale [][]byte
+	err := bt.ForEach(func(k, v []byte) error {
+		var t apiToken
+		err := json.Unmarshal(v, &t)
+		if err != nil {
+			return err
+		}
+		if t.Owner == name {
+			stale = append(stale, k)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	for _, k := range stale {
+		err = bt.Delete(k)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// bearerToken returns the token in the Authorization header of a request.
+func bearerToken(r *http.Request) (string, bool) {
+	auth := r.Header.Get("Authorization")
+	if len(auth) < len("Bearer ") || !strings.EqualFold(auth[:len("Bearer ")], "Bearer ") {
+		return "", false
+	}
+	return strings.TrimSpace(auth[len("Bearer "):]), true
+}
+
+// tokenUser looks up the token and its owner, recording that the token has
+// been used. ok is false if the token is unknown or expired, or if the owner
+// has been suspended.
+func (h *herus) tokenUser(token string) (tr tokenRequest, ok bool, err error) {
+	key := sessionKey(token)
+	var exists, touch bool
+	err = h.db.View(func(tx *bolt.Tx) error {
+		var err error
+		tr.Token, exists, err = getToken(tx, key)
+		if err != nil || !exists {
+			return err
+		}
+		tr.User, exists, err = getUser(tx, tr.Token.Owner)
+		touch = time.Since(tr.Token.LastUsed) > tokenTouchInterval
+		return err
+	})
+	if err != nil || !exists || tr.User.Suspended {
+		return tokenRequest{}, false, err
+	}
+	if touch {
+		err = h.db.Update(func(tx *bolt.Tx) error {
+			t, exists, err := getToken(tx, key)
+			if err != nil || !exists {
+				return err
+			}
+			t.LastUsed = time.Now()
+			return putToken(tx, key, t)
+		})
+		if err != nil {
+			return tokenRequest{}, false, err
+		}
+	}
+	return tr, true, nil
+}
+
+// authorizeScope checks that a request made with an API token may perform an
+// operation that needs the provided scope, and if so returns the request with
+// the owner of the token logged in. Requests made without a token are
+// returned unchanged.
+func authorizeScope(r *http.Request, scope string) (*http.Request, error) {
+	tr, ok := r.Context().Value(tokenContextKey{}).(tokenRequest)
+	if !ok {
+		return r, nil
+	}
+	if !tr.Token.hasScope(scope) {
+		return r, errMissingScope
+	}
+	return r.WithContext(context.WithValue(r.Context(), userContextKey{}, tr.User)), nil
+}
+
+// requireScope wraps a handler so that it can be reached with an API token
+// that carries the provided scope.
+func requireScope(scope string, handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		r, err := authorizeScope(r, scope)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusForbidden)
+			return
+		}
+		handler(w, r)
+	}
+}
+
+// executeSettingsBody builds the body portion of the settings page.
+func executeSettingsBody(w io.Writer, std settingsTemplateData) error {
+	t, err := template.ParseFiles(settingsTpl)
+	if err != nil {
+		return err
+	}
+	return t.Execute(w, std)
+}
+
+// processSettingsSubmission generates or revokes a token for the user. The
+// generated token is returned so that it can be shown to the user.
+func (h *herus) processSettingsSubmission(r *http.Request, user User) (string, error) {
+	err := r.ParseForm()
+	if err != nil {
+		return "", err
+	}
+	var token string
+	err = h.db.Update(func(tx *bolt.Tx) error {
+		if id := r.FormValue("revoke"); id != "" {
+			return revokeToken(tx, user, id)
+		}
+		days, _ := strconv.Atoi(r.FormValue("days"))
+		var err error
+		token, err = createToken(tx, user, r.FormValue("name"), r.Form["scope"], days)
+		return err
+	})
+	return token, err
+}
+
+// settingsHandler handles requests to the settings page, where users manage
+// their API tokens.
+func (h *herus) settingsHandler(w http.ResponseWriter, r *http.Request) {
+	user, ok := currentUser(r)
+	if !ok {
+		http.Redirect(w, r, loginPage, http.StatusSeeOther)
+		return
+	}
+
+	std := settingsTemplateData{
+		SettingsPage: settingsPage,
+
+		DefaultDays: defaultTokenDays,
+		ExpiryDays:  tokenExpiryDays,
+		Scopes:      tokenScopes,
+	}
+	if r.Method == "POST" {
+		token, err := h.processSettingsSubmission(r, user)
+		if err != nil {
+			std.ErrorExists = true
+			std.Error = err.Error()
+		}
+		std.NewToken = token
+	}
+	err := h.db.View(func(tx *bolt.Tx) error {
+		var err error
+		std.Tokens, err = userTokens(tx, user.Name)
+		return err
+	})
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	err = executeHeader(w, HeaderTemplateData{Title: settingsTitle})
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	err = executeSettingsBody(w, std)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	err = executeFooter(w)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+}
@@ -0,0 +1,158 @@
+package main
+
+import (
+	"context"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/boltdb/bolt"
+)
+
+// TestAuthorizeScope checks that a token can only be used for the scopes it
+// carries, and that requests without a token are left alone.
+func TestAuthorizeScope(t *testing.T) {
+	alice := User{Name: "alice"}
+	for _, scope := range tokenScopes {
+		for _, other := range tokenScopes {
+			tr := tokenRequest{Token: apiToken{Owner: alice.Name, Scopes: []string{other}}, User: alice}
+			r := httptest.NewRequest("GET", "/", nil)
+			r = r.WithContext(context.WithValue(r.Context(), tokenContextKey{}, tr))
+			r, err := authorizeScope(r, scope)
+			user, ok := currentUser(r)
+			if scope == other {
+				if err != nil || !ok || user.Name != alice.Name {
+					t.Errorf("token with scope %v was not allowed to %v: %v", other, scope, err)
+				}
+			} else if err != errMissingScope || ok {
+				t.Errorf("token with scope %v was allowed to %v", other, scope)
+			}
+		}
+	}
+
+	r := httptest.NewRequest("GET", "/", nil)
+	authorized, err := authorizeScope(r, scopeVote)
+	if err != nil || authorized != r {
+		t.Errorf("request without a token was changed, error %v", err)
+	}
+}
+
+// TestTokenUser checks that only tokens that exist, have not expired, and
+// belong to a user in good standing are accepted.
+func TestTokenUser(t *testing.T) {
+	h := &herus{db: newTestDB(t)}
+	var valid, expired, revoked, suspended string
+	err := h.db.Update(func(tx *bolt.Tx) error {
+		err := putUser(tx, User{Name: "alice"})
+		if err != nil {
+			return err
+		}
+		err = putUser(tx, User{Name: "mallory", Suspended: true})
+		if err != nil {
+			return err
+		}
+		alice := User{Name: "alice"}
+		valid, err = createToken(tx, alice, "valid", []string{scopeRead}, 7)
+		if err != nil {
+			return err
+		}
+		expired, err = createToken(tx, alice, "expired", []string{scopeRead}, 7)
+		if err != nil {
+			return err
+		}
+		token, _, err := getToken(tx, sessionKey(expired))
+		if err != nil {
+			return err
+		}
+		token.Expires = time.Now().Add(-time.Second)
+		err = putToken(tx, sessionKey(expired), token)
+		if err != nil {
+			return err
+		}
+		revoked, err = createToken(tx, alice, "revoked", []string{scopeRead}, 7)
+		if err != nil {
+			return err
+		}
+		err = revokeToken(tx, alice, string(sessionKey(revoked)))
+		if err != nil {
+			return err
+		}
+		suspended, err = createToken(tx, User{Name: "mallory"}, "suspended", []string{scopeRead}, 7)
+		return err
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		token string
+		want  bool
+	}{
+		{valid, true},
+		{expired, false},
+		{revoked, false},
+		{suspended, false},
+		{tokenPrefix + "unknown", false},
+	}
+	for _, test := range tests {
+		tr, ok, err := h.tokenUser(test.token)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if ok != test.want {
+			t.Errorf("token %v accepted: %v, want %v", test.token, ok, test.want)
+		}
+		if ok && tr.User.Name != "alice" {
+			t.Errorf("token %v belongs to %v, want alice", test.token, tr.User.Name)
+		}
+	}
+}
+
+// TestPasswordChangeRevokesTokens checks that changing a password revokes the
+// tokens of the user and leaves the tokens of other users alone.
+func TestPasswordChangeRevokesTokens(t *testing.T) {
+	h := &herus{db: newTestDB(t)}
+	alice := User{Name: "alice", Salt: "salt"}
+	alice.HashedPassword = hashPassword(alice.Salt, alice.Name, "password1")
+	var aliceToken, bobToken string
+	err := h.db.Update(func(tx *bolt.Tx) error {
+		err := putUser(tx, alice)
+		if err != nil {
+			return err
+		}
+		err = putUser(tx, User{Name: "bob"})
+		if err != nil {
+			return err
+		}
+		aliceToken, err = createToken(tx, alice, "script", []string{scopeUpload}, 7)
+		if err != nil {
+			return err
+		}
+		bobToken, err = createToken(tx, User{Name: "bob"}, "script", []string{scopeUpload}, 7)
+		return err
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	form := url.Values{
+		"password":        {"password1"},
+		"newPassword":     {"password2"},
+		"confirmPassword": {"password2"},
+	}
+	r := httptest.NewRequest("POST", "/password.go", strings.NewReader(form.Encode()))
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	err = h.processPasswordChange(r, alice)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, ok, _ := h.tokenUser(aliceToken); ok {
+		t.Error("token of alice still works after the password of alice changed")
+	}
+	if _, ok, _ := h.tokenUser(bobToken); !ok {
+		t.Error("token of bob was revoked by the password change of alice")
+	}
+}
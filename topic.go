@@ -36,24 +36,36 @@ type mediaRelation struct {
 	LeftVotes  uint64
 	RightVotes uint64
 	Upvotes    uint64
+
+	Hidden bool
 }
 
-// topicRelation is a mapping from one topic to another.
+// topicRelation is a mapping from one topic to another. Title is the name of
+// the topic that the relation leads to, and Type is one of the relation types
+// in relation.go.
 type topicRelation struct {
 	SubmissionDate time.Time
 	Submitter      string
 	Title          string
+	Type           string
 
 	CenterVotes uint64
 	Downvotes   uint64
 	LeftVotes   uint64
 	RightVotes  uint64
 	Upvotes     uint64
+
+	Hidden bool
 }
 
 // topicData is a struct that gets stored in the database containing all of the
-// information about a topic.
+// information about a topic. The description is written in markdown.
 type topicData struct {
+	CreationDate time.Time
+	Creator      string
+	Description  string
+	Title        string
+
 	AssociatedMedia []mediaRelation
 	RelatedTopics   []topicRelation
 }
@@ -61,12 +73,30 @@ type topicData struct {
 // topicTemplateData provides the dynamic data that is used to fill out the
 // template for the topic page.
 type topicTemplateData struct {
+	AliasPage         string
+	CreatePage        string
+	Description       template.HTML
+	EditSuffix        string
 	ElaborationPrefix string
+	Exists            bool
+	GraphPrefix       string
+	HistorySuffix     string
+	MergePage         string
+	Name              string
+	PathPrefix        string
+	Sort              string
+	SplitPage         string
+	FlagPage          string
 	TopicPrefix       string
 	Title             string
+	VotePage          string
 
 	AssociatedMedia []mediaRelation
-	RelatedTopics   []topicRelation
+	RelationGroups  []relationGroup
+
+	// Thumbnails maps the hash of each piece of media that has a thumbnail
+	// to the url of the thumbnail.
+	Thumbnails map[string]string
 }
 
 // executeTopicBody writes the html body for the topic page.
@@ -95,37 +125,131 @@ func getTopic(tx *bolt.Tx, topic string) (td topicData, exists bool, err error)
 	return td, true, nil
 }
 
-// putTopic stores the provided topic data in the topic database.
-func putTopic(tx *bolt.Tx, topic string, td topicData) error {
+// putTopic stores the provided topic data in the topic database. The write is
+// recorded in the revision history of the topic under the name of the author,
+// and the backlinks of the relations of the topic and the search index are
+// updated.
+func putTopic(tx *bolt.Tx, topic string, td topicData, author string) error {
+	old, _, err := getTopic(tx, topic)
+	if err != nil {
+		return err
+	}
 	topicDataBytes, err := json.Marshal(td)
 	if err != nil {
 		return err
 	}
 	bt := tx.Bucket(bucketTopics)
-	return bt.Put([]byte(topic), topicDataBytes)
+	err = bt.Put([]byte(topic), topicDataBytes)
+	if err != nil {
+		return err
+	}
+	err = indexRelations(tx, topic, old.RelatedTopics, td.RelatedTopics)
+	if err != nil {
+		return err
+	}
+	err = indexTopic(tx, topic, td)
+	if err != nil {
+		return err
+	}
+	return recordRevision(tx, topic, td, author)
+}
+
+// putTopicData stores topic data without updating the backlinks, search
+// index, or revision history of the topic. It is used for writes that only
+// change vote counters, which are not part of the content of a topic, and by
+// migrations that rebuild the indexes themselves.
+func putTopicData(tx *bolt.Tx, topic string, td topicData) error {
+	topicDataBytes, err := json.Marshal(td)
+	if err != nil {
+		return err
+	}
+	return tx.Bucket(bucketTopics).Put([]byte(topic), topicDataBytes)
+}
+
+// deleteTopic removes a topic, the backlinks of its relations, and its search
+// document from the database. The revision history of the topic is kept.
+func deleteTopic(tx *bolt.Tx, topic string) error {
+	old, _, err := getTopic(tx, topic)
+	if err != nil {
+		return err
+	}
+	err = indexRelations(tx, topic, old.RelatedTopics, nil)
+	if err != nil {
+		return err
+	}
+	err = removeSearchDocument(tx, itemKindTopic, topic)
+	if err != nil {
+		return err
+	}
+	return tx.Bucket(bucketTopics).Delete([]byte(topic))
 }
 
-// topicHandler handles requests for topic pages.
+// topicHandler handles requests for topic pages, sending requests for the
+// history, diff, edit, and revert pages of a topic to their own handlers.
+// Requests that use a non-canonical name or an alias are redirected to the
+// canonical url of the topic.
 func (h *herus) topicHandler(w http.ResponseWriter, r *http.Request) {
-	// Parse and preprocess the topic name.
-	//
-	// TODO: There is probably a better way to format the topic title.
-	topicTitle := strings.TrimPrefix(r.URL.Path, topicPrefix)
-	topicTitle = strings.Replace(topicTitle, "_", " ", -1)
-	topicTitle = strings.Title(topicTitle)
-	topicName := strings.ToLower(topicTitle)
-	topicName = strings.Replace(topicName, " ", "_", -1)
+	// Split the path into the topic name and the subpage.
+	topicName := strings.TrimPrefix(r.URL.Path, topicPrefix)
+	subpage := ""
+	if i := strings.Index(topicName, "/"); i >= 0 {
+		topicName, subpage = topicName[:i], topicName[i:]
+	}
+	redirected, err := h.redirectToCanonical(w, r, topicPrefix, topicName, subpage)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if redirected {
+		return
+	}
+
+	if subpage != "" {
+		subpages := []struct {
+			suffix  string
+			role    string
+			handler func(http.ResponseWriter, *http.Request, string)
+		}{
+			{diffSuffix, memberReader, h.diffHandler},
+			{editSuffix, memberContributor, h.editHandler},
+			{historySuffix, memberReader, h.historyHandler},
+			{revertSuffix, memberModerator, h.revertHandler},
+		}
+		for _, sp := range subpages {
+			if subpage != sp.suffix {
+				continue
+			}
+			handler := sp.handler
+			serve := func(w http.ResponseWriter, r *http.Request) {
+				handler(w, r, topicName)
+			}
+			if sp.role != memberReader {
+				serve = requireRole(sp.role, serve)
+			}
+			serve(w, r)
+			return
+		}
+		rootHandler(w, r)
+		return
+	}
+	topicTitle := topicTitleFromName(topicName)
 
 	// Get a list of media from the database and build links to each media
 	// file.
 	var td topicData
 	var exists bool
-	var err error
+	var prerequisites, subtopics, seeAlso []relatedTopic
+	var thumbnails map[string]string
 	err = h.db.View(func(tx *bolt.Tx) error {
 		td, exists, err = getTopic(tx, topicName)
-		if !exists {
-			return nil
+		if err != nil {
+			return err
+		}
+		prerequisites, subtopics, seeAlso, err = topicRelations(tx, topicName, td)
+		if err != nil {
+			return err
 		}
+		thumbnails, err = mediaThumbnails(tx, td.AssociatedMedia)
 		return err
 	})
 	if err != nil {
@@ -134,13 +258,46 @@ func (h *herus) topicHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	// Drop anything hidden by a moderator and order what remains.
+	td.AssociatedMedia = visibleMedia(td.AssociatedMedia)
+	sortMode := parseSortMode(r.URL.Query().Get("sort"))
+	rankMedia(td.AssociatedMedia, sortMode)
+	rankTopics(prerequisites, sortMode)
+	rankTopics(subtopics, sortMode)
+	rankTopics(seeAlso, sortMode)
+
+	// Prefer the title that the topic was created with.
+	if td.Title != "" {
+		topicTitle = td.Title
+	}
+
 	// Fill out the stuct that will inform the topic template.
 	ttd := topicTemplateData{
+		AliasPage:         aliasPage,
+		CreatePage:        createPage,
+		Description:       renderMarkdown(td.Description),
+		EditSuffix:        editSuffix,
 		ElaborationPrefix: elaborationPrefix,
+		Exists:            exists,
+		GraphPrefix:       graphPrefix,
+		HistorySuffix:     historySuffix,
+		MergePage:         mergePage,
+		Name:              topicName,
+		PathPrefix:        pathPrefix,
+		Sort:              sortMode,
+		SplitPage:         splitPage,
+		FlagPage:          flagPage,
+		TopicPrefix:       topicPrefix,
 		Title:             topicTitle,
+		VotePage:          votePage,
 
 		AssociatedMedia: td.AssociatedMedia,
-		RelatedTopics:   td.RelatedTopics,
+		RelationGroups: []relationGroup{
+			{Heading: "Prerequisites", Relations: prerequisites},
+			{Heading: "Subtopics", Relations: subtopics},
+			{Heading: "See also", Relations: seeAlso},
+		},
+		Thumbnails: thumbnails,
 	}
 
 	// Execute a template to display all of the uploaded media.
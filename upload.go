@@ -1,18 +1,25 @@
 package main
 
 // upload.go handles the uploading of data to the server.
+//
+// Uploads are streamed straight from the request into a temporary file in the
+// media folder, with the hash computed along the way, so that the size of an
+// upload is limited only by the upload limit of the server and not by memory.
+// Once the upload has been added to the database the temporary file is renamed
+// to the hash of the media, which makes the file appear atomically.
 
 import (
+	"bufio"
 	"crypto/sha256"
 	"encoding/hex"
-	"encoding/json"
 	"errors"
 	"html/template"
 	"io"
 	"io/ioutil"
 	"net/http"
+	"net/url"
+	"os"
 	"path/filepath"
-	"strings"
 	"time"
 
 	"github.com/boltdb/bolt"
@@ -22,116 +29,224 @@ const (
 	uploadPage = "/upload.go"
 
 	uploadTitle = "Upload Media to Herus"
+
+	// defaultMaxUploadSize is the upload limit used when none is given on
+	// the command line. It matches the limit from before uploads were
+	// streamed to disk, so larger uploads have to be enabled with
+	// -max-upload.
+	defaultMaxUploadSize = 8 << 20 // 8 MB
+
+	// maxUploadFormLen limits the size of the fields of the upload form other
+	// than the file itself.
+	maxUploadFormLen = 64 << 10 // 64 KB
+
+	// sniffLen is the number of bytes needed to detect the type of a file.
+	sniffLen = 512
+
+	// tempUploadPrefix starts the name of every temporary upload file in the
+	// media folder, and of every derived asset or text that is being written
+	// in the derived folder.
+	tempUploadPrefix = ".upload-"
 )
 
 var (
 	uploadTpl = filepath.Join(dirTemplates, "upload.tpl")
+
+	errDuplicateElaboration = errors.New("media has already been added to the parent media")
+	errDuplicateMedia       = errors.New("media has already been added to the parent topic")
+	errMissingMediaTitle    = errors.New("media must be uploaded with a title")
+	errMissingParent        = errors.New("media must be uploaded with a parent")
+	errMissingParentMedia   = errors.New("parent media does not exist")
+	errMissingParentTopic   = errors.New("parent topic does not exist - create it at " + createPage + " first")
+	errMultipleParents      = errors.New("only one parent per upload is currently allowed")
+	errUploadTooLarge       = errors.New("upload is larger than the upload limit of the server")
 )
 
-// receiveUpload accepts an upload presented by the user.
-func (h *herus) receiveUpload(w http.ResponseWriter, r *http.Request) {
-	// Setting MaxBytesReader limits the file upload to 8 MB, the connection
-	// will be closed if the limit is exceeded.
-	r.Body = http.MaxBytesReader(w, r.Body, 8<<20) // 8 MB
-	err := r.ParseMultipartForm(8 << 20)           // 8 MB
+// stagedUpload is an uploaded file that has been streamed into a temporary
+// file in the media folder and hashed, but has not been added to the database
+// yet.
+type stagedUpload struct {
+	Hash string
+	Path string
+	Size int64
+
+	// Head holds the first bytes of the file, which are enough to detect
+	// the type of the file.
+	Head []byte
+}
+
+// discard removes the temporary file of an upload. It is safe to call after
+// the file has been moved into place.
+func (su stagedUpload) discard() {
+	if su.Path != "" {
+		os.Remove(su.Path)
+	}
+}
+
+// removeTempFiles deletes the temporary files of uploads, derived assets, and
+// extracted text that never finished.
+func removeTempFiles() error {
+	paths, err := filepath.Glob(filepath.Join(dirMedia, tempUploadPrefix+"*"))
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusBadRequest)
-		return
+		return err
 	}
+	derived, err := filepath.Glob(filepath.Join(dirDerived, "*", tempUploadPrefix+"*"))
+	if err != nil {
+		return err
+	}
+	for _, path := range append(paths, derived...) {
+		err = os.Remove(path)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
 
-	// Get the values of the elaboration and the topic that the media might be
-	// getting added to.
-	mediaTitle := r.FormValue("title")
-	parentMedia := r.FormValue("parentMedia")
-	parentTopic := r.FormValue("parentTopic")
-	parentTopic = strings.Replace(parentTopic, " ", "_", -1)
-	parentTopic = strings.ToLower(parentTopic)
-	if mediaTitle == "" {
-		http.Error(w, "media must be uploaded with a title", http.StatusBadRequest)
-		return
+// stageUpload streams a file into a temporary file in the media folder,
+// hashing it along the way. Files larger than the upload limit of the server
+// are rejected.
+func (h *herus) stageUpload(src io.Reader) (stagedUpload, error) {
+	f, err := ioutil.TempFile(dirMedia, tempUploadPrefix)
+	if err != nil {
+		return stagedUpload{}, err
 	}
-	if parentMedia == "" && parentTopic == "" {
-		http.Error(w, "media must be uploaded with a parent", http.StatusBadRequest)
-		return
+	su := stagedUpload{Path: f.Name()}
+
+	br := bufio.NewReaderSize(src, sniffLen)
+	head, _ := br.Peek(sniffLen)
+	su.Head = append([]byte(nil), head...)
+
+	hasher := sha256.New()
+	su.Size, err = io.Copy(io.MultiWriter(f, hasher), io.LimitReader(br, h.maxUploadSize+1))
+	if err == nil {
+		err = f.Sync()
 	}
-	if !(parentMedia == "" || parentTopic == "") {
-		http.Error(w, "only one parent per upload is currently allowed", http.StatusBadRequest)
-		return
+	closeErr := f.Close()
+	if err == nil {
+		err = closeErr
 	}
+	if err == nil && su.Size > h.maxUploadSize {
+		err = errUploadTooLarge
+	}
+	if err != nil {
+		su.discard()
+		return stagedUpload{}, err
+	}
+	su.Hash = hex.EncodeToString(hasher.Sum(nil))
+	return su, nil
+}
 
-	// Pull the file data from the form.
-	file, _, err := r.FormFile("upload")
+// readUploadForm reads a multipart upload form one part at a time, staging
+// the file in the 'upload' field with stageUpload. The other fields of the
+// form are returned alongside the staged file, which the caller must discard.
+func (h *herus) readUploadForm(w http.ResponseWriter, r *http.Request) (stagedUpload, url.Values, error) {
+	// The limit leaves room for the other fields of the form on top of the
+	// file. The connection will be closed if the limit is exceeded.
+	r.Body = http.MaxBytesReader(w, r.Body, h.maxUploadSize+maxUploadFormLen)
+	mr, err := r.MultipartReader()
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusBadRequest)
-		return
+		return stagedUpload{}, nil, err
 	}
-	defer func() {
-		err = file.Close()
+
+	var su stagedUpload
+	fields := make(url.Values)
+	for {
+		part, err := mr.NextPart()
+		if err == io.EOF {
+			break
+		}
 		if err != nil {
-			http.Error(w, err.Error(), http.StatusBadRequest)
+			su.discard()
+			return stagedUpload{}, nil, err
 		}
-	}()
-	fileData, err := ioutil.ReadAll(file)
-	if err != nil {
-		http.Error(w, err.Error(), http.StatusBadRequest)
-		return
+		if part.FormName() == "upload" && su.Path == "" {
+			su, err = h.stageUpload(part)
+		} else {
+			var value []byte
+			value, err = ioutil.ReadAll(io.LimitReader(part, maxUploadFormLen))
+			fields.Add(part.FormName(), string(value))
+		}
+		part.Close()
+		if err != nil {
+			su.discard()
+			return stagedUpload{}, nil, err
+		}
+	}
+	if su.Path == "" {
+		return stagedUpload{}, nil, http.ErrMissingFile
 	}
+	return su, fields, nil
+}
 
-	// Get the hash of the file.
-	hasher := sha256.New()
-	_, err = hasher.Write(fileData)
-	if err != nil {
-		http.Error(w, err.Error(), http.StatusBadRequest)
-		return
+// storeUpload adds a staged upload to the database under its parent topic or
+// parent media on behalf of the user, and moves the file into place in the
+// media folder if the server has not seen it before. It returns the hash of
+// the media.
+func (h *herus) storeUpload(user User, su stagedUpload, mediaTitle, parentTopic, parentMedia string) (string, error) {
+	parentTopic = canonicalTopicName(parentTopic)
+	if mediaTitle == "" {
+		return "", errMissingMediaTitle
+	}
+	if parentMedia == "" && parentTopic == "" {
+		return "", errMissingParent
+	}
+	if !(parentMedia == "" || parentTopic == "") {
+		return "", errMultipleParents
+	}
+	mediaHash := su.Hash
+	contentType, allowed := detectMediaType(su.Head)
+	if !allowed {
+		return "", errDisallowedMediaType
 	}
-	checksum := hasher.Sum(nil)
 
 	// Create/Update the database entry for this media.
-	mediaHash := hex.EncodeToString(checksum)
-	var mm mediaMetadata
 	mediaExists := false
-	oldTitle := mediaTitle
-	err = h.db.Update(func(tx *bolt.Tx) error {
+	add := func(tx *bolt.Tx) error {
 		// See if the media has already been added to the server.
-		bm := tx.Bucket(bucketMedia)
-		mediaMetadataBytes := bm.Get([]byte(mediaHash))
-		if mediaMetadataBytes == nil {
-			// Create an entry for the media.
-			mm.Title = mediaTitle
-			mediaMetadataBytes, err := json.Marshal(mm)
-			if err != nil {
-				return err
-			}
-			err = bm.Put([]byte(mediaHash), mediaMetadataBytes)
+		mm, exists, err := getMediaMetadata(tx, mediaHash)
+		if err != nil {
+			return err
+		}
+		if exists && mm.Hidden {
+			// The new submission is visible, so the media is no longer
+			// hidden everywhere.
+			mm.Hidden = false
+			err = putMediaMetadata(tx, mediaHash, mm)
 			if err != nil {
 				return err
 			}
-		} else {
-			// Update the in-memory title with the in-database title.
-			err := json.Unmarshal(mediaMetadataBytes, &mm)
+		}
+		if !exists {
+			// Create an entry for the media. Its text is indexed once it
+			// has been extracted, see extract.go.
+			err = putMediaMetadata(tx, mediaHash, mediaMetadata{
+				Title:          mediaTitle,
+				ContentType:    contentType,
+				Size:           su.Size,
+				Submitter:      user.Name,
+				SubmissionDate: time.Now(),
+			})
 			if err != nil {
 				return err
 			}
-			mediaTitle = mm.Title
-			mediaExists = true
 		}
+		mediaExists = exists
 
 		// Add the media to either the parent topic or the parent media.
 		if parentMedia != "" {
 			// Check whether the media already exists as an elaboration to the
 			// parent media.
-			var parentMM mediaMetadata
-			parentMetadataBytes := bm.Get([]byte(parentMedia))
-			if parentMetadataBytes == nil {
-				return errors.New("parent media does not exist")
-			}
-			err = json.Unmarshal(parentMetadataBytes, &parentMM)
+			parentMM, exists, err := getMediaMetadata(tx, parentMedia)
 			if err != nil {
 				return err
 			}
+			if !exists {
+				return errMissingParentMedia
+			}
 			for _, elaboration := range parentMM.Elaborations {
 				if elaboration.Hash == mediaHash {
-					return errors.New("media has already been added to the parent media")
+					return errDuplicateElaboration
 				}
 			}
 
@@ -139,31 +254,34 @@ func (h *herus) receiveUpload(w http.ResponseWriter, r *http.Request) {
 			parentMM.Elaborations = append(parentMM.Elaborations, mediaElaboration{
 				Hash:           mediaHash,
 				SubmissionDate: time.Now(),
-				// Submitter:
-				Title: oldTitle,
+				Submitter:      user.Name,
+				Title:          mediaTitle,
 
 				Downvotes: 0,
-				Upvotes:   3,
+				Upvotes:   submittedUpvotes,
 			})
-			parentMetadataBytes, err = json.Marshal(parentMM)
+			err = putMediaMetadata(tx, parentMedia, parentMM)
 			if err != nil {
 				return err
 			}
-			return bm.Put([]byte(parentMedia), parentMetadataBytes)
+			return incrementPosts(tx, user.Name)
 		}
-		// Check whether the parent topic already has the media.
-		var td topicData
-		bt := tx.Bucket(bucketTopics)
-		tdBytes := bt.Get([]byte(parentTopic))
-		if tdBytes != nil {
-			err = json.Unmarshal(tdBytes, &td)
-			if err != nil {
-				return err
-			}
+		// Check whether the parent topic already has the media. Topics must
+		// be created before media can be added to them.
+		parentTopic, err := resolveTopic(tx, parentTopic)
+		if err != nil {
+			return err
+		}
+		td, exists, err := getTopic(tx, parentTopic)
+		if err != nil {
+			return err
+		}
+		if !exists {
+			return errMissingParentTopic
 		}
 		for _, am := range td.AssociatedMedia {
 			if am.Hash == mediaHash {
-				return errors.New("media has already been added to the parent topic")
+				return errDuplicateMedia
 			}
 		}
 
@@ -171,32 +289,68 @@ func (h *herus) receiveUpload(w http.ResponseWriter, r *http.Request) {
 		td.AssociatedMedia = append(td.AssociatedMedia, mediaRelation{
 			Hash:           mediaHash,
 			SubmissionDate: time.Now(),
-			// Submitter:
-			Title: oldTitle,
+			Submitter:      user.Name,
+			Title:          mediaTitle,
 
 			Downvotes:  0,
 			LeftVotes:  0,
 			RightVotes: 0,
-			Upvotes:    3,
+			Upvotes:    submittedUpvotes,
 		})
-		tdBytes, err = json.Marshal(td)
+		err = putTopic(tx, parentTopic, td, user.Name)
 		if err != nil {
 			return err
 		}
-		return bt.Put([]byte(parentTopic), tdBytes)
+		return incrementPosts(tx, user.Name)
+	}
+
+	// New media is moved into place in the media folder before its entry is
+	// committed, so that the entry never refers to a file that is not there.
+	// The file is removed again if the entry cannot be committed.
+	dst := filepath.Join(dirMedia, mediaHash)
+	moved := false
+	err := h.db.Update(func(tx *bolt.Tx) error {
+		err := add(tx)
+		if err != nil || mediaExists {
+			return err
+		}
+		err = os.Rename(su.Path, dst)
+		if err != nil {
+			return err
+		}
+		moved = true
+		return nil
 	})
+	if err != nil {
+		if moved {
+			os.Remove(dst)
+		}
+		return "", err
+	}
+
+	// Queue new media for its derived assets and text extraction.
+	if !mediaExists {
+		h.queueDerivedAssets(mediaHash)
+	}
+	return mediaHash, nil
+}
+
+// receiveUpload accepts an upload presented by the user.
+func (h *herus) receiveUpload(w http.ResponseWriter, r *http.Request) {
+	user, _ := currentUser(r)
+
+	su, fields, err := h.readUploadForm(w, r)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
+	defer su.discard()
 
-	// Write the media to the media folder.
-	if !mediaExists {
-		err = ioutil.WriteFile(filepath.Join(dirMedia, mediaHash), fileData, 0700)
-		if err != nil {
-			http.Error(w, err.Error(), http.StatusBadRequest)
-			return
-		}
+	// Add the media to the title and parent given in the form.
+	_, err = h.storeUpload(user, su, fields.Get("title"), fields.Get("parentTopic"), fields.Get("parentMedia"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
 	}
 
 	err = executeHeader(w, HeaderTemplateData{Title: uploadTitle})
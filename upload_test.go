@@ -0,0 +1,116 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/boltdb/bolt"
+)
+
+// TestStoreUploadMoveFailure checks that media whose file cannot be moved into
+// place is not added to the database, so that the upload can be retried.
+func TestStoreUploadMoveFailure(t *testing.T) {
+	t.Chdir(t.TempDir())
+	err := os.MkdirAll(dirMedia, 0700)
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := &herus{db: newTestDB(t)}
+	alice := User{Name: "alice"}
+	err = h.db.Update(func(tx *bolt.Tx) error {
+		err := putUser(tx, alice)
+		if err != nil {
+			return err
+		}
+		return putTopic(tx, "calculus", topicData{Title: "Calculus"}, "admin")
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	data := []byte("limits and derivatives\n")
+	su := stagedUpload{
+		Hash: "0123456789abcdef",
+		Path: filepath.Join(dirMedia, tempUploadPrefix+"missing"),
+		Size: int64(len(data)),
+		Head: data,
+	}
+	_, err = h.storeUpload(alice, su, "notes.txt", "calculus", "")
+	if err == nil {
+		t.Fatal("upload of a file that cannot be moved succeeded")
+	}
+	err = h.db.View(func(tx *bolt.Tx) error {
+		_, exists, err := getMediaMetadata(tx, su.Hash)
+		if err != nil {
+			return err
+		}
+		if exists {
+			t.Error("media was added without its file")
+		}
+		td, _, err := getTopic(tx, "calculus")
+		if err != nil {
+			return err
+		}
+		if len(td.AssociatedMedia) != 0 {
+			t.Error("media was added to the topic without its file")
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	su.Path = filepath.Join(dirMedia, tempUploadPrefix+"staged")
+	err = os.WriteFile(su.Path, data, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = h.storeUpload(alice, su, "notes.txt", "calculus", "")
+	if err != nil {
+		t.Fatalf("retrying the upload failed: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(dirMedia, su.Hash)); err != nil {
+		t.Errorf("media file is not in place after the retry: %v", err)
+	}
+}
+
+// TestRemoveTempFiles checks that the temporary files left in the media and
+// derived folders by a crash are removed, and nothing else.
+func TestRemoveTempFiles(t *testing.T) {
+	t.Chdir(t.TempDir())
+	keep := []string{
+		filepath.Join(dirMedia, "0123456789abcdef"),
+		filepath.Join(dirMedia, resumableUploadPrefix+"0123"),
+		derivedPath("0123456789abcdef", textFile),
+	}
+	remove := []string{
+		filepath.Join(dirMedia, tempUploadPrefix+"1"),
+		derivedPath("0123456789abcdef", tempUploadPrefix+"2"),
+	}
+	for _, path := range append(keep, remove...) {
+		err := os.MkdirAll(filepath.Dir(path), 0700)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = os.WriteFile(path, nil, 0600)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	err := removeTempFiles()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, path := range keep {
+		if _, err := os.Stat(path); err != nil {
+			t.Errorf("%v was removed", path)
+		}
+	}
+	for _, path := range remove {
+		if _, err := os.Stat(path); !os.IsNotExist(err) {
+			t.Errorf("%v was not removed", path)
+		}
+	}
+}
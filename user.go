@@ -1,15 +1,58 @@
 package main
 
+// user.go manages user accounts, including registration, login, logout, and
+// the user pages that show the contribution history of each user.
+
 import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
 	"encoding/json"
+	"errors"
+	"html/template"
+	"io"
+	"net/http"
+	"path/filepath"
+	"sort"
+	"strings"
 	"time"
 
 	"github.com/boltdb/bolt"
+	"golang.org/x/crypto/blake2b"
 )
 
 const (
-	loginPage  = "/login.go"
-	userPrefix = "/u/"
+	loginPage    = "/login.go"
+	logoutPage   = "/logout.go"
+	passwordPage = "/password.go"
+	registerPage = "/register.go"
+	userPrefix   = "/u/"
+
+	loginTitle    = "Log in to Herus"
+	passwordTitle = "Change Your Password"
+	registerTitle = "Create a Herus Account"
+	userTitle     = "Contributions"
+
+	maxUsernameLen = 32
+	minPasswordLen = 8
+	saltLen        = 16
+)
+
+var (
+	loginTpl    = filepath.Join(dirTemplates, "login.tpl")
+	passwordTpl = filepath.Join(dirTemplates, "password.tpl")
+	registerTpl = filepath.Join(dirTemplates, "register.tpl")
+	userTpl     = filepath.Join(dirTemplates, "user.tpl")
+
+	errInvalidLogin     = errors.New("username or password is incorrect")
+	errInvalidUsername  = errors.New("usernames may only contain letters, numbers, '-' and '_'")
+	errLongUsername     = errors.New("username is too long")
+	errMissingUsername  = errors.New("a username is required")
+	errNotLoggedIn      = errors.New("you must be logged in to do that")
+	errPasswordMismatch = errors.New("passwords do not match")
+	errShortPassword    = errors.New("password must be at least 8 characters")
+	errWrongPassword    = errors.New("current password is incorrect")
+	errUsernameTaken    = errors.New("username is already taken")
 )
 
 // flags can be given to users if they are believed to be behaving in an
@@ -31,34 +74,471 @@ type User struct {
 	Posts uint64
 	Votes uint64
 
+	// Moderation information. RecentFlags holds the times of the flags that
+	// the user has submitted, used to rate limit flagging.
+	RecentFlags []time.Time
+	Suspended   bool
+
 	// Membership information.
 	DateStarted string
 	DateEnded   string
 	MemberType  string
 }
 
+// userTemplateData defines the data which is used to fill out the login,
+// register, and password template files.
+type userTemplateData struct {
+	Error            string
+	ErrorExists      bool
+	Name             string
+	Email            string
+	PostWithoutError bool
+}
+
+// userMediaContribution is a piece of media that a user added to a topic.
+type userMediaContribution struct {
+	Topic string
+	mediaRelation
+}
+
+// userElaborationContribution is a piece of media that a user added as an
+// elaboration to another piece of media.
+type userElaborationContribution struct {
+	Parent string
+	mediaElaboration
+}
+
+// userConnectionContribution is a connection that a user made between two
+// topics.
+type userConnectionContribution struct {
+	Source string
+	topicRelation
+}
+
+// userPageTemplateData defines the data which is used to fill out the user
+// template file.
+type userPageTemplateData struct {
+	ElaborationPrefix string
+	FlagPage          string
+	TopicPrefix       string
+
+	Name        string
+	DateStarted string
+	Posts       uint64
+	Votes       uint64
+
+	Connections  []userConnectionContribution
+	Elaborations []userElaborationContribution
+	Media        []userMediaContribution
+}
+
+// hashPassword returns the hash of a password, salted with the user's salt and
+// username.
+func hashPassword(salt, name, password string) []byte {
+	hash := blake2b.Sum256([]byte(salt + name + password))
+	return hash[:]
+}
+
+// randomHex returns a hex encoded string of n random bytes.
+func randomHex(n int) (string, error) {
+	b := make([]byte, n)
+	_, err := rand.Read(b)
+	if err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// normalizeUsername lowercases a username and checks that it is made up of
+// characters that are safe to put in a url.
+func normalizeUsername(name string) (string, error) {
+	name = strings.ToLower(strings.TrimSpace(name))
+	if name == "" {
+		return "", errMissingUsername
+	}
+	if len(name) > maxUsernameLen {
+		return "", errLongUsername
+	}
+	for _, c := range name {
+		if !(c >= 'a' && c <= 'z') && !(c >= '0' && c <= '9') && c != '-' && c != '_' {
+			return "", errInvalidUsername
+		}
+	}
+	return name, nil
+}
+
+// getUser returns the user with the provided name from the users bucket.
+func getUser(tx *bolt.Tx, name string) (user User, exists bool, err error) {
+	bu := tx.Bucket(bucketUsers)
+	userBytes := bu.Get([]byte(name))
+	if userBytes == nil {
+		return User{}, false, nil
+	}
+	err = json.Unmarshal(userBytes, &user)
+	if err != nil {
+		return User{}, true, err
+	}
+	return user, true, nil
+}
+
+// putUser stores the provided user in the users bucket.
+func putUser(tx *bolt.Tx, user User) error {
+	userBytes, err := json.Marshal(user)
+	if err != nil {
+		return err
+	}
+	bu := tx.Bucket(bucketUsers)
+	return bu.Put([]byte(user.Name), userBytes)
+}
+
+// incrementPosts adds one to the number of posts made by a user.
+func incrementPosts(tx *bolt.Tx, name string) error {
+	user, exists, err := getUser(tx, name)
+	if err != nil {
+		return err
+	}
+	if !exists {
+		return errInvalidLogin
+	}
+	user.Posts++
+	return putUser(tx, user)
+}
+
+// userContributions scans the topics and media buckets for everything that
+// was submitted by the named user, most recent first. Submissions that have
+// been hidden by a moderator are left out.
+func userContributions(tx *bolt.Tx, name string, uptd *userPageTemplateData) error {
+	err := tx.Bucket(bucketTopics).ForEach(func(k, v []byte) error {
+		var td topicData
+		err := json.Unmarshal(v, &td)
+		if err != nil {
+			return err
+		}
+		for _, am := range visibleMedia(td.AssociatedMedia) {
+			if am.Submitter == name {
+				uptd.Media = append(uptd.Media, userMediaContribution{Topic: string(k), mediaRelation: am})
+			}
+		}
+		for _, rt := range visibleTopics(td.RelatedTopics) {
+			if rt.Submitter == name {
+				uptd.Connections = append(uptd.Connections, userConnectionContribution{Source: string(k), topicRelation: rt})
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	err = tx.Bucket(bucketMedia).ForEach(func(k, v []byte) error {
+		var mm mediaMetadata
+		err := json.Unmarshal(v, &mm)
+		if err != nil {
+			return err
+		}
+		for _, me := range visibleElaborations(mm.Elaborations) {
+			if me.Submitter == name {
+				uptd.Elaborations = append(uptd.Elaborations, userElaborationContribution{Parent: string(k), mediaElaboration: me})
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	sort.Slice(uptd.Connections, func(i, j int) bool {
+		return uptd.Connections[i].SubmissionDate.After(uptd.Connections[j].SubmissionDate)
+	})
+	sort.Slice(uptd.Elaborations, func(i, j int) bool {
+		return uptd.Elaborations[i].SubmissionDate.After(uptd.Elaborations[j].SubmissionDate)
+	})
+	sort.Slice(uptd.Media, func(i, j int) bool {
+		return uptd.Media[i].SubmissionDate.After(uptd.Media[j].SubmissionDate)
+	})
+	return nil
+}
+
 // Add a user to the users bucket.
 // In the style of CreateUser() from the boltdb readme.
-// Assumes username uniqueness already verified.
+// Username uniqueness is verified in the same transaction as the write.
 func (h *herus) initUser(user *User) error {
 	return h.db.Update(func(tx *bolt.Tx) error {
-		users := tx.Bucket(bucketUsers)
-		encoded, err := json.Marshal(user)
+		_, exists, err := getUser(tx, user.Name)
 		if err != nil {
 			return err
 		}
-		// Stick bytes into users bucket.
-		return users.Put([]byte(user.Name), encoded)
+		if exists {
+			return errUsernameTaken
+		}
+		if user.MemberType == "" {
+			user.MemberType = newMemberType(tx)
+		}
+		return putUser(tx, *user)
+	})
+}
+
+// executeUserBody builds the body portion of the login, register, or password
+// page.
+func executeUserBody(w io.Writer, tpl string, utd userTemplateData) error {
+	t, err := template.ParseFiles(tpl)
+	if err != nil {
+		return err
+	}
+	return t.Execute(w, utd)
+}
+
+// serveUserPage writes the login, register, or password page, including any
+// error that occurred while processing a submission.
+func serveUserPage(w http.ResponseWriter, title string, tpl string, utd userTemplateData) {
+	err := executeHeader(w, HeaderTemplateData{Title: title})
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	err = executeUserBody(w, tpl, utd)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	err = executeFooter(w)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+}
+
+// processRegistration creates a new user from the submitted registration
+// form.
+func (h *herus) processRegistration(r *http.Request) (User, error) {
+	err := r.ParseForm()
+	if err != nil {
+		return User{}, err
+	}
+	name, err := normalizeUsername(r.FormValue("username"))
+	if err != nil {
+		return User{}, err
+	}
+	password := r.FormValue("password")
+	if len(password) < minPasswordLen {
+		return User{}, errShortPassword
+	}
+	if password != r.FormValue("confirmPassword") {
+		return User{}, errPasswordMismatch
+	}
+	salt, err := randomHex(saltLen)
+	if err != nil {
+		return User{}, err
+	}
+
+	user := User{
+		Email:          strings.TrimSpace(r.FormValue("email")),
+		HashedPassword: hashPassword(salt, name, password),
+		Name:           name,
+		Salt:           salt,
+
+		DateStarted: time.Now().Format(time.RFC3339),
+	}
+	return user, h.initUser(&user)
+}
+
+// processLogin checks the submitted credentials, returning the user if they
+// are correct.
+func (h *herus) processLogin(r *http.Request) (User, error) {
+	err := r.ParseForm()
+	if err != nil {
+		return User{}, err
+	}
+	name, err := normalizeUsername(r.FormValue("username"))
+	if err != nil {
+		return User{}, errInvalidLogin
+	}
+	password := r.FormValue("password")
+
+	var user User
+	var exists bool
+	err = h.db.View(func(tx *bolt.Tx) error {
+		user, exists, err = getUser(tx, name)
+		return err
+	})
+	if err != nil {
+		return User{}, err
+	}
+	if !exists {
+		return User{}, errInvalidLogin
+	}
+	hash := hashPassword(user.Salt, user.Name, password)
+	if subtle.ConstantTimeCompare(hash, user.HashedPassword) != 1 {
+		return User{}, errInvalidLogin
+	}
+	if user.Suspended {
+		return User{}, errSuspendedLogin
+	}
+	return user, nil
+}
+
+// processPasswordChange verifies the user's current password and replaces it
+// with the newly submitted password.
+func (h *herus) processPasswordChange(r *http.Request, user User) error {
+	err := r.ParseForm()
+	if err != nil {
+		return err
+	}
+	password := r.FormValue("newPassword")
+	if len(password) < minPasswordLen {
+		return errShortPassword
+	}
+	if password != r.FormValue("confirmPassword") {
+		return errPasswordMismatch
+	}
+	salt, err := randomHex(saltLen)
+	if err != nil {
+		return err
+	}
+
+	return h.db.Update(func(tx *bolt.Tx) error {
+		// Reload the user so that the check happens against the most recent
+		// password.
+		user, exists, err := getUser(tx, user.Name)
+		if err != nil {
+			return err
+		}
+		if !exists {
+			return errInvalidLogin
+		}
+		hash := hashPassword(user.Salt, user.Name, r.FormValue("password"))
+		if subtle.ConstantTimeCompare(hash, user.HashedPassword) != 1 {
+			return errWrongPassword
+		}
+
+		user.Salt = salt
+		user.HashedPassword = hashPassword(salt, user.Name, password)
+		err = putUser(tx, user)
+		if err != nil {
+			return err
+		}
+		err = revokeUserSessions(tx, user.Name)
+		if err != nil {
+			return err
+		}
+		return revokeUserTokens(tx, user.Name)
 	})
 }
 
-// Voting needs to be aware of what each user has voted for. Some archetecture
-// that tracks when a user has voted for something and remembers which way the
-// vote went. So, we can use a map. Page+item+user -> vote value. Which means
-// you can't easily pull a full list of things a user has voted on without
-// doing a bigger scan.
+// registerHandler handles requests to the register page.
+func (h *herus) registerHandler(w http.ResponseWriter, r *http.Request) {
+	var utd userTemplateData
+	if r.Method == "POST" {
+		user, err := h.processRegistration(r)
+		if err == nil {
+			err = h.startSession(w, r, user)
+		}
+		if err == nil {
+			http.Redirect(w, r, indexPage, http.StatusSeeOther)
+			return
+		}
+		utd.ErrorExists = true
+		utd.Error = err.Error()
+		utd.Name = r.FormValue("username")
+		utd.Email = r.FormValue("email")
+	}
+	serveUserPage(w, registerTitle, registerTpl, utd)
+}
+
+// loginHandler handles requests to the login page.
+func (h *herus) loginHandler(w http.ResponseWriter, r *http.Request) {
+	var utd userTemplateData
+	if r.Method == "POST" {
+		user, err := h.processLogin(r)
+		if err == nil {
+			err = h.startSession(w, r, user)
+		}
+		if err == nil {
+			http.Redirect(w, r, indexPage, http.StatusSeeOther)
+			return
+		}
+		utd.ErrorExists = true
+		utd.Error = err.Error()
+		utd.Name = r.FormValue("username")
+	}
+	serveUserPage(w, loginTitle, loginTpl, utd)
+}
 
-// [prefix][user][prefix][page][prefix][item] -> vote value. That allows you to
-// scan the bucket to get a vote history. Upload history can be retrieved by
-// scanning everything as well. If it becomes necessary to pull up those stats
-// regularly, another thing can be added.
+// passwordHandler handles requests to the change password page. Changing the
+// password logs the user out of every other session.
+func (h *herus) passwordHandler(w http.ResponseWriter, r *http.Request) {
+	user, ok := currentUser(r)
+	if !ok {
+		http.Redirect(w, r, loginPage, http.StatusSeeOther)
+		return
+	}
+
+	var utd userTemplateData
+	if r.Method == "POST" {
+		err := h.processPasswordChange(r, user)
+		if err == nil {
+			err = h.startSession(w, r, user)
+		}
+		if err != nil {
+			utd.ErrorExists = true
+			utd.Error = err.Error()
+		} else {
+			utd.PostWithoutError = true
+		}
+	}
+	serveUserPage(w, passwordTitle, passwordTpl, utd)
+}
+
+// userHandler handles requests for user pages, which list the contributions
+// that the user has made.
+func (h *herus) userHandler(w http.ResponseWriter, r *http.Request) {
+	name := strings.ToLower(strings.TrimPrefix(r.URL.Path, userPrefix))
+
+	var user User
+	var exists bool
+	uptd := userPageTemplateData{
+		ElaborationPrefix: elaborationPrefix,
+		FlagPage:          flagPage,
+		TopicPrefix:       topicPrefix,
+	}
+	err := h.db.View(func(tx *bolt.Tx) error {
+		var err error
+		user, exists, err = getUser(tx, name)
+		if err != nil || !exists {
+			return err
+		}
+		return userContributions(tx, name, &uptd)
+	})
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if !exists {
+		rootHandler(w, r)
+		return
+	}
+	uptd.Name = user.Name
+	uptd.DateStarted = user.DateStarted
+	uptd.Posts = user.Posts
+	uptd.Votes = user.Votes
+
+	err = executeHeader(w, HeaderTemplateData{Title: user.Name + " - " + userTitle})
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	t, err := template.ParseFiles(userTpl)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	err = t.Execute(w, uptd)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	err = executeFooter(w)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+}
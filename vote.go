@@ -0,0 +1,467 @@
+package main
+
+// vote.go handles the voting on media, topic relations, and elaborations.
+//
+// Votes are cast along two axes. The first axis is quality, which is an up or
+// down vote. The second axis is the position of the item relative to the page
+// that it appears on. For media on a topic page, a left vote means the media
+// is too basic for the topic and a right vote means the media is too advanced.
+// For a related topic, a left vote means the related topic is more basic than
+// the topic, a center vote means the two are at the same level, and a right
+// vote means the related topic is more advanced. Elaborations only have the
+// quality axis.
+//
+// Every vote is stored in the votes bucket under the key
+// [u][user][0][p][kind:page][0][i][item], which allows the full vote history
+// of a user to be pulled up with a prefix scan. The vote counters on the
+// relation structs are updated in the same transaction as the vote itself so
+// that the counters always agree with the votes bucket.
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/boltdb/bolt"
+)
+
+const (
+	votePage = "/vote.go"
+
+	itemKindElaboration = "elaboration"
+	itemKindMedia       = "media"
+	itemKindTopic       = "topic"
+
+	voteDown = -1
+	voteNone = 0
+	voteUp   = 1
+
+	positionCenter = "center"
+	positionLeft   = "left"
+	positionNone   = ""
+	positionRight  = "right"
+
+	// submittedUpvotes is the number of upvotes that media, relations, and
+	// elaborations start with when they are submitted.
+	submittedUpvotes = 3
+)
+
+var (
+	errInvalidItemKind = errors.New("items must be media, topics, or elaborations")
+	errInvalidPosition = errors.New("position is not available for this item")
+	errInvalidVote     = errors.New("vote must be 'up', 'down', or 'none'")
+	errMissingItem     = errors.New("the item does not exist")
+)
+
+// userVote is the value stored in the votes bucket for each vote that has
+// been cast.
+type userVote struct {
+	Date     time.Time
+	Position string
+	Value    int
+}
+
+// voteCounter is implemented by each of the relation types that can be voted
+// on.
+type voteCounter interface {
+	counters() (up *uint64, down *uint64)
+}
+
+// positionCounter is implemented by each of the relation types that can be
+// voted on along the position axis. positionCounter returns nil if the
+// position is not supported by the relation type.
+type positionCounter interface {
+	positionCounter(position string) *uint64
+}
+
+// counters returns the vote counters of a media relation.
+func (mr *mediaRelation) counters() (*uint64, *uint64) {
+	return &mr.Upvotes, &mr.Downvotes
+}
+
+// counters returns the vote counters of a topic relation.
+func (tr *topicRelation) counters() (*uint64, *uint64) {
+	return &tr.Upvotes, &tr.Downvotes
+}
+
+// counters returns the vote counters of an elaboration.
+func (me *mediaElaboration) counters() (*uint64, *uint64) {
+	return &me.Upvotes, &me.Downvotes
+}
+
+// positionCounter returns the counter of a media relation for a position.
+// Media can only be too basic or too advanced.
+func (mr *mediaRelation) positionCounter(position string) *uint64 {
+	switch position {
+	case positionLeft:
+		return &mr.LeftVotes
+	case positionRight:
+		return &mr.RightVotes
+	}
+	return nil
+}
+
+// positionCounter returns the counter of a topic relation for a position.
+func (tr *topicRelation) positionCounter(position string) *uint64 {
+	switch position {
+	case positionLeft:
+		return &tr.LeftVotes
+	case positionCenter:
+		return &tr.CenterVotes
+	case positionRight:
+		return &tr.RightVotes
+	}
+	return nil
+}
+
+// positionPercent returns where an item sits on the position axis, from 0
+// (entirely left) to 100 (entirely right). Items without any position votes
+// sit at 50.
+func positionPercent(left, center, right uint64) int {
+	total := left + center + right
+	if total == 0 {
+		return 50
+	}
+	return int((50*center + 100*right) / total)
+}
+
+// PositionPercent returns where the media sits between too basic and too
+// advanced.
+func (mr mediaRelation) PositionPercent() int {
+	return positionPercent(mr.LeftVotes, 0, mr.RightVotes)
+}
+
+// PositionVotes returns the number of position votes cast on the media.
+func (mr mediaRelation) PositionVotes() uint64 {
+	return mr.LeftVotes + mr.RightVotes
+}
+
+// PositionPercent returns where the related topic sits between more basic and
+// more advanced.
+func (tr topicRelation) PositionPercent() int {
+	return positionPercent(tr.LeftVotes, tr.CenterVotes, tr.RightVotes)
+}
+
+// PositionVotes returns the number of position votes cast on the related
+// topic.
+func (tr topicRelation) PositionVotes() uint64 {
+	return tr.LeftVotes + tr.CenterVotes + tr.RightVotes
+}
+
+// voteKey returns the key in the votes bucket for a user's vote on an item.
+func voteKey(user, kind, page, item string) []byte {
+	return []byte("u" + user + "\x00p" + kind + ":" + page + "\x00i" + item)
+}
+
+// parseVoteKey splits a key of the votes bucket back into the user, kind,
+// page, and item of the vote.
+func parseVoteKey(key []byte) (user, kind, page, item string, ok bool) {
+	parts := strings.Split(string(key), "\x00")
+	if len(parts) != 3 || !strings.HasPrefix(parts[0], "u") || !strings.HasPrefix(parts[1], "p") || !strings.HasPrefix(parts[2], "i") {
+		return "", "", "", "", false
+	}
+	kindPage := strings.SplitN(parts[1][1:], ":", 2)
+	if len(kindPage) != 2 {
+		return "", "", "", "", false
+	}
+	return parts[0][1:], kindPage[0], kindPage[1], parts[2][1:], true
+}
+
+// parseVoteValue converts the value submitted by a vote form into a vote.
+func parseVoteValue(value string) (int, error) {
+	switch value {
+	case "up":
+		return voteUp, nil
+	case "down":
+		return voteDown, nil
+	case "none", "":
+		return voteNone, nil
+	}
+	return 0, errInvalidVote
+}
+
+// parsePosition converts the position submitted by a vote form into a
+// position.
+func parsePosition(position string) (string, error) {
+	switch position {
+	case positionLeft, positionCenter, positionRight:
+		return position, nil
+	case "none":
+		return positionNone, nil
+	}
+	return "", errInvalidPosition
+}
+
+// getVote returns the vote that a user has cast on an item. If the user has
+// not voted on the item, a vote with value voteNone is returned.
+func getVote(tx *bolt.Tx, key []byte) (uv userVote, err error) {
+	voteBytes := tx.Bucket(bucketVotes).Get(key)
+	if voteBytes == nil {
+		return userVote{}, nil
+	}
+	err = json.Unmarshal(voteBytes, &uv)
+	return uv, err
+}
+
+// adjustCounters removes the effect of the old vote from the counters of an
+// item and applies the new vote.
+func adjustCounters(c voteCounter, oldVote, newVote userVote) error {
+	up, down := c.counters()
+	switch oldVote.Value {
+	case voteUp:
+		if *up > 0 {
+			*up--
+		}
+	case voteDown:
+		if *down > 0 {
+			*down--
+		}
+	}
+	switch newVote.Value {
+	case voteUp:
+		*up++
+	case voteDown:
+		*down++
+	}
+
+	if oldVote.Position == newVote.Position {
+		return nil
+	}
+	pc, ok := c.(positionCounter)
+	if !ok {
+		return errInvalidPosition
+	}
+	if oldVote.Position != positionNone {
+		counter := pc.positionCounter(oldVote.Position)
+		if counter != nil && *counter > 0 {
+			*counter--
+		}
+	}
+	if newVote.Position != positionNone {
+		counter := pc.positionCounter(newVote.Position)
+		if counter == nil {
+			return errInvalidPosition
+		}
+		*counter++
+	}
+	return nil
+}
+
+// recountVotes resets the counters of an item to those of a newly submitted
+// item and then applies every vote in the votes bucket that was cast on the
+// item on the page, so that the counters agree with the votes bucket again.
+func recountVotes(tx *bolt.Tx, kind, page, item string, c voteCounter) error {
+	up, down := c.counters()
+	*up, *down = submittedUpvotes, 0
+	if pc, ok := c.(positionCounter); ok {
+		for _, position := range []string{positionLeft, positionCenter, positionRight} {
+			if counter := pc.positionCounter(position); counter != nil {
+				*counter = 0
+			}
+		}
+	}
+	return tx.Bucket(bucketVotes).ForEach(func(k, v []byte) error {
+		_, voteKind, votePage, voteItem, ok := parseVoteKey(k)
+		if !ok || voteKind != kind || votePage != page || voteItem != item {
+			return nil
+		}
+		var uv userVote
+		err := json.Unmarshal(v, &uv)
+		if err != nil {
+			return err
+		}
+		return adjustCounters(c, userVote{}, uv)
+	})
+}
+
+// findItem finds an item on a page. The returned save function writes the
+// page, including any changes made to the item, back to the database on
+// behalf of the author. Saves of topics where only the vote counters changed
+// skip the revision history and indexes of the topic.
+func findItem(tx *bolt.Tx, kind, page, item, author string) (c voteCounter, save func(votesOnly bool) error, err error) {
+	switch kind {
+	case itemKindMedia, itemKindTopic:
+		td, exists, err := getTopic(tx, page)
+		if err != nil {
+			return nil, nil, err
+		}
+		if !exists {
+			return nil, nil, errMissingItem
+		}
+		if kind == itemKindMedia {
+			for i := range td.AssociatedMedia {
+				if td.AssociatedMedia[i].Hash == item {
+					c = &td.AssociatedMedia[i]
+				}
+			}
+		} else {
+			for i := range td.RelatedTopics {
+				if td.RelatedTopics[i].Title == item {
+					c = &td.RelatedTopics[i]
+				}
+			}
+		}
+		if c == nil {
+			return nil, nil, errMissingItem
+		}
+		return c, func(votesOnly bool) error {
+			if votesOnly {
+				return putTopicData(tx, page, td)
+			}
+			return putTopic(tx, page, td, author)
+		}, nil
+
+	case itemKindElaboration:
+		mm, exists, err := getMediaMetadata(tx, page)
+		if err != nil {
+			return nil, nil, err
+		}
+		if !exists {
+			return nil, nil, errMissingItem
+		}
+		for i := range mm.Elaborations {
+			if mm.Elaborations[i].Hash == item {
+				c = &mm.Elaborations[i]
+			}
+		}
+		if c == nil {
+			return nil, nil, errMissingItem
+		}
+		return c, func(bool) error { return putMediaMetadata(tx, page, mm) }, nil
+	}
+	return nil, nil, errInvalidItemKind
+}
+
+// updateItem finds an item on a page and hands it to fn to be modified. The
+// page is saved after fn returns.
+func updateItem(tx *bolt.Tx, kind, page, item, author string, fn func(c voteCounter) error) error {
+	c, save, err := findItem(tx, kind, page, item, author)
+	if err != nil {
+		return err
+	}
+	err = fn(c)
+	if err != nil {
+		return err
+	}
+	return save(false)
+}
+
+// applyVote finds the item being voted on and updates its counters.
+func applyVote(tx *bolt.Tx, kind, page, item, author string, oldVote, newVote userVote) error {
+	c, save, err := findItem(tx, kind, page, item, author)
+	if err != nil {
+		return err
+	}
+	err = adjustCounters(c, oldVote, newVote)
+	if err != nil {
+		return err
+	}
+	return save(true)
+}
+
+// castVote records a user's vote on an item. The update function is handed a
+// copy of the vote that the user previously cast on the item and modifies it
+// to become the new vote. A vote with no value and no position is retracted.
+func (h *herus) castVote(user User, kind, page, item string, update func(*userVote)) error {
+	return h.db.Update(func(tx *bolt.Tx) error {
+		key := voteKey(user.Name, kind, page, item)
+		oldVote, err := getVote(tx, key)
+		if err != nil {
+			return err
+		}
+		newVote := oldVote
+		update(&newVote)
+		if oldVote.Value == newVote.Value && oldVote.Position == newVote.Position {
+			return nil
+		}
+		err = applyVote(tx, kind, page, item, user.Name, oldVote, newVote)
+		if err != nil {
+			return err
+		}
+		oldCast := oldVote.Value != voteNone || oldVote.Position != positionNone
+		newCast := newVote.Value != voteNone || newVote.Position != positionNone
+
+		// Keep the user's vote total in sync with the votes bucket.
+		u, exists, err := getUser(tx, user.Name)
+		if err != nil {
+			return err
+		}
+		if !exists {
+			return errInvalidLogin
+		}
+		if !oldCast {
+			u.Votes++
+		} else if !newCast && u.Votes > 0 {
+			u.Votes--
+		}
+		err = putUser(tx, u)
+		if err != nil {
+			return err
+		}
+
+		bv := tx.Bucket(bucketVotes)
+		if !newCast {
+			return bv.Delete(key)
+		}
+		newVote.Date = time.Now()
+		voteBytes, err := json.Marshal(newVote)
+		if err != nil {
+			return err
+		}
+		return bv.Put(key, voteBytes)
+	})
+}
+
+// voteHandler handles requests to cast, change, or retract a vote. Forms that
+// submit a 'position' vote on the position axis, all other forms vote on the
+// quality axis. After the vote is processed, the user is sent back to the
+// page that holds the item, or to the topic named in 'return' for items that
+// are shown on a page other than the one that holds them.
+func (h *herus) voteHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "votes must be submitted with a POST request", http.StatusMethodNotAllowed)
+		return
+	}
+	user, _ := currentUser(r)
+	err := r.ParseForm()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	kind := r.FormValue("kind")
+	page := r.FormValue("page")
+	item := r.FormValue("item")
+	var update func(*userVote)
+	if _, ok := r.Form["position"]; ok {
+		position, err := parsePosition(r.FormValue("position"))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		update = func(uv *userVote) { uv.Position = position }
+	} else {
+		value, err := parseVoteValue(r.FormValue("value"))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		update = func(uv *userVote) { uv.Value = value }
+	}
+
+	err = h.castVote(user, kind, page, item, update)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if kind == itemKindElaboration {
+		http.Redirect(w, r, elaborationPrefix+page, http.StatusSeeOther)
+		return
+	}
+	if back := r.FormValue("return"); back != "" {
+		page = back
+	}
+	http.Redirect(w, r, topicURL(page), http.StatusSeeOther)
+}
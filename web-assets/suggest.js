@@ -0,0 +1,39 @@
+// suggest.js offers existing topics and media as suggestions for any input
+// with a data-suggest attribute of 'topic' or 'media'. Suggestions are pulled
+// from /api/suggest as the user types and shown with a datalist.
+(function() {
+	var inputs = document.querySelectorAll('input[data-suggest]');
+	Array.prototype.forEach.call(inputs, function(input, i) {
+		var list = document.createElement('datalist');
+		list.id = 'suggest-' + i;
+		input.setAttribute('list', list.id);
+		input.parentNode.insertBefore(list, input.nextSibling);
+
+		var pending = null;
+		input.addEventListener('input', function() {
+			var prefix = input.value;
+			if (pending) {
+				clearTimeout(pending);
+			}
+			pending = setTimeout(function() {
+				var url = '/api/suggest?kind=' + encodeURIComponent(input.dataset.suggest) +
+					'&prefix=' + encodeURIComponent(prefix);
+				fetch(url, {credentials: 'same-origin'}).then(function(resp) {
+					return resp.json();
+				}).then(function(suggestions) {
+					if (input.value !== prefix || !Array.isArray(suggestions)) {
+						return;
+					}
+					list.innerHTML = '';
+					suggestions.forEach(function(s) {
+						var option = document.createElement('option');
+						option.value = s.name;
+						option.label = s.title;
+						option.textContent = s.title;
+						list.appendChild(option);
+					});
+				});
+			}, 150);
+		});
+	});
+})();